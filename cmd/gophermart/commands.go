@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gambruh/gophermart/internal/config"
+	"github.com/gambruh/gophermart/internal/database"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrUsage          = errors.New("usage: gophermart [flags] migrate up|down [steps]|status | reconcile [fix] | roles login [role...]")
+)
+
+// runCommand handles maintenance subcommands given after the flags
+func runCommand(args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(args[1:])
+	case "reconcile":
+		return runReconcile(args[1:])
+	case "roles":
+		return runRoles(args[1:])
+	default:
+		return fmt.Errorf("%w %q, %v", ErrUnknownCommand, args[0], ErrUsage)
+	}
+}
+
+func openDB() (*database.SQLdb, error) {
+	if config.Cfg.Database == "" {
+		return nil, errors.New("database uri is not set: use -d flag or DATABASE_URI")
+	}
+	return database.NewSQLdb(config.Cfg.Database), nil
+}
+
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("applied %d migration(s)\n", applied)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return ErrUsage
+			}
+			steps = n
+		}
+		rolledBack, err := db.MigrateDown(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("rolled back %d migration(s)\n", rolledBack)
+	case "status":
+		statuses, err := db.MigrationStatus(ctx)
+		for _, st := range statuses {
+			applied := "pending"
+			if st.AppliedAt != nil {
+				applied = st.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-30s %s\n", st.Version, st.Name, applied)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return ErrUsage
+	}
+	return nil
+}
+
+// runReconcile reports balances that differ from the sum of operations and
+// rewrites them when called with "fix"
+func runReconcile(args []string) error {
+	fix := false
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "fix":
+		fix = true
+	default:
+		return ErrUsage
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	drifts, err := db.ReconcileBalances(context.Background(), fix)
+	for _, d := range drifts {
+		fmt.Printf("%s (id %d): recorded current=%v withdrawn=%v, operations give current=%v withdrawn=%v\n",
+			d.Login, d.UserID, d.Recorded.Current, d.Recorded.Withdrawn, d.Actual.Current, d.Actual.Withdrawn)
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(drifts) == 0:
+		fmt.Println("all balances match operations")
+	case fix:
+		fmt.Printf("fixed %d balance(s)\n", len(drifts))
+	default:
+		fmt.Printf("%d balance(s) drifted, run \"reconcile fix\" to rewrite them\n", len(drifts))
+	}
+	return nil
+}
+
+// runRoles sets the roles of a user, it is how the first operator gets the
+// admin role. Without roles it prints the current ones
+func runRoles(args []string) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	login := args[0]
+	if len(args) > 1 {
+		if err = db.SetRoles(ctx, login, args[1:]); err != nil {
+			return err
+		}
+	}
+	roles, err := db.GetRoles(ctx, login)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %v\n", login, roles)
+	return nil
+}
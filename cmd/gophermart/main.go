@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gambruh/gophermart/internal/accrualworker"
 	"github.com/gambruh/gophermart/internal/auth"
@@ -11,22 +18,89 @@ import (
 	"github.com/gambruh/gophermart/internal/handlers"
 )
 
+// shutdownTimeout bounds how long in-flight requests and the accrual agent
+// get to finish after a termination signal
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	config.InitFlags()
 	config.SetConfig()
-	authstorage := auth.GetAuthDB()
+
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	keyring, err := auth.LoadKeyring()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if keyring != nil {
+		auth.SetKeyring(keyring)
+	}
+
 	defstorage := database.GetDB()
+	var authstorage auth.AuthStorage
+	if mem, ok := defstorage.(*database.MemStorage); ok {
+		// users registered through the API have to be seen by the order storage
+		authstorage = mem
+	} else {
+		authstorage = auth.GetAuthDB()
+	}
 
-	service := handlers.NewService(defstorage, authstorage)
 	agent := accrualworker.NewAgent(defstorage)
+	service := handlers.NewService(defstorage, authstorage)
+	service.Accrual = agent
 
 	server := &http.Server{
 		Addr:    config.Cfg.Address,
 		Handler: service.Service(),
 	}
 
-	go agent.CheckAccrual()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	log.Println(server.ListenAndServe())
+	agentDone := make(chan struct{})
+	go func() {
+		defer close(agentDone)
+		agent.CheckAccrual(ctx)
+	}()
 
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down")
+	case err := <-serverErr:
+		log.Println(err)
+		stop()
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(shutdownCtx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("error when shutting down http server:", err)
+	}
+
+	// the agent finishes its current cycle, so accrual results already
+	// received are committed before the storage is closed
+	select {
+	case <-agentDone:
+	case <-shutdownCtx.Done():
+		log.Println("accrual agent didn't stop in time")
+	}
+
+	if err = defstorage.Close(); err != nil {
+		log.Println("error when closing storage:", err)
+	}
+	if err = authstorage.Close(); err != nil {
+		log.Println("error when closing auth storage:", err)
+	}
 }
@@ -1,6 +1,7 @@
 package accrualworker
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -17,12 +18,22 @@ import (
 	"github.com/gambruh/gophermart/internal/database"
 )
 
-const workersmax = 1
 const pingtime = 5
 
+// maxbackoff caps the delay between polling cycles while they keep failing
+const maxbackoff = 5 * time.Minute
+
+// batchsize is the amount of accrual results written to storage in one transaction
+const batchsize = 50
+
+// claimsize is the most orders checked in one polling cycle, the rest wait for the next one
+const claimsize = 1000
+
 var (
 	ErrTooManyReqs = errors.New("too many requests")
 	ErrNoNewOrders = errors.New("no orders for accrual")
+	// ErrAccrualUnavailable is returned while the circuit breaker keeps requests from the accrual system
+	ErrAccrualUnavailable = errors.New("accrual system is unavailable")
 )
 
 type SQLdb struct {
@@ -34,72 +45,263 @@ type Agent struct {
 	Server      string
 	Storage     database.Storage
 	AuthStorage auth.AuthStorage
+	Workers     int
 	Mu          *sync.Mutex
+	// Schedule spaces out the checks of the orders which stay pending
+	Schedule database.Schedule
+	// Lease keeps the orders the agent checks from the agents of other
+	// replicas sharing the database. A cycle claims no more orders than it
+	// can ask about within the lease and drops the results coming later
+	Lease time.Duration
+
+	limiter limiter
+	breaker breaker
 }
 
-func (a *Agent) CheckAccrual() error {
-	pingTime := time.NewTicker(pingtime * time.Second)
-	defer pingTime.Stop()
+// CheckAccrual polls the accrual system every pingtime seconds until ctx is
+// done. A failed cycle doesn't stop polling, the next one is delayed with an
+// exponential backoff instead. While the circuit breaker is open the next
+// cycle waits for its cooldown to end
+func (a *Agent) CheckAccrual(ctx context.Context) error {
+	failures := 0
+	wait := pingtime * time.Second
 	for {
-		<-pingTime.C
-		err := a.PingAccrual()
-		if err != nil {
-			log.Println("error while checking accrual:", err)
+		if err := sleep(ctx, wait); err != nil {
 			return err
 		}
+
+		err := a.PingAccrual(ctx)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		wait, failures = a.nextWait(err, failures)
+		if err != nil {
+			log.Printf("error while checking accrual (breaker %v), retrying in %v: %v\n", a.BreakerState(), wait, err)
+		}
 	}
 }
+
+// nextWait returns the delay before the next cycle and the count of failed
+// cycles in a row once a cycle has ended with err. A cycle cut short by the
+// open breaker isn't counted, it would only push the trial request back
+func (a *Agent) nextWait(err error, failures int) (time.Duration, int) {
+	switch {
+	case err == nil:
+		return pingtime * time.Second, 0
+	case errors.Is(err, ErrAccrualUnavailable):
+		if wait := a.breaker.Cooldown(); wait > 0 {
+			return wait, failures
+		}
+		return pingtime * time.Second, failures
+	default:
+		failures++
+		return backoff(failures, pingtime*time.Second, maxbackoff), failures
+	}
+}
+
+// BreakerState reports whether the agent currently sends requests to the accrual system
+func (a *Agent) BreakerState() BreakerState {
+	return a.breaker.State()
+}
+
 func NewAgent(st database.Storage) *Agent {
 	return &Agent{
 		Client:  &http.Client{},
 		Server:  config.Cfg.Accrual,
 		Storage: st,
+		Workers: config.Cfg.RateLimit,
 		Mu:      &sync.Mutex{},
+		Schedule: database.Schedule{
+			Interval:    pingtime * time.Second,
+			MaxInterval: config.Cfg.AccrualMaxCheckInterval,
+			StaleAfter:  config.Cfg.AccrualStaleAfter,
+		},
+		Lease: config.Cfg.AccrualLease,
 	}
 }
 
-func (a *Agent) askAccrual() ([]database.ProcessedOrder, error) {
-	var results []database.ProcessedOrder
-	ordsArr, err := a.Storage.GetOrdersForAccrual()
+// PingAccrual runs one polling cycle: orders due for a check are claimed, handed
+// to a pool of workers and their results are written to storage in batches as
+// they arrive. An order the accrual system fails to answer for is skipped until
+// its next check. So is an order not asked about before the lease of the
+// claim runs out, once it does another agent may be polling the order
+func (a *Agent) PingAccrual(ctx context.Context) error {
+	if !a.breaker.Ready() {
+		return ErrAccrualUnavailable
+	}
+
+	claimedAt := time.Now()
+	ordsArr, err := a.Storage.ClaimOrdersForAccrual(ctx, database.Claim{
+		At:       claimedAt,
+		Limit:    a.claimLimit(),
+		Schedule: a.Schedule,
+		Lease:    a.Lease,
+	})
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, ErrNoNewOrders
-		}
 		log.Println("error when trying to get orders from storage to ask accrual:", err)
-		return nil, err
+		return err
+	}
+	if len(ordsArr) == 0 {
+		return nil
 	}
 
-	for i := 0; i < len(ordsArr); i++ {
-		res, err := a.makeGetRequest(ordsArr[i])
-		if err != nil {
-			log.Println("error when sending order to accrual:", err)
-			return nil, err
+	// the workers stop with the lease, a tenth of it is left for saving
+	leaseCtx := ctx
+	if a.Lease > 0 {
+		var cancel context.CancelFunc
+		leaseCtx, cancel = context.WithDeadline(ctx, claimedAt.Add(a.Lease-a.Lease/10))
+		defer cancel()
+	}
+
+	jobs := make(chan string)
+	results := make(chan database.ProcessedOrder)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < a.workers(); i++ {
+		wg.Add(1)
+		go a.worker(leaseCtx, wg, jobs, results)
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, number := range ordsArr {
+			select {
+			case jobs <- number:
+			case <-leaseCtx.Done():
+				return
+			}
 		}
-		results = append(results, res)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	err = a.saveResults(results)
+	if err == nil && a.breaker.State() == BreakerOpen {
+		return ErrAccrualUnavailable
 	}
-	return results, nil
+	return err
 }
 
-func (a *Agent) worker(wg *sync.WaitGroup, jobs <-chan string, results chan<- database.ProcessedOrder) {
+// claimLimit is the most orders the agent can ask about within the lease at
+// the current rate limit, claimsize at most. The orders claimed beyond that
+// would only wait out the lease
+func (a *Agent) claimLimit() int {
+	interval := a.limiter.Interval()
+	if a.Lease <= 0 || interval <= 0 {
+		return claimsize
+	}
+	n := int(a.Lease / interval)
+	switch {
+	case n < 1:
+		return 1
+	case n > claimsize:
+		return claimsize
+	default:
+		return n
+	}
+}
+
+func (a *Agent) workers() int {
+	if a.Workers < 1 {
+		return 1
+	}
+	return a.Workers
+}
+
+// worker asks about the orders from jobs until ctx, bound to the lease of
+// the claim, is done. A result coming after that is dropped, the order may
+// have been claimed by another agent meanwhile
+func (a *Agent) worker(ctx context.Context, wg *sync.WaitGroup, jobs <-chan string, results chan<- database.ProcessedOrder) {
+	defer wg.Done()
 	for j := range jobs {
-		result, err := a.makeGetRequest(j)
+		result, err := a.askOrder(ctx, j)
+		if ctx.Err() != nil || errors.Is(err, ErrAccrualUnavailable) {
+			continue
+		}
 		if err != nil {
-			log.Println("error when sending order to accrual:", err)
-			return
+			log.Printf("error when sending order %s to accrual: %v\n", j, err)
+			continue
 		}
 		results <- result
 	}
-	wg.Done()
 }
 
-func (a *Agent) makeGetRequest(ordernumber string) (database.ProcessedOrder, error) {
+// askOrder requests the accrual status of an order, waiting out and retrying
+// as long as the accrual system answers 429. Every outcome is reported to the
+// circuit breaker
+func (a *Agent) askOrder(ctx context.Context, ordernumber string) (database.ProcessedOrder, error) {
+	for {
+		if err := a.limiter.Wait(ctx); err != nil {
+			return database.ProcessedOrder{}, err
+		}
+		if !a.breaker.Allow() {
+			return database.ProcessedOrder{}, ErrAccrualUnavailable
+		}
+
+		result, err := a.makeGetRequest(ctx, ordernumber)
+		switch {
+		case err == nil || errors.Is(err, ErrTooManyReqs):
+			a.breaker.Success()
+		case ctx.Err() != nil:
+			a.breaker.Abandon()
+		default:
+			a.breaker.Failure()
+		}
+
+		if !errors.Is(err, ErrTooManyReqs) {
+			return result, err
+		}
+	}
+}
+
+// saveResults drains results into storage batchsize orders at a time. A failed
+// batch doesn't stop the following ones, the first error is returned at the end.
+// Results with an unexpected status are skipped by the storage and don't fail
+// the cycle, those orders are checked again on their schedule
+func (a *Agent) saveResults(results <-chan database.ProcessedOrder) error {
+	var firstErr error
+	batch := make([]database.ProcessedOrder, 0, batchsize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := a.Storage.UpdateAccrual(batch)
+		switch {
+		case err == nil:
+		case errors.Is(err, database.ErrUnexpectedStatus):
+			log.Println("accrual results skipped:", err)
+		default:
+			log.Println("error in updatedatabase func of accrualworker:", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		batch = batch[:0]
+	}
+
+	for res := range results {
+		batch = append(batch, res)
+		if len(batch) == batchsize {
+			flush()
+		}
+	}
+	flush()
+
+	return firstErr
+}
+
+func (a *Agent) makeGetRequest(ctx context.Context, ordernumber string) (database.ProcessedOrder, error) {
 	var processed database.ProcessedOrder
 	url := fmt.Sprintf("%s/api/orders/%s", a.Server, ordernumber)
 	if !strings.HasPrefix(url, "http://") {
 		url = "http://" + url
 	}
 
-	r, err := http.NewRequest(http.MethodGet, url, nil)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		log.Println("error 1 in makeGetRequest:", err)
 		return database.ProcessedOrder{}, err
@@ -130,6 +332,7 @@ func (a *Agent) makeGetRequest(ordernumber string) (database.ProcessedOrder, err
 	case res.StatusCode == 204:
 		return database.ProcessedOrder{Number: ordernumber, Status: "NEW"}, nil
 	case res.StatusCode == 429:
+		a.throttle(res)
 		return database.ProcessedOrder{Number: ordernumber}, ErrTooManyReqs
 	default:
 		log.Println("unexpected response from accrual api. StatusCode:", res.StatusCode)
@@ -137,17 +340,18 @@ func (a *Agent) makeGetRequest(ordernumber string) (database.ProcessedOrder, err
 	}
 }
 
-func (a *Agent) PingAccrual() error {
-	input, err := a.askAccrual()
+// throttle pauses every worker for the period given in a 429 response and
+// adopts the rate limit the accrual system advertises in its body
+func (a *Agent) throttle(res *http.Response) {
+	retryAfter := parseRetryAfter(res.Header.Get("Retry-After"))
+	a.limiter.Pause(retryAfter)
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1024))
 	if err != nil {
-		log.Println("error in PingAccrual() func of accrualworker:", err)
-		return err
+		log.Println("error in reading 429 response body from accrual:", err)
 	}
-	err = a.Storage.UpdateAccrual(input)
-	if err != nil {
-		log.Println("error in updatedatabase func of accrualworker:", err)
-		return err
+	if perMinute, ok := parseRateLimit(string(body)); ok {
+		a.limiter.SetLimit(perMinute)
 	}
-
-	return nil
+	log.Printf("accrual asked to slow down: pausing for %v, limit is %v between requests\n", retryAfter, a.limiter.Interval())
 }
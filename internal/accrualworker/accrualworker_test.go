@@ -1,6 +1,7 @@
 package accrualworker
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -11,11 +12,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gambruh/gophermart/internal/auth"
+	"github.com/gambruh/gophermart/internal/config"
 	"github.com/gambruh/gophermart/internal/database"
 )
 
 func TestAgent_makeGetRequest(t *testing.T) {
-	var testval float32 = 500
+	var testval database.Money = 500_00
 
 	testAccrualStorage := map[string]database.ProcessedOrder{
 		"1234567897": {
@@ -62,8 +65,8 @@ func TestAgent_makeGetRequest(t *testing.T) {
 		},
 		Server: ts.URL,
 		Storage: &database.MemStorage{
-			Data: map[string]string{"Vasya": "secret", "Petya": "secretsecret", "Jenya": "123"},
-			Umap: map[string]string{"1234567897": "Vasya", "1234532313": "Vasya", "1234532339": "Petya"},
+			AuthMemStorage: auth.NewMemStorage(),
+			Umap:           map[string]string{"1234567897": "Vasya", "1234532313": "Vasya", "1234532339": "Petya"},
 			Orders: map[string][]database.Order{
 				"Vasya": {
 					database.Order{
@@ -142,7 +145,7 @@ func TestAgent_makeGetRequest(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := tt.a.makeGetRequest(tt.order)
+			got, err := tt.a.makeGetRequest(context.Background(), tt.order)
 			if err != nil {
 				t.Errorf("Agent.askAccrual() error = %v, ", err)
 				return
@@ -153,3 +156,239 @@ func TestAgent_makeGetRequest(t *testing.T) {
 		})
 	}
 }
+
+// recordingStorage serves a fixed list of orders for accrual and records
+// every batch passed to UpdateAccrual
+type recordingStorage struct {
+	database.Storage
+	orders  []string
+	mu      sync.Mutex
+	batches [][]database.ProcessedOrder
+}
+
+func (s *recordingStorage) ClaimOrdersForAccrual(ctx context.Context, claim database.Claim) ([]string, error) {
+	return s.orders, nil
+}
+
+func (s *recordingStorage) UpdateAccrual(ords []database.ProcessedOrder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch := make([]database.ProcessedOrder, len(ords))
+	copy(batch, ords)
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func TestAgent_PingAccrual(t *testing.T) {
+	const (
+		workers  = 4
+		orders   = 120
+		badOrder = "order-13"
+	)
+
+	var (
+		mu          sync.Mutex
+		inFlight    int
+		maxInFlight int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		time.Sleep(time.Millisecond)
+
+		orderNum := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		if orderNum == badOrder {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(database.ProcessedOrder{Number: orderNum, Status: "PROCESSING"})
+	}))
+	defer ts.Close()
+
+	st := &recordingStorage{}
+	for i := 0; i < orders; i++ {
+		st.orders = append(st.orders, fmt.Sprintf("order-%d", i))
+	}
+
+	a := &Agent{
+		Client:  ts.Client(),
+		Server:  ts.URL,
+		Storage: st,
+		Workers: workers,
+		Mu:      &sync.Mutex{},
+	}
+	if err := a.PingAccrual(context.Background()); err != nil {
+		t.Fatalf("Agent.PingAccrual() error = %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, b := range st.batches {
+		if len(b) > batchsize {
+			t.Errorf("batch of %d results exceeds batchsize %d", len(b), batchsize)
+		}
+		for _, o := range b {
+			seen[o.Number] = true
+		}
+	}
+	if len(seen) != orders-1 {
+		t.Errorf("got results for %d orders, want %d", len(seen), orders-1)
+	}
+	if seen[badOrder] {
+		t.Errorf("order %s failed in accrual but was stored", badOrder)
+	}
+	if maxInFlight > workers {
+		t.Errorf("%d requests were in flight at once, want at most %d", maxInFlight, workers)
+	}
+}
+
+func TestAgent_DuplicateResults(t *testing.T) {
+	const order = "12345678903"
+	var accrual database.Money = 10_00
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(database.ProcessedOrder{Number: order, Status: "PROCESSED", Accrual: &accrual})
+	}))
+	defer ts.Close()
+
+	st := database.NewStorage()
+	if err := st.Register("alice", "secretpass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetOrder(order, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// without leases both agents claim the order and both get it PROCESSED
+	agents := make([]*Agent, 2)
+	for i := range agents {
+		agents[i] = &Agent{Client: ts.Client(), Server: ts.URL, Storage: st, Mu: &sync.Mutex{}}
+	}
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, a := range agents {
+		wg.Add(1)
+		go func(a *Agent) {
+			defer wg.Done()
+			<-start
+			if err := a.PingAccrual(context.Background()); err != nil {
+				t.Errorf("Agent.PingAccrual() error = %v", err)
+			}
+		}(a)
+	}
+	close(start)
+	wg.Wait()
+	// and the tick repeats
+	if err := st.UpdateAccrual([]database.ProcessedOrder{{Number: order, Status: "PROCESSED", Accrual: &accrual}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), config.UserID("userID"), "alice")
+	balance, err := st.GetBalance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Current != accrual {
+		t.Errorf("balance = %v, want the order credited once, %v", balance.Current, accrual)
+	}
+}
+
+func TestAgent_UnexpectedStatus(t *testing.T) {
+	const lost = "12345678903"
+	var accrual database.Money = 10_00
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		orderNum := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		if orderNum == lost {
+			json.NewEncoder(w).Encode(database.ProcessedOrder{Number: orderNum, Status: "LOST"})
+			return
+		}
+		json.NewEncoder(w).Encode(database.ProcessedOrder{Number: orderNum, Status: "PROCESSED", Accrual: &accrual})
+	}))
+	defer ts.Close()
+
+	st := database.NewStorage()
+	if err := st.Register("alice", "secretpass"); err != nil {
+		t.Fatal(err)
+	}
+	orders := []string{lost, "4561261212345467", "79927398713"}
+	for _, order := range orders {
+		if err := st.SetOrder(order, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := &Agent{Client: ts.Client(), Server: ts.URL, Storage: st, Mu: &sync.Mutex{}}
+	if err := a.PingAccrual(context.Background()); err != nil {
+		t.Fatalf("Agent.PingAccrual() error = %v, want the bad result skipped", err)
+	}
+
+	ctx := context.WithValue(context.Background(), config.UserID("userID"), "alice")
+	balance, err := st.GetBalance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 2 * accrual; balance.Current != want {
+		t.Errorf("balance = %v, want the other orders credited, %v", balance.Current, want)
+	}
+}
+
+func TestAgent_claimLimit(t *testing.T) {
+	a := &Agent{Lease: 2 * time.Minute}
+	if got := a.claimLimit(); got != claimsize {
+		t.Errorf("claimLimit() without a rate limit = %d, want %d", got, claimsize)
+	}
+	a.limiter.SetLimit(60)
+	if got := a.claimLimit(); got != 120 {
+		t.Errorf("claimLimit() at a request a second = %d, want the 120 fitting in the lease", got)
+	}
+	a.Lease = 30 * time.Second
+	a.limiter.SetLimit(1)
+	if got := a.claimLimit(); got != 1 {
+		t.Errorf("claimLimit() at a request a minute = %d, want 1", got)
+	}
+}
+
+func TestAgent_PingAccrual_LeaseRunsOut(t *testing.T) {
+	const lease = 200 * time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(lease / 4)
+		orderNum := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		json.NewEncoder(w).Encode(database.ProcessedOrder{Number: orderNum, Status: "PROCESSING"})
+	}))
+	defer ts.Close()
+
+	st := &recordingStorage{}
+	for i := 0; i < 20; i++ {
+		st.orders = append(st.orders, fmt.Sprintf("order-%d", i))
+	}
+	a := &Agent{
+		Client:  ts.Client(),
+		Server:  ts.URL,
+		Storage: st,
+		Workers: 1,
+		Mu:      &sync.Mutex{},
+		Lease:   lease,
+	}
+
+	start := time.Now()
+	if err := a.PingAccrual(context.Background()); err != nil {
+		t.Fatalf("Agent.PingAccrual() error = %v", err)
+	}
+	if took := time.Since(start); took > lease {
+		t.Errorf("the cycle took %v, longer than the lease %v", took, lease)
+	}
+	stored := 0
+	for _, b := range st.batches {
+		stored += len(b)
+	}
+	if stored == 0 || stored >= 4 {
+		t.Errorf("stored %d results, want the few answered within the lease", stored)
+	}
+}
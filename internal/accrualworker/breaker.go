@@ -0,0 +1,197 @@
+package accrualworker
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// breakerThreshold is the amount of consecutive failed requests that opens the breaker
+	breakerThreshold = 5
+	// breakerCooldown is how long an open breaker waits before letting a trial request through
+	breakerCooldown = 30 * time.Second
+)
+
+type BreakerState int
+
+const (
+	// BreakerClosed - the accrual system is healthy, requests flow freely
+	BreakerClosed BreakerState = iota
+	// BreakerOpen - the accrual system keeps failing, requests are not sent
+	BreakerOpen
+	// BreakerHalfOpen - the cooldown has passed, a single trial request decides the next state
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText reports the state by its name, e.g. in the admin API
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// breaker is a circuit breaker guarding the accrual endpoint.
+// The zero value is a closed breaker with default settings
+type breaker struct {
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+}
+
+// Allow reports whether a request may be sent. In the half-open state only
+// one trial request is allowed until its outcome is reported
+func (b *breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.clock().Sub(b.openedAt) < b.cooldownPeriod() {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Ready is like Allow, but doesn't take the trial slot of a half-open breaker
+func (b *breaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		return b.clock().Sub(b.openedAt) >= b.cooldownPeriod()
+	case BreakerHalfOpen:
+		return !b.probing
+	default:
+		return true
+	}
+}
+
+// Success records a request the accrual system answered properly
+func (b *breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a request the accrual system failed to answer
+func (b *breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerHalfOpen:
+		b.open()
+	case BreakerClosed:
+		b.failures++
+		if b.failures >= b.failureThreshold() {
+			b.open()
+		}
+	}
+}
+
+// Abandon gives back the trial slot of a half-open breaker when the trial
+// request was never completed, e.g. because the agent is shutting down
+func (b *breaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// Cooldown returns how long an open breaker keeps holding requests back,
+// zero once a trial request may be sent
+func (b *breaker) Cooldown() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerOpen {
+		return 0
+	}
+	if left := b.cooldownPeriod() - b.clock().Sub(b.openedAt); left > 0 {
+		return left
+	}
+	return 0
+}
+
+func (b *breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *breaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = b.clock()
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *breaker) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+func (b *breaker) failureThreshold() int {
+	if b.threshold > 0 {
+		return b.threshold
+	}
+	return breakerThreshold
+}
+
+func (b *breaker) cooldownPeriod() time.Duration {
+	if b.cooldown > 0 {
+		return b.cooldown
+	}
+	return breakerCooldown
+}
+
+// backoff returns the delay before retry number attempt (counting from 1):
+// base doubled for every previous attempt, capped at max, with the upper half
+// of the delay randomized so that replicas don't retry in lockstep
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,171 @@
+package accrualworker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := &breaker{
+		threshold: 3,
+		cooldown:  time.Minute,
+		now:       func() time.Time { return now },
+	}
+
+	for i := 0; i < 2; i++ {
+		b.Failure()
+	}
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("state after 2 failures = %v, want %v", got, BreakerClosed)
+	}
+	b.Success()
+	for i := 0; i < 2; i++ {
+		b.Failure()
+	}
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("a success should reset the failure count, state = %v", got)
+	}
+
+	b.Failure()
+	if got := b.State(); got != BreakerOpen {
+		t.Fatalf("state after 3 failures = %v, want %v", got, BreakerOpen)
+	}
+	if b.Allow() || b.Ready() {
+		t.Fatal("open breaker should not allow requests before the cooldown")
+	}
+
+	now = now.Add(time.Minute)
+	if !b.Ready() {
+		t.Fatal("breaker should be ready for a trial after the cooldown")
+	}
+	if !b.Allow() {
+		t.Fatal("breaker should allow a trial request after the cooldown")
+	}
+	if got := b.State(); got != BreakerHalfOpen {
+		t.Fatalf("state during the trial = %v, want %v", got, BreakerHalfOpen)
+	}
+	if b.Allow() {
+		t.Fatal("half-open breaker should allow a single trial request")
+	}
+
+	b.Failure()
+	if got := b.State(); got != BreakerOpen {
+		t.Fatalf("state after a failed trial = %v, want %v", got, BreakerOpen)
+	}
+
+	now = now.Add(time.Minute)
+	b.Allow()
+	b.Abandon()
+	if !b.Allow() {
+		t.Fatal("an abandoned trial should free the trial slot")
+	}
+	b.Success()
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("state after a successful trial = %v, want %v", got, BreakerClosed)
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	base, max := time.Second, 20*time.Second
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{attempt: 1, ceiling: time.Second},
+		{attempt: 2, ceiling: 2 * time.Second},
+		{attempt: 3, ceiling: 4 * time.Second},
+		{attempt: 5, ceiling: 16 * time.Second},
+		{attempt: 6, ceiling: 20 * time.Second},
+		{attempt: 100, ceiling: 20 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := backoff(tt.attempt, base, max)
+				if got < tt.ceiling/2 || got > tt.ceiling {
+					t.Fatalf("backoff(%d) = %v, want within [%v, %v]", tt.attempt, got, tt.ceiling/2, tt.ceiling)
+				}
+			}
+		})
+	}
+}
+
+func TestAgent_PingAccrual_BreakerOpens(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	st := &recordingStorage{}
+	for i := 0; i < 2*breakerThreshold; i++ {
+		st.orders = append(st.orders, fmt.Sprintf("order-%d", i))
+	}
+	a := &Agent{
+		Client:  ts.Client(),
+		Server:  ts.URL,
+		Storage: st,
+		Workers: 1,
+		Mu:      &sync.Mutex{},
+	}
+
+	err := a.PingAccrual(context.Background())
+	if !errors.Is(err, ErrAccrualUnavailable) {
+		t.Fatalf("Agent.PingAccrual() error = %v, want %v", err, ErrAccrualUnavailable)
+	}
+	if got := a.BreakerState(); got != BreakerOpen {
+		t.Fatalf("breaker state = %v, want %v", got, BreakerOpen)
+	}
+	if got := atomic.LoadInt32(&hits); got != breakerThreshold {
+		t.Errorf("accrual got %d requests, want %d before the breaker opened", got, breakerThreshold)
+	}
+
+	err = a.PingAccrual(context.Background())
+	if !errors.Is(err, ErrAccrualUnavailable) {
+		t.Fatalf("Agent.PingAccrual() with open breaker error = %v, want %v", err, ErrAccrualUnavailable)
+	}
+	if got := atomic.LoadInt32(&hits); got != breakerThreshold {
+		t.Errorf("open breaker let %d requests through", got-breakerThreshold)
+	}
+}
+
+func TestAgent_nextWait(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	a := &Agent{}
+	a.breaker.now = func() time.Time { return now }
+	a.breaker.cooldown = time.Minute
+
+	wait, failures := a.nextWait(errors.New("accrual is down"), 3)
+	if failures != 4 || wait > maxbackoff {
+		t.Errorf("nextWait() after a failure = %v, %d, want a backoff and 4 failures", wait, failures)
+	}
+
+	for i := 0; i < breakerThreshold; i++ {
+		a.breaker.Failure()
+	}
+	now = now.Add(20 * time.Second)
+	// the cycles cut short by the open breaker wait for the trial
+	for i := 0; i < 10; i++ {
+		wait, failures = a.nextWait(ErrAccrualUnavailable, failures)
+		if wait != 40*time.Second || failures != 4 {
+			t.Fatalf("nextWait() with open breaker = %v, %d, want the 40s left of the cooldown and 4 failures", wait, failures)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if wait, _ = a.nextWait(ErrAccrualUnavailable, failures); wait != pingtime*time.Second {
+		t.Errorf("nextWait() after the cooldown = %v, want %v", wait, pingtime*time.Second)
+	}
+	if wait, failures = a.nextWait(nil, failures); wait != pingtime*time.Second || failures != 0 {
+		t.Errorf("nextWait() after a good cycle = %v, %d, want %v and no failures", wait, failures, pingtime*time.Second)
+	}
+}
@@ -0,0 +1,134 @@
+package accrualworker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRetryAfter is used when a 429 response comes without a usable Retry-After header
+const defaultRetryAfter = 60 * time.Second
+
+// limiter is shared by all workers of an agent. It spaces requests to the
+// accrual system according to the advertised rate limit and holds every
+// worker back while the accrual system asks us to retry later.
+// The zero value doesn't limit anything
+type limiter struct {
+	mu          sync.Mutex
+	interval    time.Duration // minimal gap between two requests
+	next        time.Time     // earliest start of the next request
+	pausedUntil time.Time
+}
+
+// Wait blocks until the caller may send a request or ctx is done
+func (l *limiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		if now.Before(l.pausedUntil) {
+			d := l.pausedUntil.Sub(now)
+			l.mu.Unlock()
+			if err := sleep(ctx, d); err != nil {
+				return err
+			}
+			continue
+		}
+		start := l.next
+		if start.Before(now) {
+			start = now
+		}
+		l.next = start.Add(l.interval)
+		l.mu.Unlock()
+
+		if err := sleep(ctx, start.Sub(now)); err != nil {
+			return err
+		}
+
+		// a pause may have started while we were waiting for our slot
+		l.mu.Lock()
+		paused := time.Now().Before(l.pausedUntil)
+		l.mu.Unlock()
+		if !paused {
+			return nil
+		}
+	}
+}
+
+// Pause stops all requests for d
+func (l *limiter) Pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until := time.Now().Add(d)
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	if l.next.Before(l.pausedUntil) {
+		l.next = l.pausedUntil
+	}
+}
+
+// SetLimit spreads requests evenly so that no more than perMinute are sent in a minute
+func (l *limiter) SetLimit(perMinute int) {
+	if perMinute <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interval = time.Minute / time.Duration(perMinute)
+}
+
+// Interval returns the current minimal gap between requests
+func (l *limiter) Interval() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.interval
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// parseRetryAfter reads the Retry-After header, given either in seconds or as an HTTP date
+func parseRetryAfter(header string) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return defaultRetryAfter
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return defaultRetryAfter
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		d := time.Until(at)
+		if d < 0 {
+			return 0
+		}
+		return d
+	}
+	return defaultRetryAfter
+}
+
+// parseRateLimit reads the "No more than N requests per minute allowed" body of a 429 response
+func parseRateLimit(body string) (perMinute int, ok bool) {
+	_, err := fmt.Sscanf(strings.TrimSpace(body), "No more than %d requests per minute allowed", &perMinute)
+	if err != nil || perMinute <= 0 {
+		return 0, false
+	}
+	return perMinute, true
+}
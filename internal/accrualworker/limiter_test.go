@@ -0,0 +1,172 @@
+package accrualworker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gambruh/gophermart/internal/database"
+)
+
+func Test_parseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{name: "seconds", header: "60", want: 60 * time.Second},
+		{name: "zero", header: "0", want: 0},
+		{name: "empty", header: "", want: defaultRetryAfter},
+		{name: "negative", header: "-5", want: defaultRetryAfter},
+		{name: "garbage", header: "soon", want: defaultRetryAfter},
+		{name: "date in the past", header: "Wed, 21 Oct 2015 07:28:00 GMT", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.header); got != tt.want {
+				t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+
+	future := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(future); got < 28*time.Second || got > 30*time.Second {
+		t.Errorf("parseRetryAfter(%q) = %v, want about 30s", future, got)
+	}
+}
+
+func Test_parseRateLimit(t *testing.T) {
+	tests := []struct {
+		body   string
+		want   int
+		wantOk bool
+	}{
+		{body: "No more than 10 requests per minute allowed", want: 10, wantOk: true},
+		{body: "No more than 600 requests per minute allowed\n", want: 600, wantOk: true},
+		{body: "No more than 0 requests per minute allowed", wantOk: false},
+		{body: "Too Many Requests", wantOk: false},
+		{body: "", wantOk: false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRateLimit(tt.body)
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("parseRateLimit(%q) = %d, %v, want %d, %v", tt.body, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	var l limiter
+	ctx := context.Background()
+
+	start := time.Now()
+	if err := l.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 10*time.Millisecond {
+		t.Error("zero limiter should not delay requests")
+	}
+
+	l.SetLimit(1200) // one request every 50ms
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("3 requests at 1200 rpm took %v, want at least 100ms", elapsed)
+	}
+
+	l.Pause(200 * time.Millisecond)
+	start = time.Now()
+	if err := l.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("request went out %v after a 200ms pause", elapsed)
+	}
+
+	l.Pause(time.Hour)
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(cctx); err == nil {
+		t.Error("Wait should give up when the context is done")
+	}
+}
+
+func TestAgent_PingAccrual_TooManyRequests(t *testing.T) {
+	const orders = 6
+
+	var (
+		mu        sync.Mutex
+		limitedAt time.Time
+		requests  []time.Time
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		now := time.Now()
+		requests = append(requests, now)
+		first := limitedAt.IsZero()
+		if first {
+			limitedAt = now
+		}
+		mu.Unlock()
+
+		if first {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("No more than 600 requests per minute allowed"))
+			return
+		}
+		orderNum := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		json.NewEncoder(w).Encode(database.ProcessedOrder{Number: orderNum, Status: "PROCESSING"})
+	}))
+	defer ts.Close()
+
+	st := &recordingStorage{}
+	for i := 0; i < orders; i++ {
+		st.orders = append(st.orders, fmt.Sprintf("order-%d", i))
+	}
+	a := &Agent{
+		Client:  ts.Client(),
+		Server:  ts.URL,
+		Storage: st,
+		Workers: 3,
+		Mu:      &sync.Mutex{},
+	}
+
+	if err := a.PingAccrual(context.Background()); err != nil {
+		t.Fatalf("Agent.PingAccrual() error = %v", err)
+	}
+
+	stored := 0
+	for _, b := range st.batches {
+		stored += len(b)
+	}
+	if stored != orders {
+		t.Errorf("stored %d results, want %d: the throttled order must be retried", stored, orders)
+	}
+
+	if got, want := a.limiter.Interval(), 100*time.Millisecond; got != want {
+		t.Errorf("request interval = %v, want %v after a 600 rpm limit", got, want)
+	}
+
+	// requests already on the wire when the 429 came may land right after it,
+	// nothing new may be sent until Retry-After has passed
+	mu.Lock()
+	defer mu.Unlock()
+	for _, at := range requests {
+		since := at.Sub(limitedAt)
+		if since > 100*time.Millisecond && since < time.Second {
+			t.Errorf("request sent %v after 429 with Retry-After: 1", since)
+		}
+	}
+}
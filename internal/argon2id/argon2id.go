@@ -133,6 +133,17 @@ func CheckHash(password, hash string) (match bool, params *Params, err error) {
 	return false, params, nil
 }
 
+// NeedsRehash reports whether the hash was created with parameters other
+// than params, so that it should be recomputed the next time the plain-text
+// password is known. It returns an error if the hash can't be decoded.
+func NeedsRehash(hash string, params *Params) (bool, error) {
+	current, _, _, err := DecodeHash(hash)
+	if err != nil {
+		return false, err
+	}
+	return *current != *params, nil
+}
+
 func generateRandomBytes(n uint32) ([]byte, error) {
 	b := make([]byte, n)
 	_, err := rand.Read(b)
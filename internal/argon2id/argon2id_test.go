@@ -117,3 +117,38 @@ func TestVariant(t *testing.T) {
 		t.Fatalf("expected error %s", ErrIncompatibleVariant)
 	}
 }
+
+func TestNeedsRehash(t *testing.T) {
+	hash, err := CreateHash("pa$$word", DefaultParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stronger := *DefaultParams
+	stronger.Iterations = 3
+	longerKey := *DefaultParams
+	longerKey.KeyLength = 64
+
+	tests := []struct {
+		name   string
+		params *Params
+		want   bool
+	}{
+		{name: "same params", params: DefaultParams, want: false},
+		{name: "more iterations", params: &stronger, want: true},
+		{name: "longer key", params: &longerKey, want: true},
+	}
+	for _, tt := range tests {
+		got, err := NeedsRehash(hash, tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: NeedsRehash() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err = NeedsRehash("$2a$10$abc", DefaultParams); err == nil {
+		t.Error("NeedsRehash() of a bcrypt hash should fail")
+	}
+}
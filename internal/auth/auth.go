@@ -10,8 +10,9 @@ import (
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"github.com/gambruh/gophermart/internal/argon2id"
 	"github.com/gambruh/gophermart/internal/config"
+
+	"github.com/lib/pq"
 )
 
 type LoginData struct {
@@ -19,14 +20,27 @@ type LoginData struct {
 	Password string `json:"password"`
 }
 
+type PasswordChange struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// AccountDeletion confirms closing the account with the password
+type AccountDeletion struct {
+	Password string `json:"password"`
+}
+
 type AuthStorage interface {
 	Register(login string, password string) error
 	VerifyCredentials(login string, password string) error
 	GetPass(username string) (string, error)
-}
-
-type AuthMemStorage struct {
-	Data map[string]string
+	ChangePassword(login string, password string) error
+	DeleteUser(login string) error
+	// SetRoles replaces the roles of the user, ListUsers returns all the users with their roles
+	SetRoles(ctx context.Context, login string, roles []string) error
+	ListUsers(ctx context.Context) ([]User, error)
+	SessionStorage
+	Close() error
 }
 
 type AuthDB struct {
@@ -45,15 +59,21 @@ var (
 	ErrWrongOrder        = errors.New("wrong order")
 )
 
-func GenerateToken(login string) (string, error) {
-	// Create a new token object, specifying the signing method and the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// uniqueViolation is the postgres error code of a unique constraint violation
+const uniqueViolation = "23505"
+
+// GenerateToken issues a short-lived access token of the session carrying the user's roles
+func GenerateToken(login string, sessionID string, roles []string) (string, error) {
+	if roles == nil {
+		roles = []string{}
+	}
+	// Sign the claims with the active key of the keyring
+	tokenString, err := CurrentKeyring().Sign(jwt.MapClaims{
 		"userID": login,
-		"exp":    time.Now().Add(time.Hour * 8).Unix(),
+		"sid":    sessionID,
+		"role":   roles,
+		"exp":    time.Now().Add(accessTTL()).Unix(),
 	})
-
-	// Sign the token with the secret key
-	tokenString, err := token.SignedString([]byte(config.Cfg.Key))
 	if err != nil {
 		return "", err
 	}
@@ -61,23 +81,31 @@ func GenerateToken(login string) (string, error) {
 	return tokenString, nil
 }
 
-func AuthMiddleware(next http.Handler) http.Handler {
+// AuthMiddleware lets through requests with a valid access token of a
+// session that hasn't been revoked
+func AuthMiddleware(st SessionStorage) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return authMiddleware(st, next)
+	}
+}
+
+func authMiddleware(st SessionStorage, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		type MyCustomClaims struct {
-			UserID string `json:"userID"`
+			UserID    string   `json:"userID"`
+			SessionID string   `json:"sid"`
+			Roles     []string `json:"role"`
 			jwt.StandardClaims
 		}
 
-		cookie, err := r.Cookie("gophermart-auth")
+		cookie, err := r.Cookie(AccessCookie)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		token, err := jwt.ParseWithClaims(cookie.Value, &MyCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(config.Cfg.Key), nil
-		})
+		token, err := jwt.ParseWithClaims(cookie.Value, &MyCustomClaims{}, CurrentKeyring().Keyfunc)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -90,110 +118,56 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		err = st.CheckSession(r.Context(), claims.SessionID)
+		switch err {
+		case nil:
+		case ErrSessionRevoked, ErrSessionNotFound:
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		default:
+			log.Println("error when checking session:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
 		ctx := context.WithValue(r.Context(), config.UserID("userID"), claims.UserID)
+		ctx = context.WithValue(ctx, config.SessionID("sessionID"), claims.SessionID)
+		ctx = context.WithValue(ctx, config.Roles("roles"), claims.Roles)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
 func NewAuthDB(postgresStr string) *AuthDB {
 	db, _ := sql.Open("postgres", postgresStr)
+	return NewAuthDBFromPool(db)
+}
+
+// NewAuthDBFromPool returns an AuthDB working through an already opened pool
+func NewAuthDBFromPool(db *sql.DB) *AuthDB {
 	return &AuthDB{
 		db: db,
 	}
 }
 
+// GetAuthDB returns the configured auth storage. The Postgres schema is owned
+// by the database package migrations, so database.GetDB has to run first
 func GetAuthDB() (authstorage AuthStorage) {
 	if config.Cfg.Storage {
 		authstorage = NewMemStorage()
 	} else {
-		db := NewAuthDB(config.Cfg.Database)
-		db.InitAuthDB()
-		authstorage = db
+		authstorage = NewAuthDB(config.Cfg.Database)
 	}
 
 	return authstorage
 }
 
-func (s *AuthDB) CheckTableExists(tablename string) error {
-	var check bool
-
-	err := s.db.QueryRow(checkTableExistsQuery, tablename).Scan(&check)
-	if err != nil {
-		log.Printf("error checking if table exists: %v", err)
-		return err
-	}
-	if !check {
-		return ErrTableDoesntExist
-	}
-	return nil
-}
-
-func (s *AuthDB) InitAuthDB() error {
-	err := s.CheckNDropTables()
-	if err != nil {
-		return err
-	}
-	err = s.CreateUsersTable()
-	if err != nil {
-		return err
-	}
-	err = s.CreatePasswordsTable()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-func (s *AuthDB) CreateUsersTable() error {
-	err := s.CheckTableExists("users")
-	if err == ErrTableDoesntExist {
-		_, err := s.db.Exec(createUsersTableQuery)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-func (s *AuthDB) CreatePasswordsTable() error {
-	err := s.CheckTableExists("passwords")
-	if err == ErrTableDoesntExist {
-		_, err = s.db.Exec(createPasswordsTableQuery)
-		if err != nil {
-			log.Println("error when creating passwords table:", err)
-			return err
-		}
-	}
-	return nil
-}
-
-func (s *AuthDB) CheckNDropTables() error {
-	var check bool
-
-	err := s.db.QueryRow(checkTableExistsQuery, "users").Scan(&check)
-	if err != nil {
-		fmt.Printf("error checking if table exists: %v", err)
-		return err
-	}
-	if check {
-		_, err = s.db.Exec(dropPasswordsTableQuery)
-		if err != nil {
-			return err
-		}
-		_, err = s.db.Exec(dropUsersTableQuery)
-		if err != nil {
-			return err
-		}
-	}
-	if err != nil {
-		fmt.Printf("error dropping a table: %v", err)
-		return err
-	}
-
-	return nil
+func (s *AuthDB) Close() error {
+	return s.db.Close()
 }
 
 func (s *AuthDB) Register(login string, password string) error {
 	var username string
-	hashedpassword, err := argon2id.CreateHash(password, argon2id.DefaultParams)
+	hashedpassword, err := hashPassword(password)
 	if err != nil {
 		log.Println("error when trying to hash password:", err)
 		return err
@@ -203,6 +177,11 @@ func (s *AuthDB) Register(login string, password string) error {
 	switch e {
 	case sql.ErrNoRows:
 		_, err := s.db.Exec(AddNewUserQuery, login, hashedpassword)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+			// registered concurrently after the check
+			return ErrUsernameIsTaken
+		}
 		return err
 	case nil:
 		err := ErrUsernameIsTaken
@@ -222,7 +201,7 @@ func (s *AuthDB) VerifyCredentials(login string, password string) error {
 	err := s.db.QueryRow(CheckUsernameQuery, login).Scan(&id)
 	switch err {
 	case sql.ErrNoRows:
-		return nil
+		return ErrUserNotFound
 	case nil:
 	default:
 		log.Println("Unexpected case in checking user's credentials in database:", err)
@@ -235,7 +214,7 @@ func (s *AuthDB) VerifyCredentials(login string, password string) error {
 		return err
 	}
 
-	check, err := argon2id.ComparePasswordAndHash(password, pass)
+	check, rehash, err := comparePassword(password, pass)
 	if err != nil {
 		log.Println("error when trying to compare password and hash:", err)
 		return err
@@ -244,47 +223,201 @@ func (s *AuthDB) VerifyCredentials(login string, password string) error {
 		return ErrWrongPassword
 	}
 
+	if rehash {
+		s.upgradeHash(id, password, pass)
+	}
 	return nil
 }
 
-func (s *AuthMemStorage) Register(login string, password string) error {
-	_, contains := s.Data[login]
-	if contains {
-		return ErrUsernameIsTaken
+// upgradeHash replaces an outdated hash of the password by one made with the
+// current parameters. The login has succeeded already, so errors are only logged.
+// The hash is replaced only if it's still the same, a password changed in
+// the meantime stays
+func (s *AuthDB) upgradeHash(id int, password, oldHash string) {
+	hashedpassword, err := hashPassword(password)
+	if err != nil {
+		log.Println("error when trying to rehash password:", err)
+		return
+	}
+	if _, err = s.db.Exec(upgradeHashQuery, id, hashedpassword, oldHash); err != nil {
+		log.Println("error when upgrading password hash:", err)
+	}
+}
+
+func (s *AuthDB) GetPass(username string) (string, error) {
+	var password string
+	err := s.db.QueryRow(getPassQuery, username).Scan(&password)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return password, nil
+}
+
+// ChangePassword replaces the password of the user
+func (s *AuthDB) ChangePassword(login string, password string) error {
+	hashedpassword, err := hashPassword(password)
+	if err != nil {
+		log.Println("error when trying to hash password:", err)
+		return err
+	}
+	res, err := s.db.Exec(changePasswordQuery, login, hashedpassword)
+	if err != nil {
+		log.Println("error when changing password:", err)
+		return err
+	}
+	changed, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if changed == 0 {
+		return ErrUserNotFound
 	}
-	s.Data[login] = password
 	return nil
 }
 
-func (s AuthMemStorage) VerifyCredentials(login string, password string) error {
-	check, contains := s.Data[login]
-	if contains && check == password {
-		return nil
+// DeleteUser removes the user and everything of theirs but the operations,
+// which are kept anonymously
+func (s *AuthDB) DeleteUser(login string) error {
+	res, err := s.db.Exec(deleteUserQuery, login)
+	if err != nil {
+		log.Println("error when deleting user:", err)
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrUserNotFound
 	}
-	return ErrWrongPassword
+	return nil
 }
 
-func NewMemStorage() *AuthMemStorage {
-	return &AuthMemStorage{
-		Data: make(map[string]string),
+func (s *AuthDB) CreateSession(ctx context.Context, session Session) error {
+	res, err := s.db.ExecContext(ctx, createSessionQuery, session.ID, session.Login, session.RefreshHash, session.ExpiresAt)
+	if err != nil {
+		log.Println("error when creating session:", err)
+		return err
+	}
+	created, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if created == 0 {
+		return ErrUserNotFound
 	}
+	return nil
 }
 
-func (s AuthMemStorage) GetPass(username string) (string, error) {
-	password, contains := s.Data[username]
-	if !contains {
-		return "", ErrUserNotFound
+func (s *AuthDB) RotateSession(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (Session, error) {
+	session := Session{RefreshHash: newHash, ExpiresAt: expiresAt}
+	err := s.db.QueryRowContext(ctx, rotateSessionQuery, oldHash, newHash, expiresAt).Scan(&session.ID, &session.Login)
+	switch err {
+	case nil:
+		return session, nil
+	case sql.ErrNoRows:
+	default:
+		log.Println("error when rotating session:", err)
+		return Session{}, err
 	}
 
-	return password, nil
+	// the token may have been rotated already
+	var id string
+	err = s.db.QueryRowContext(ctx, revokeReusedSessionQuery, oldHash).Scan(&id)
+	switch err {
+	case nil:
+		log.Println("refresh token reused, session revoked:", id)
+		return Session{}, ErrRefreshReused
+	case sql.ErrNoRows:
+		return Session{}, ErrSessionNotFound
+	default:
+		log.Println("error when revoking session:", err)
+		return Session{}, err
+	}
 }
 
-func (s *AuthDB) GetPass(username string) (string, error) {
-	var password string
-	err := s.db.QueryRow(getPassQuery, username).Scan(&password)
+func (s *AuthDB) CheckSession(ctx context.Context, id string) error {
+	var live bool
+	err := s.db.QueryRowContext(ctx, checkSessionQuery, id).Scan(&live)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrSessionNotFound
+	case err != nil:
+		return err
+	case !live:
+		return ErrSessionRevoked
+	default:
+		return nil
+	}
+}
+
+func (s *AuthDB) RevokeSession(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, revokeSessionQuery, id)
+	return err
+}
+
+func (s *AuthDB) RevokeUserSessions(ctx context.Context, login string) error {
+	_, err := s.db.ExecContext(ctx, revokeUserSessionsQuery, login)
+	return err
+}
+
+func (s *AuthDB) GetRoles(ctx context.Context, login string) ([]string, error) {
+	var roles []string
+	err := s.db.QueryRowContext(ctx, getRolesQuery, login).Scan(pq.Array(&roles))
+	switch err {
+	case nil:
+		return roles, nil
+	case sql.ErrNoRows:
+		return nil, ErrUserNotFound
+	default:
+		log.Println("error when getting roles:", err)
+		return nil, err
+	}
+}
+
+func (s *AuthDB) SetRoles(ctx context.Context, login string, roles []string) error {
+	roles, err := NormalizeRoles(roles)
 	if err != nil {
-		return "", err
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, setRolesQuery, login, pq.Array(roles))
+	if err != nil {
+		log.Println("error when setting roles:", err)
+		return err
+	}
+	changed, err := res.RowsAffected()
+	if err != nil {
+		return err
 	}
+	if changed == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
 
-	return password, nil
+func (s *AuthDB) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, listUsersQuery)
+	if err != nil {
+		log.Println("error when listing users:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err = rows.Scan(&u.Login, pq.Array(&u.Roles)); err != nil {
+			log.Println("error when scanning rows in ListUsers:", err)
+			return nil, err
+		}
+		if u.Roles == nil {
+			u.Roles = []string{}
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
 }
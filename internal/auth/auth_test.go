@@ -1,10 +1,12 @@
 package auth
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gambruh/gophermart/internal/config"
 	"github.com/go-chi/chi/v5"
 )
@@ -19,7 +21,7 @@ func (ts *TestService) Service() http.Handler {
 	}
 	// Create a new router, add the AuthMiddleware and the mock handler.
 	r := chi.NewRouter()
-	r.Use(AuthMiddleware)
+	r.Use(AuthMiddleware(ts.Storage))
 	r.Get("/test", handler)
 
 	return r
@@ -27,13 +29,24 @@ func (ts *TestService) Service() http.Handler {
 func TestAuthMiddleware(t *testing.T) {
 	key := "abcd"
 	config.Cfg.Key = key
-	mockstorage := AuthMemStorage{
-		Data: make(map[string]string),
+	mockstorage := NewMemStorage()
+	if err := mockstorage.Register("user123", "secretpassword"); err != nil {
+		t.Fatal(err)
 	}
-	mockstorage.Data["user123"] = "secretpassword"
-	var mockservice = &(TestService{Storage: &mockstorage})
+	var mockservice = &(TestService{Storage: mockstorage})
 
-	token123, err := GenerateToken("user123")
+	tokens, err := NewSession(context.Background(), mockstorage, "user123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := NewSession(context.Background(), mockstorage, "user123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mockstorage.RevokeSession(context.Background(), sessionOf(t, revoked.Access)); err != nil {
+		t.Fatal(err)
+	}
+	unknownSession, err := GenerateToken("user123", "unknown", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -49,9 +62,23 @@ func TestAuthMiddleware(t *testing.T) {
 			name:     "Authorized request",
 			login:    "user123",
 			password: "usualpass",
-			token:    token123,
+			token:    tokens.Access,
 			want:     http.StatusOK,
 		},
+		{
+			name:     "Revoked session",
+			login:    "user123",
+			password: "usualpass",
+			token:    revoked.Access,
+			want:     http.StatusUnauthorized,
+		},
+		{
+			name:     "Unknown session",
+			login:    "user123",
+			password: "usualpass",
+			token:    unknownSession,
+			want:     http.StatusUnauthorized,
+		},
 		{
 			name:     "Wrong token",
 			login:    "unknownuser",
@@ -77,7 +104,7 @@ func TestAuthMiddleware(t *testing.T) {
 			}
 
 			cookie := http.Cookie{
-				Name:  "gophermart-auth",
+				Name:  AccessCookie,
 				Value: tt.token,
 			}
 			req.AddCookie(&cookie)
@@ -91,3 +118,14 @@ func TestAuthMiddleware(t *testing.T) {
 		})
 	}
 }
+
+// sessionOf returns the session id from an access token
+func sessionOf(t *testing.T, access string) string {
+	t.Helper()
+	claims := jwt.MapClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(access, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims["sid"].(string)
+}
@@ -23,44 +23,105 @@ const AddNewUserQuery = `
 	VALUES ((SELECT id FROM new_user), $2);
 `
 
-const checkTableExistsQuery = `
-	SELECT EXISTS (
-		SELECT 	1 
-		FROM 	information_schema.tables
-		WHERE 	table_name = $1
-	);
+const changePasswordQuery = `
+	UPDATE passwords
+	SET password = $2
+	WHERE id = (
+		SELECT id
+		FROM users
+		WHERE username = $1
+		);
 `
 
-const createUsersTableQuery = `
-	CREATE TABLE users (
-		id SERIAL,
-		username text NOT NULL UNIQUE,
-		PRIMARY KEY (id)
-	);
+// deleteUserQuery removes the user with the password, orders, balance and
+// sessions. Operations are kept with no user
+const deleteUserQuery = `
+	DELETE FROM users
+	WHERE username = $1;
 `
 
-const createPasswordsTableQuery = `
-	CREATE TABLE passwords (
-		id integer PRIMARY KEY,
-		password TEXT NOT NULL,
-		CONSTRAINT fk_users
-			FOREIGN KEY (id) 
-				REFERENCES users(id)
-				ON DELETE CASCADE
-	);
+const getPassQuery = `
+		SELECT password
+		FROM passwords
+		JOIN users ON users.id = passwords.id
+		WHERE users.username = $1
+	`
+
+// role queries
+const getRolesQuery = `
+	SELECT roles
+	FROM users
+	WHERE username = $1;
 `
 
-const dropPasswordsTableQuery = `
-	DROP TABLE passwords CASCADE;
+const setRolesQuery = `
+	UPDATE users
+	SET roles = $2
+	WHERE username = $1;
 `
 
-const dropUsersTableQuery = `
-	DROP TABLE users CASCADE;
+const listUsersQuery = `
+	SELECT username, roles
+	FROM users
+	ORDER BY username;
 `
 
-const getPassQuery = `
-		SELECT password
-		FROM passwords
-		JOIN users ON users.id = passwords.user_id
-		WHERE users.username = $1
-	`
+// session queries
+const createSessionQuery = `
+	INSERT INTO sessions (id, user_id, refresh_hash, expires_at)
+	SELECT $1, id, $3, $4
+	FROM users
+	WHERE username = $2;
+`
+
+// rotateSessionQuery swaps the refresh token of a live session, keeping the
+// old one to recognize its reuse
+const rotateSessionQuery = `
+	UPDATE sessions
+	SET previous_hash = sessions.refresh_hash,
+		refresh_hash = $2,
+		expires_at = $3
+	FROM users
+	WHERE users.id = sessions.user_id
+	AND sessions.refresh_hash = $1
+	AND sessions.revoked_at IS NULL
+	AND sessions.expires_at > now()
+	RETURNING sessions.id, users.username;
+`
+
+const revokeReusedSessionQuery = `
+	UPDATE sessions
+	SET revoked_at = COALESCE(revoked_at, now())
+	WHERE previous_hash = $1
+	RETURNING id;
+`
+
+const checkSessionQuery = `
+	SELECT revoked_at IS NULL AND expires_at > now()
+	FROM sessions
+	WHERE id = $1;
+`
+
+const revokeSessionQuery = `
+	UPDATE sessions
+	SET revoked_at = now()
+	WHERE id = $1
+	AND revoked_at IS NULL;
+`
+
+const revokeUserSessionsQuery = `
+	UPDATE sessions
+	SET revoked_at = now()
+	WHERE user_id = (
+		SELECT id
+		FROM users
+		WHERE username = $1
+		)
+	AND revoked_at IS NULL;
+`
+
+const upgradeHashQuery = `
+	UPDATE passwords
+	SET password = $2
+	WHERE id = $1 AND password = $3
+`
@@ -0,0 +1,22 @@
+package auth_test
+
+import (
+	"testing"
+
+	"github.com/gambruh/gophermart/internal/auth"
+	"github.com/gambruh/gophermart/internal/storagetest"
+)
+
+func TestAuthMemStorage_Conformance(t *testing.T) {
+	storagetest.RunAuth(t, func(t *testing.T) auth.AuthStorage {
+		return auth.NewMemStorage()
+	})
+}
+
+func TestAuthDB_Conformance(t *testing.T) {
+	storagetest.RunAuth(t, func(t *testing.T) auth.AuthStorage {
+		st := auth.NewAuthDB(storagetest.PostgresURI(t))
+		t.Cleanup(func() { st.Close() })
+		return st
+	})
+}
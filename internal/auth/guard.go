@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gambruh/gophermart/internal/config"
+)
+
+// defaults for the guard settings left empty in the config
+const (
+	defaultMaxFailures   = 5
+	defaultIPMaxFailures = 50
+	defaultLoginDelay    = time.Second
+	defaultLockout       = 15 * time.Minute
+	defaultHashWait      = time.Second
+)
+
+// maxTracked bounds the failure records kept per login and per address.
+// Beyond it the expired records are dropped, then the ones not blocked now
+// and only then the lockouts ending first
+const maxTracked = 100_000
+
+var ErrHashBusy = errors.New("too many password hashes in progress")
+
+// GuardConfig sets up a LoginGuard. Zero fields take the defaults
+type GuardConfig struct {
+	// failures in a row before a login or an address is locked out
+	MaxFailures   int
+	IPMaxFailures int
+	// the pause after the first failure, it doubles with every next one
+	Delay time.Duration
+	// how long a lockout lasts, failures older than that are forgotten
+	Lockout time.Duration
+	// password hashes computed at once and how long to wait for a free slot
+	HashConcurrency int
+	HashWait        time.Duration
+}
+
+// GuardConfigFromCfg takes the guard settings from config.Cfg
+func GuardConfigFromCfg() GuardConfig {
+	return GuardConfig{
+		MaxFailures:     config.Cfg.LoginMaxFailures,
+		IPMaxFailures:   config.Cfg.LoginIPMaxFailures,
+		Delay:           config.Cfg.LoginDelay,
+		Lockout:         config.Cfg.LoginLockout,
+		HashConcurrency: config.Cfg.HashConcurrency,
+		HashWait:        config.Cfg.HashWait,
+	}
+}
+
+// LoginGuard slows down password guessing. Failed attempts are counted per
+// login and per client address: after each failure the next attempt has to
+// wait twice as long, and after MaxFailures the login is locked out for a
+// while. It also caps the argon2id hashes computed at once, each of them takes
+// tens of megabytes of memory. A nil guard allows everything
+type LoginGuard struct {
+	cfg     GuardConfig
+	hashSem chan struct{}
+	now     func() time.Time
+	// maxTracked is a field so that tests can lower it
+	maxTracked int
+
+	mu     sync.Mutex
+	logins map[string]*failures
+	ips    map[string]*failures
+}
+
+type failures struct {
+	count       int
+	last        time.Time
+	blockedTill time.Time
+}
+
+func NewLoginGuard(cfg GuardConfig) *LoginGuard {
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = defaultMaxFailures
+	}
+	if cfg.IPMaxFailures <= 0 {
+		cfg.IPMaxFailures = defaultIPMaxFailures
+	}
+	if cfg.Delay <= 0 {
+		cfg.Delay = defaultLoginDelay
+	}
+	if cfg.Lockout <= 0 {
+		cfg.Lockout = defaultLockout
+	}
+	if cfg.HashConcurrency <= 0 {
+		cfg.HashConcurrency = runtime.NumCPU()
+	}
+	if cfg.HashWait <= 0 {
+		cfg.HashWait = defaultHashWait
+	}
+	return &LoginGuard{
+		cfg:        cfg,
+		hashSem:    make(chan struct{}, cfg.HashConcurrency),
+		now:        time.Now,
+		maxTracked: maxTracked,
+		logins:     make(map[string]*failures),
+		ips:        make(map[string]*failures),
+	}
+}
+
+// Allow tells whether a password of the login may be checked now. If not,
+// it returns how long the client has to wait
+func (g *LoginGuard) Allow(login, ip string) (time.Duration, bool) {
+	if g == nil {
+		return 0, true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	wait := g.wait(g.logins[login], now)
+	if ipWait := g.wait(g.ips[ip], now); ipWait > wait {
+		wait = ipWait
+	}
+	return wait, wait <= 0
+}
+
+// wait returns the time left till the next attempt is allowed, g.mu must be held
+func (g *LoginGuard) wait(f *failures, now time.Time) time.Duration {
+	if f == nil {
+		return 0
+	}
+	return f.blockedTill.Sub(now)
+}
+
+// Fail records a wrong password
+func (g *LoginGuard) Fail(login, ip string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	g.fail(g.logins, login, g.cfg.MaxFailures, now)
+	g.fail(g.ips, ip, g.cfg.IPMaxFailures, now)
+}
+
+// fail counts a failure of key and sets when the next attempt is allowed, g.mu must be held
+func (g *LoginGuard) fail(m map[string]*failures, key string, limit int, now time.Time) {
+	f, ok := m[key]
+	if !ok || now.Sub(f.last) > g.cfg.Lockout {
+		if len(m) >= g.maxTracked {
+			g.prune(m, now)
+		}
+		f = &failures{}
+		m[key] = f
+	}
+	f.count++
+	f.last = now
+
+	if f.count >= limit {
+		f.blockedTill = now.Add(g.cfg.Lockout)
+		return
+	}
+	delay := g.cfg.Delay << (f.count - 1)
+	if delay <= 0 || delay > g.cfg.Lockout {
+		delay = g.cfg.Lockout
+	}
+	f.blockedTill = now.Add(delay)
+}
+
+// prune drops the records of failures that are forgotten already. If there
+// is still no room, an eighth of the records go, so that a flood of new keys
+// doesn't sort the map on every failure: first the ones not blocked now,
+// quiet the longest first, then the blocked ones whose lockout ends first.
+// A flood thus can't push out a lockout while there are others to drop.
+// g.mu must be held
+func (g *LoginGuard) prune(m map[string]*failures, now time.Time) {
+	for key, f := range m {
+		if now.Sub(f.last) > g.cfg.Lockout && !now.Before(f.blockedTill) {
+			delete(m, key)
+		}
+	}
+	keep := g.maxTracked - 1 - g.maxTracked/8
+	if len(m) <= keep {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := m[keys[i]], m[keys[j]]
+		aBlocked, bBlocked := now.Before(a.blockedTill), now.Before(b.blockedTill)
+		switch {
+		case aBlocked != bBlocked:
+			return bBlocked
+		case aBlocked:
+			return a.blockedTill.Before(b.blockedTill)
+		default:
+			return a.last.Before(b.last)
+		}
+	})
+	for _, key := range keys[:len(keys)-keep] {
+		delete(m, key)
+	}
+}
+
+// Succeed clears the failures of the login after a right password. The
+// address keeps its record, one known password doesn't make it trusted
+func (g *LoginGuard) Succeed(login string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.logins, login)
+}
+
+// AcquireHash takes a slot for computing a password hash. The returned
+// function frees it. ErrHashBusy means no slot got free in time
+func (g *LoginGuard) AcquireHash(ctx context.Context) (func(), error) {
+	if g == nil {
+		return func() {}, nil
+	}
+	timer := time.NewTimer(g.cfg.HashWait)
+	defer timer.Stop()
+
+	select {
+	case g.hashSem <- struct{}{}:
+		return func() { <-g.hashSem }, nil
+	case <-timer.C:
+		return nil, ErrHashBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
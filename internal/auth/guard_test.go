@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoginGuard_ProgressiveDelay(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	g := NewLoginGuard(GuardConfig{MaxFailures: 4, Delay: time.Second, Lockout: time.Minute})
+	g.now = func() time.Time { return now }
+
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, time.Minute} {
+		g.Fail("alice", "10.0.0.1")
+		wait, ok := g.Allow("alice", "10.0.0.2")
+		if ok || wait != want {
+			t.Fatalf("Allow() = %v, %v, want to wait %v", wait, ok, want)
+		}
+		now = now.Add(want)
+		if _, ok = g.Allow("alice", "10.0.0.2"); !ok {
+			t.Fatalf("attempt isn't allowed after waiting %v", want)
+		}
+	}
+
+	// failures are forgotten after the lockout period
+	now = now.Add(time.Minute + time.Second)
+	g.Fail("alice", "10.0.0.1")
+	if wait, _ := g.Allow("alice", "10.0.0.2"); wait != time.Second {
+		t.Errorf("wait after the failures expired = %v, want %v", wait, time.Second)
+	}
+}
+
+func TestLoginGuard_PerAddress(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	g := NewLoginGuard(GuardConfig{MaxFailures: 100, IPMaxFailures: 3, Delay: time.Second, Lockout: time.Minute})
+	g.now = func() time.Time { return now }
+
+	// one address guessing passwords of different logins
+	for _, login := range []string{"alice", "bob", "carol"} {
+		g.Fail(login, "10.0.0.1")
+		now = now.Add(10 * time.Second)
+	}
+	if wait, ok := g.Allow("dave", "10.0.0.1"); ok || wait != time.Minute-10*time.Second {
+		t.Errorf("Allow() for a locked out address = %v, %v, want to wait 50s", wait, ok)
+	}
+	if _, ok := g.Allow("dave", "10.0.0.2"); !ok {
+		t.Error("another address is held back")
+	}
+
+	g.Succeed("alice")
+	if _, ok := g.Allow("alice", "10.0.0.1"); ok {
+		t.Error("success of one login unlocked the address")
+	}
+}
+
+func TestLoginGuard_MaxTracked(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	g := NewLoginGuard(GuardConfig{MaxFailures: 100, IPMaxFailures: 100, Delay: time.Minute, Lockout: time.Hour})
+	g.now = func() time.Time { return now }
+	g.maxTracked = 4
+
+	// logins and addresses are all new, none of the records has expired
+	for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		g.Fail(key, "10.0.0."+key)
+		now = now.Add(time.Second)
+	}
+	if len(g.logins) > g.maxTracked || len(g.ips) > g.maxTracked {
+		t.Errorf("tracked %d logins and %d addresses, want at most %d", len(g.logins), len(g.ips), g.maxTracked)
+	}
+	if _, ok := g.Allow("a", "10.0.0.x"); !ok {
+		t.Error("the oldest record is kept beyond the cap")
+	}
+	if _, ok := g.Allow("f", "10.0.0.x"); ok {
+		t.Error("the newest record is dropped")
+	}
+}
+
+func TestLoginGuard_MaxTrackedKeepsLockouts(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	g := NewLoginGuard(GuardConfig{MaxFailures: 2, IPMaxFailures: 1000, Delay: time.Second, Lockout: time.Hour})
+	g.now = func() time.Time { return now }
+	g.maxTracked = 8
+
+	g.Fail("alice", "10.0.0.1")
+	g.Fail("alice", "10.0.0.1")
+	// a flood of failures of other logins, each one waited out
+	for i := 0; i < 10*g.maxTracked; i++ {
+		now = now.Add(2 * time.Second)
+		g.Fail(fmt.Sprintf("login-%d", i), "10.0.0.1")
+	}
+	if len(g.logins) > g.maxTracked {
+		t.Errorf("tracked %d logins, want at most %d", len(g.logins), g.maxTracked)
+	}
+	if _, ok := g.Allow("alice", "10.0.0.2"); ok {
+		t.Error("the flood pushed out the lockout of alice")
+	}
+}
+
+func TestLoginGuard_AcquireHash(t *testing.T) {
+	g := NewLoginGuard(GuardConfig{HashConcurrency: 2, HashWait: 10 * time.Millisecond})
+	ctx := context.Background()
+
+	release1, err := g.AcquireHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := g.AcquireHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = g.AcquireHash(ctx); !errors.Is(err, ErrHashBusy) {
+		t.Errorf("AcquireHash() with no free slot error = %v, want %v", err, ErrHashBusy)
+	}
+	release1()
+	release3, err := g.AcquireHash(ctx)
+	if err != nil {
+		t.Errorf("AcquireHash() after a release error = %v", err)
+	} else {
+		release3()
+	}
+	release2()
+
+	var nilGuard *LoginGuard
+	if _, ok := nilGuard.Allow("alice", "10.0.0.1"); !ok {
+		t.Error("nil guard holds back attempts")
+	}
+	release, err := nilGuard.AcquireHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gambruh/gophermart/internal/config"
+)
+
+// defaultKeyID names the HS256 key made from config.Cfg.Key when no keyring is configured
+const defaultKeyID = "default"
+
+var (
+	ErrBadKeyring   = errors.New("bad keyring")
+	ErrUnknownKeyID = errors.New("token is signed with an unknown key")
+)
+
+// Key is a token signing key. A key without a private part can only verify
+// tokens, HS256 keys are symmetric and do both
+type Key struct {
+	ID        string
+	Algorithm string
+
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// Keyring holds the key that signs new tokens and all the keys tokens are
+// still accepted with. Every token carries the id of its key in the kid
+// header. To rotate keys:
+//  1. add the new key, keeping the old one active;
+//  2. once every replica has the new key, make it active;
+//  3. drop the old key when the tokens it signed have expired.
+type Keyring struct {
+	active *Key
+	keys   map[string]*Key
+}
+
+// keyringConfig is the format of the keyring file and of the JWT_KEYS variable.
+// PEM keys are PKCS#8 or PKIX, RSA keys may be PKCS#1 too
+type keyringConfig struct {
+	Active string      `json:"active"`
+	Keys   []keyConfig `json:"keys"`
+}
+
+type keyConfig struct {
+	ID         string `json:"kid"`
+	Algorithm  string `json:"alg"`
+	Secret     string `json:"secret,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+	PublicKey  string `json:"public_key,omitempty"`
+}
+
+var (
+	keyringMu sync.RWMutex
+	keyring   *Keyring
+)
+
+// SetKeyring makes k the keyring tokens are signed and verified with.
+// Without one, a single HS256 key made of config.Cfg.Key is used
+func SetKeyring(k *Keyring) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	keyring = k
+}
+
+// CurrentKeyring returns the keyring in use
+func CurrentKeyring() *Keyring {
+	keyringMu.RLock()
+	defer keyringMu.RUnlock()
+	if keyring != nil {
+		return keyring
+	}
+	key := &Key{ID: defaultKeyID, Algorithm: jwt.SigningMethodHS256.Alg()}
+	key.signKey = []byte(config.Cfg.Key)
+	key.verifyKey = key.signKey
+	return &Keyring{active: key, keys: map[string]*Key{key.ID: key}}
+}
+
+// LoadKeyring reads the keyring from config.Cfg.KeysFile or config.Cfg.Keys.
+// It returns nil if neither is set
+func LoadKeyring() (*Keyring, error) {
+	var data []byte
+	switch {
+	case config.Cfg.KeysFile != "":
+		b, err := os.ReadFile(config.Cfg.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	case config.Cfg.Keys != "":
+		data = []byte(config.Cfg.Keys)
+	default:
+		return nil, nil
+	}
+	return ParseKeyring(data)
+}
+
+// ParseKeyring builds a keyring from its JSON description
+func ParseKeyring(data []byte) (*Keyring, error) {
+	var cfg keyringConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadKeyring, err)
+	}
+
+	k := &Keyring{keys: make(map[string]*Key, len(cfg.Keys))}
+	for _, kc := range cfg.Keys {
+		if kc.ID == "" {
+			return nil, fmt.Errorf("%w: key without kid", ErrBadKeyring)
+		}
+		if _, dup := k.keys[kc.ID]; dup {
+			return nil, fmt.Errorf("%w: duplicate kid %q", ErrBadKeyring, kc.ID)
+		}
+		key, err := parseKey(kc)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q: %v", ErrBadKeyring, kc.ID, err)
+		}
+		k.keys[key.ID] = key
+	}
+
+	k.active = k.keys[cfg.Active]
+	switch {
+	case k.active == nil:
+		return nil, fmt.Errorf("%w: active key %q not found", ErrBadKeyring, cfg.Active)
+	case k.active.signKey == nil:
+		return nil, fmt.Errorf("%w: active key %q has no private key", ErrBadKeyring, cfg.Active)
+	}
+	return k, nil
+}
+
+func parseKey(kc keyConfig) (*Key, error) {
+	key := &Key{ID: kc.ID, Algorithm: kc.Algorithm}
+	switch kc.Algorithm {
+	case jwt.SigningMethodHS256.Alg():
+		if kc.Secret == "" {
+			return nil, errors.New("HS256 key needs a secret")
+		}
+		key.signKey = []byte(kc.Secret)
+		key.verifyKey = key.signKey
+
+	case jwt.SigningMethodRS256.Alg():
+		if kc.PrivateKey != "" {
+			private, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(kc.PrivateKey))
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = private
+			key.verifyKey = &private.PublicKey
+		} else if kc.PublicKey != "" {
+			public, err := jwt.ParseRSAPublicKeyFromPEM([]byte(kc.PublicKey))
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = public
+		}
+
+	case SigningMethodEdDSA.Alg():
+		if kc.PrivateKey != "" {
+			private, err := parseEd25519PrivateKey(kc.PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = private
+			key.verifyKey = private.Public().(ed25519.PublicKey)
+		} else if kc.PublicKey != "" {
+			public, err := parseEd25519PublicKey(kc.PublicKey)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = public
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", kc.Algorithm)
+	}
+
+	if key.verifyKey == nil {
+		return nil, errors.New("no private or public key")
+	}
+	return key, nil
+}
+
+func decodePEM(data string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("key is not PEM encoded")
+	}
+	return block.Bytes, nil
+}
+
+func parseEd25519PrivateKey(data string) (ed25519.PrivateKey, error) {
+	der, err := decodePEM(data)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+	return private, nil
+}
+
+func parseEd25519PublicKey(data string) (ed25519.PublicKey, error) {
+	der, err := decodePEM(data)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+	return public, nil
+}
+
+// Sign signs the claims with the active key
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(k.active.Algorithm), claims)
+	token.Header["kid"] = k.active.ID
+	return token.SignedString(k.active.signKey)
+}
+
+// Keyfunc picks the key a token is verified with by its kid. The algorithm
+// of the token has to be the one of the key, so that a public key can't be
+// passed off as an HMAC secret
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKeyID, kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("token algorithm %s doesn't match key %q", token.Method.Alg(), kid)
+	}
+	return key.verifyKey, nil
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	// RSA modulus and exponent
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// OKP curve and public key
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKSet is the document other services fetch the public keys from
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the keyring. HS256 secrets are never published
+func (k *Keyring) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range k.keys {
+		jwk := JWK{ID: key.ID, Algorithm: key.Algorithm, Use: "sig"}
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = jwt.EncodeSegment(public.N.Bytes())
+			jwk.E = jwt.EncodeSegment(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = jwt.EncodeSegment(public)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].ID < set.Keys[j].ID })
+	return set
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func pemBlock(t *testing.T, typ string, der []byte, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}))
+}
+
+// testKeys returns PEM encoded Ed25519 and RSA key pairs
+func testKeys(t *testing.T) (edPrivate, edPublic, rsaPrivate, rsaPublic string) {
+	t.Helper()
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(edPriv)
+	edPrivate = pemBlock(t, "PRIVATE KEY", der, err)
+	der, err = x509.MarshalPKIXPublicKey(edPub)
+	edPublic = pemBlock(t, "PUBLIC KEY", der, err)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivate = pemBlock(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), nil)
+	der, err = x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	rsaPublic = pemBlock(t, "PUBLIC KEY", der, err)
+	return
+}
+
+func mustKeyring(t *testing.T, cfg keyringConfig) *Keyring {
+	t.Helper()
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := ParseKeyring(data)
+	if err != nil {
+		t.Fatalf("ParseKeyring() error = %v", err)
+	}
+	return k
+}
+
+func verify(k *Keyring, token string) error {
+	_, err := jwt.Parse(token, k.Keyfunc)
+	return err
+}
+
+func TestKeyring_Rotation(t *testing.T) {
+	edPrivate, edPublic, rsaPrivate, _ := testKeys(t)
+	old := keyConfig{ID: "2023", Algorithm: "HS256", Secret: "old secret"}
+	ed := keyConfig{ID: "2024-ed", Algorithm: "EdDSA", PrivateKey: edPrivate}
+	rs := keyConfig{ID: "2024-rs", Algorithm: "RS256", PrivateKey: rsaPrivate}
+	claims := jwt.MapClaims{"userID": "user123"}
+
+	before := mustKeyring(t, keyringConfig{Active: "2023", Keys: []keyConfig{old}})
+	oldToken, err := before.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new keys are rolled out and one of them is made active
+	during := mustKeyring(t, keyringConfig{Active: "2024-ed", Keys: []keyConfig{old, ed, rs}})
+	edToken, err := during.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verify(during, oldToken); err != nil {
+		t.Errorf("token of the previous key is rejected: %v", err)
+	}
+	if err = verify(during, edToken); err != nil {
+		t.Errorf("EdDSA token is rejected: %v", err)
+	}
+	if err = verify(before, edToken); err == nil {
+		t.Error("token of a key unknown to the keyring is accepted")
+	}
+
+	rsKeyring := mustKeyring(t, keyringConfig{Active: "2024-rs", Keys: []keyConfig{rs}})
+	rsToken, err := rsKeyring.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verify(during, rsToken); err != nil {
+		t.Errorf("RS256 token is rejected: %v", err)
+	}
+
+	// the old key is dropped
+	after := mustKeyring(t, keyringConfig{Active: "2024-ed", Keys: []keyConfig{ed}})
+	if err = verify(after, oldToken); !errors.Is(err.(*jwt.ValidationError).Inner, ErrUnknownKeyID) {
+		t.Errorf("token of a dropped key: error = %v, want %v", err, ErrUnknownKeyID)
+	}
+
+	// other services verify with the public key only
+	verifier := mustKeyring(t, keyringConfig{Active: "hs", Keys: []keyConfig{
+		{ID: "hs", Algorithm: "HS256", Secret: "s"},
+		{ID: "2024-ed", Algorithm: "EdDSA", PublicKey: edPublic},
+	}})
+	if err = verify(verifier, edToken); err != nil {
+		t.Errorf("EdDSA token is rejected by the public key: %v", err)
+	}
+}
+
+func TestKeyring_AlgorithmMustMatchKey(t *testing.T) {
+	_, _, _, rsaPublic := testKeys(t)
+	k := mustKeyring(t, keyringConfig{Active: "hs", Keys: []keyConfig{
+		{ID: "hs", Algorithm: "HS256", Secret: "secret"},
+		{ID: "rs", Algorithm: "RS256", PublicKey: rsaPublic},
+	}})
+
+	// the public key is known to everybody, it mustn't work as an HMAC secret
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"userID": "admin"})
+	forged.Header["kid"] = "rs"
+	token, err := forged.SignedString([]byte(rsaPublic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verify(k, token); err == nil {
+		t.Error("HS256 token signed with the RSA public key is accepted")
+	}
+
+	noKid, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verify(k, noKid); err == nil {
+		t.Error("token without kid is accepted")
+	}
+}
+
+func TestParseKeyring_Errors(t *testing.T) {
+	_, edPublic, _, _ := testKeys(t)
+	tests := []struct {
+		name string
+		cfg  keyringConfig
+	}{
+		{name: "no active key", cfg: keyringConfig{Active: "a", Keys: []keyConfig{{ID: "b", Algorithm: "HS256", Secret: "s"}}}},
+		{name: "active key can't sign", cfg: keyringConfig{Active: "a", Keys: []keyConfig{{ID: "a", Algorithm: "EdDSA", PublicKey: edPublic}}}},
+		{name: "duplicate kid", cfg: keyringConfig{Active: "a", Keys: []keyConfig{{ID: "a", Algorithm: "HS256", Secret: "s"}, {ID: "a", Algorithm: "HS256", Secret: "t"}}}},
+		{name: "empty secret", cfg: keyringConfig{Active: "a", Keys: []keyConfig{{ID: "a", Algorithm: "HS256"}}}},
+		{name: "unsupported algorithm", cfg: keyringConfig{Active: "a", Keys: []keyConfig{{ID: "a", Algorithm: "none", Secret: "s"}}}},
+		{name: "not PEM", cfg: keyringConfig{Active: "a", Keys: []keyConfig{{ID: "a", Algorithm: "EdDSA", PrivateKey: "abc"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := json.Marshal(tt.cfg)
+			if _, err := ParseKeyring(data); !errors.Is(err, ErrBadKeyring) {
+				t.Errorf("ParseKeyring() error = %v, want %v", err, ErrBadKeyring)
+			}
+		})
+	}
+}
+
+func TestKeyring_JWKS(t *testing.T) {
+	edPrivate, _, _, rsaPublic := testKeys(t)
+	k := mustKeyring(t, keyringConfig{Active: "ed", Keys: []keyConfig{
+		{ID: "hs", Algorithm: "HS256", Secret: "secret"},
+		{ID: "ed", Algorithm: "EdDSA", PrivateKey: edPrivate},
+		{ID: "rs", Algorithm: "RS256", PublicKey: rsaPublic},
+	}})
+
+	set := k.JWKS()
+	if len(set.Keys) != 2 {
+		t.Fatalf("JWKS() has %d keys, want 2", len(set.Keys))
+	}
+	ed, rs := set.Keys[0], set.Keys[1]
+	if ed.ID != "ed" || ed.KeyType != "OKP" || ed.Curve != "Ed25519" || ed.X == "" {
+		t.Errorf("Ed25519 key = %+v", ed)
+	}
+	if rs.ID != "rs" || rs.KeyType != "RSA" || rs.N == "" || rs.E != "AQAB" {
+		t.Errorf("RSA key = %+v", rs)
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gambruh/gophermart/internal/argon2id"
+	"github.com/gambruh/gophermart/internal/config"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashParams returns the argon2id parameters for new password hashes, the
+// ones not set in the config are taken from argon2id.DefaultParams
+func HashParams() *argon2id.Params {
+	params := *argon2id.DefaultParams
+	if config.Cfg.HashMemory > 0 {
+		params.Memory = config.Cfg.HashMemory
+	}
+	if config.Cfg.HashIterations > 0 {
+		params.Iterations = config.Cfg.HashIterations
+	}
+	if config.Cfg.HashParallelism > 0 {
+		params.Parallelism = config.Cfg.HashParallelism
+	}
+	return &params
+}
+
+func hashPassword(password string) (string, error) {
+	return argon2id.CreateHash(password, HashParams())
+}
+
+// isBcrypt tells a bcrypt hash of an imported user from an argon2id one
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// comparePassword checks the password against a stored argon2id or bcrypt
+// hash. rehash is set when the password matches but the hash should be
+// replaced by one made with the current parameters
+func comparePassword(password, hash string) (match bool, rehash bool, err error) {
+	if isBcrypt(hash) {
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		return err == nil, err == nil, err
+	}
+
+	match, err = argon2id.ComparePasswordAndHash(password, hash)
+	if err != nil || !match {
+		return false, false, err
+	}
+	rehash, err = argon2id.NeedsRehash(hash, HashParams())
+	return true, rehash, err
+}
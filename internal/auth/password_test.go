@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gambruh/gophermart/internal/argon2id"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestComparePassword(t *testing.T) {
+	current, err := hashPassword("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	weak := *HashParams()
+	weak.Memory /= 2
+	outdated, err := argon2id.CreateHash("pass", &weak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		password   string
+		hash       string
+		wantMatch  bool
+		wantRehash bool
+	}{
+		{name: "current params", password: "pass", hash: current, wantMatch: true},
+		{name: "outdated params", password: "pass", hash: outdated, wantMatch: true, wantRehash: true},
+		{name: "bcrypt", password: "pass", hash: string(legacy), wantMatch: true, wantRehash: true},
+		{name: "wrong password", password: "wrong", hash: outdated},
+		{name: "wrong bcrypt password", password: "wrong", hash: string(legacy)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, rehash, err := comparePassword(tt.password, tt.hash)
+			if err != nil {
+				t.Fatalf("comparePassword() error = %v", err)
+			}
+			if match != tt.wantMatch || rehash != tt.wantRehash {
+				t.Errorf("comparePassword() = %v, %v, want %v, %v", match, rehash, tt.wantMatch, tt.wantRehash)
+			}
+		})
+	}
+}
+
+func TestAuthMemStorage_UpgradesLegacyHash(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMemStorage()
+	s.Data["imported"] = string(legacy)
+
+	if err = s.VerifyCredentials("imported", "wrong"); err != ErrWrongPassword {
+		t.Fatalf("VerifyCredentials() error = %v, want %v", err, ErrWrongPassword)
+	}
+	if s.Data["imported"] != string(legacy) {
+		t.Error("hash is replaced after a wrong password")
+	}
+
+	if err = s.VerifyCredentials("imported", "pass"); err != nil {
+		t.Fatalf("VerifyCredentials() error = %v", err)
+	}
+	upgraded := s.Data["imported"]
+	if !strings.HasPrefix(upgraded, "$argon2id$") {
+		t.Fatalf("hash isn't upgraded to argon2id: %s", upgraded)
+	}
+	if err = s.VerifyCredentials("imported", "pass"); err != nil {
+		t.Errorf("VerifyCredentials() with the upgraded hash error = %v", err)
+	}
+	if s.Data["imported"] != upgraded {
+		t.Error("up-to-date hash is replaced again")
+	}
+}
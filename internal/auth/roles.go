@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gambruh/gophermart/internal/config"
+)
+
+// RoleAdmin lets the user into the operator endpoints under /api/admin
+const RoleAdmin = "admin"
+
+var ErrUnknownRole = errors.New("unknown role")
+
+// knownRoles are the roles that can be granted
+var knownRoles = map[string]bool{
+	RoleAdmin: true,
+}
+
+// User is an account as operators see it
+type User struct {
+	Login string   `json:"login"`
+	Roles []string `json:"roles"`
+}
+
+// RoleChange is the request body setting the roles of a user
+type RoleChange struct {
+	Roles []string `json:"roles"`
+}
+
+// NormalizeRoles checks the roles are known and returns them sorted without repeats
+func NormalizeRoles(roles []string) ([]string, error) {
+	seen := make(map[string]bool, len(roles))
+	normalized := []string{}
+	for _, role := range roles {
+		if !knownRoles[role] {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownRole, role)
+		}
+		if !seen[role] {
+			seen[role] = true
+			normalized = append(normalized, role)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// HasRole tells whether the authenticated user of the request has the role.
+// The roles come from the access token, so they may predate a role change
+func HasRole(ctx context.Context, role string) bool {
+	roles, _ := ctx.Value(config.Roles("roles")).([]string)
+	return containsRole(roles, role)
+}
+
+func containsRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireRole lets through only the users having the role. It goes after
+// AuthMiddleware, which puts the roles of the token into the context. A token
+// with the role is checked against st as well, so that a user who lost the
+// role is turned away at once rather than once the token expires
+func RequireRole(st SessionStorage, role string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !HasRole(r.Context(), role) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			login, _ := r.Context().Value(config.UserID("userID")).(string)
+			roles, err := st.GetRoles(r.Context(), login)
+			switch {
+			case err == nil:
+			case errors.Is(err, ErrUserNotFound):
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			default:
+				log.Println("error when checking roles:", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !containsRole(roles, role) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
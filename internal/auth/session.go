@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gambruh/gophermart/internal/config"
+)
+
+// cookie names of the access and refresh tokens
+const (
+	AccessCookie  = "gophermart-auth"
+	RefreshCookie = "gophermart-refresh"
+)
+
+// defaults for the token lifetimes when the config leaves them empty
+const (
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionRevoked  = errors.New("session is revoked or expired")
+	ErrRefreshReused   = errors.New("refresh token has already been used")
+)
+
+// Session is a login of a user on one device. Only a hash of its refresh
+// token is stored, the token itself is known to the client only
+type Session struct {
+	ID          string
+	Login       string
+	RefreshHash string
+	ExpiresAt   time.Time
+}
+
+// SessionStorage keeps the sessions, so that they can be revoked before
+// their tokens expire
+type SessionStorage interface {
+	// CreateSession stores a new session, ErrUserNotFound if there is no such user
+	CreateSession(ctx context.Context, s Session) error
+	// RotateSession replaces the refresh token of a live session and extends it
+	// till expiresAt. Presenting a token that was already rotated revokes the
+	// session and gives ErrRefreshReused, as the token must have been stolen
+	RotateSession(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (Session, error)
+	// CheckSession returns nil for a live session, ErrSessionRevoked or ErrSessionNotFound otherwise
+	CheckSession(ctx context.Context, id string) error
+	RevokeSession(ctx context.Context, id string) error
+	RevokeUserSessions(ctx context.Context, login string) error
+	// GetRoles returns the roles put into the access tokens of the user
+	GetRoles(ctx context.Context, login string) ([]string, error)
+}
+
+// Tokens are issued to the client on login and on every refresh
+type Tokens struct {
+	Access           string
+	Refresh          string
+	RefreshExpiresAt time.Time
+}
+
+func accessTTL() time.Duration {
+	if config.Cfg.AccessTTL > 0 {
+		return config.Cfg.AccessTTL
+	}
+	return defaultAccessTTL
+}
+
+func refreshTTL() time.Duration {
+	if config.Cfg.RefreshTTL > 0 {
+		return config.Cfg.RefreshTTL
+	}
+	return defaultRefreshTTL
+}
+
+// randomToken returns n random bytes encoded for use in a cookie
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hash of a refresh token as it is stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewSession starts a session of the user and issues its tokens
+func NewSession(ctx context.Context, st SessionStorage, login string) (Tokens, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return Tokens{}, err
+	}
+	refresh, err := randomToken(32)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	s := Session{
+		ID:          id,
+		Login:       login,
+		RefreshHash: HashToken(refresh),
+		ExpiresAt:   time.Now().Add(refreshTTL()),
+	}
+	if err = st.CreateSession(ctx, s); err != nil {
+		return Tokens{}, err
+	}
+	return issueTokens(ctx, st, s, refresh)
+}
+
+// RefreshSession exchanges a refresh token for a new pair of tokens
+func RefreshSession(ctx context.Context, st SessionStorage, refresh string) (Tokens, error) {
+	newRefresh, err := randomToken(32)
+	if err != nil {
+		return Tokens{}, err
+	}
+	s, err := st.RotateSession(ctx, HashToken(refresh), HashToken(newRefresh), time.Now().Add(refreshTTL()))
+	if err != nil {
+		return Tokens{}, err
+	}
+	return issueTokens(ctx, st, s, newRefresh)
+}
+
+// issueTokens signs an access token with the current roles of the user
+func issueTokens(ctx context.Context, st SessionStorage, s Session, refresh string) (Tokens, error) {
+	roles, err := st.GetRoles(ctx, s.Login)
+	if err != nil {
+		return Tokens{}, err
+	}
+	access, err := GenerateToken(s.Login, s.ID, roles)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return Tokens{
+		Access:           access,
+		Refresh:          refresh,
+		RefreshExpiresAt: s.ExpiresAt,
+	}, nil
+}
+
+// SetTokenCookies hands the tokens over to the client. The refresh token is
+// only sent back to the user endpoints
+func SetTokenCookies(w http.ResponseWriter, t Tokens) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     AccessCookie,
+		Value:    t.Access,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     RefreshCookie,
+		Value:    t.Refresh,
+		Path:     "/api/user",
+		Expires:  t.RefreshExpiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// ClearTokenCookies makes the client forget both tokens
+func ClearTokenCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: AccessCookie, Path: "/", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: RefreshCookie, Path: "/api/user", MaxAge: -1})
+}
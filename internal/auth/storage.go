@@ -0,0 +1,256 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AuthMemStorage keeps users in memory. Passwords are stored as argon2id
+// hashes, same as in the database
+type AuthMemStorage struct {
+	// login - password hash pairs
+	Data map[string]string
+
+	// sessions by id, and session ids by current and previous refresh token hashes
+	sessions map[string]*memSession
+	refresh  map[string]string
+	previous map[string]string
+
+	// roles of the users having any
+	roles map[string][]string
+
+	// to ensure possible concurrent usage
+	Mu *sync.RWMutex
+}
+
+func NewMemStorage() *AuthMemStorage {
+	return &AuthMemStorage{
+		Data:     make(map[string]string),
+		sessions: make(map[string]*memSession),
+		refresh:  make(map[string]string),
+		previous: make(map[string]string),
+		roles:    make(map[string][]string),
+		Mu:       &sync.RWMutex{},
+	}
+}
+
+func (s *AuthMemStorage) Register(login string, password string) error {
+	// hashing is slow, so it's done before taking the lock
+	hashedpassword, err := hashPassword(password)
+	if err != nil {
+		log.Println("error when trying to hash password:", err)
+		return err
+	}
+
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	_, contains := s.Data[login]
+	if contains {
+		return ErrUsernameIsTaken
+	}
+	s.Data[login] = hashedpassword
+	return nil
+}
+
+func (s *AuthMemStorage) VerifyCredentials(login string, password string) error {
+	hash, err := s.GetPass(login)
+	if err != nil {
+		return err
+	}
+
+	check, rehash, err := comparePassword(password, hash)
+	if err != nil {
+		log.Println("error when trying to compare password and hash:", err)
+		return err
+	}
+	if !check {
+		return ErrWrongPassword
+	}
+
+	if rehash {
+		hashedpassword, err := hashPassword(password)
+		if err != nil {
+			log.Println("error when trying to rehash password:", err)
+			return nil
+		}
+		s.Mu.Lock()
+		// a password changed in the meantime stays
+		if s.Data[login] == hash {
+			s.Data[login] = hashedpassword
+		}
+		s.Mu.Unlock()
+	}
+	return nil
+}
+
+// GetPass returns the password hash of the user
+func (s *AuthMemStorage) GetPass(username string) (string, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	password, contains := s.Data[username]
+	if !contains {
+		return "", ErrUserNotFound
+	}
+
+	return password, nil
+}
+
+// ChangePassword replaces the password of the user
+func (s *AuthMemStorage) ChangePassword(login string, password string) error {
+	hashedpassword, err := hashPassword(password)
+	if err != nil {
+		log.Println("error when trying to hash password:", err)
+		return err
+	}
+
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if _, contains := s.Data[login]; !contains {
+		return ErrUserNotFound
+	}
+	s.Data[login] = hashedpassword
+	return nil
+}
+
+// DeleteUser removes the user with all their sessions
+func (s *AuthMemStorage) DeleteUser(login string) error {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if _, contains := s.Data[login]; !contains {
+		return ErrUserNotFound
+	}
+	delete(s.Data, login)
+	delete(s.roles, login)
+	for id, session := range s.sessions {
+		if session.Login != login {
+			continue
+		}
+		delete(s.refresh, session.RefreshHash)
+		delete(s.previous, session.previousHash)
+		delete(s.sessions, id)
+	}
+	return nil
+}
+
+type memSession struct {
+	Session
+	previousHash string
+	revoked      bool
+}
+
+func (s *AuthMemStorage) CreateSession(ctx context.Context, session Session) error {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if _, contains := s.Data[session.Login]; !contains {
+		return ErrUserNotFound
+	}
+	s.sessions[session.ID] = &memSession{Session: session}
+	s.refresh[session.RefreshHash] = session.ID
+	return nil
+}
+
+func (s *AuthMemStorage) RotateSession(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (Session, error) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	id, contains := s.refresh[oldHash]
+	if !contains {
+		// the token may have been rotated already
+		id, contains = s.previous[oldHash]
+		if !contains {
+			return Session{}, ErrSessionNotFound
+		}
+		log.Println("refresh token reused, session revoked:", id)
+		s.sessions[id].revoked = true
+		return Session{}, ErrRefreshReused
+	}
+
+	session := s.sessions[id]
+	if session.revoked || !session.ExpiresAt.After(time.Now()) {
+		return Session{}, ErrSessionNotFound
+	}
+	delete(s.refresh, oldHash)
+	delete(s.previous, session.previousHash)
+	s.refresh[newHash] = id
+	s.previous[oldHash] = id
+	session.previousHash = oldHash
+	session.RefreshHash = newHash
+	session.ExpiresAt = expiresAt
+	return session.Session, nil
+}
+
+func (s *AuthMemStorage) CheckSession(ctx context.Context, id string) error {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	session, contains := s.sessions[id]
+	switch {
+	case !contains:
+		return ErrSessionNotFound
+	case session.revoked || !session.ExpiresAt.After(time.Now()):
+		return ErrSessionRevoked
+	default:
+		return nil
+	}
+}
+
+func (s *AuthMemStorage) RevokeSession(ctx context.Context, id string) error {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if session, contains := s.sessions[id]; contains {
+		session.revoked = true
+	}
+	return nil
+}
+
+func (s *AuthMemStorage) RevokeUserSessions(ctx context.Context, login string) error {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	for _, session := range s.sessions {
+		if session.Login == login {
+			session.revoked = true
+		}
+	}
+	return nil
+}
+
+func (s *AuthMemStorage) GetRoles(ctx context.Context, login string) ([]string, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	if _, contains := s.Data[login]; !contains {
+		return nil, ErrUserNotFound
+	}
+	return append([]string{}, s.roles[login]...), nil
+}
+
+func (s *AuthMemStorage) SetRoles(ctx context.Context, login string, roles []string) error {
+	roles, err := NormalizeRoles(roles)
+	if err != nil {
+		return err
+	}
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if _, contains := s.Data[login]; !contains {
+		return ErrUserNotFound
+	}
+	s.roles[login] = roles
+	return nil
+}
+
+// ListUsers returns the users sorted by login, as SQL storage does
+func (s *AuthMemStorage) ListUsers(ctx context.Context) ([]User, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	users := make([]User, 0, len(s.Data))
+	for login := range s.Data {
+		users = append(users, User{Login: login, Roles: append([]string{}, s.roles[login]...)})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Login < users[j].Login })
+	return users, nil
+}
+
+func (s *AuthMemStorage) Close() error {
+	return nil
+}
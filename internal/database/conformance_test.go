@@ -0,0 +1,83 @@
+package database_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/gambruh/gophermart/internal/database"
+	"github.com/gambruh/gophermart/internal/storagetest"
+)
+
+func TestMemStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) database.Storage {
+		return database.NewStorage()
+	})
+}
+
+func TestSQLdb_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) database.Storage {
+		return storagetest.NewPostgres(t)
+	})
+}
+
+func TestSQLdb_DeleteUserKeepsOperations(t *testing.T) {
+	st := storagetest.NewPostgres(t)
+	if err := st.Register("alice", "secretpass"); err != nil {
+		t.Fatal(err)
+	}
+	order := storagetest.LuhnNumber(100)
+	if err := st.SetOrder(order, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var accrual database.Money = 50_00
+	if err := st.UpdateAccrual([]database.ProcessedOrder{{Number: order, Status: "PROCESSED", Accrual: &accrual}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		number      string
+		sum         database.Money
+		processedAt time.Time
+	)
+	err := st.DB.QueryRow(`SELECT number, accrual, processed_at FROM operations WHERE user_id IS NULL`).
+		Scan(&number, &sum, &processedAt)
+	if err != nil {
+		t.Fatalf("anonymous operation not found: %v", err)
+	}
+	if number != order || sum != accrual {
+		t.Errorf("kept operation %s of %v, want %s of %v", number, sum, order, accrual)
+	}
+}
+
+func TestSQLdb_AccrualCreditedOnce(t *testing.T) {
+	st := storagetest.NewPostgres(t)
+	if err := st.Register("alice", "secretpass"); err != nil {
+		t.Fatal(err)
+	}
+	order := storagetest.LuhnNumber(100)
+	if err := st.SetOrder(order, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var accrual database.Money = 50_00
+	if err := st.UpdateAccrual([]database.ProcessedOrder{{Number: order, Status: "PROCESSED", Accrual: &accrual}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the way a second agent racing the first one would credit the order
+	_, err := st.DB.Exec(`
+		INSERT INTO operations (user_id, number, accrual, processed_at, type)
+		SELECT user_id, number, 50, now(), 'accrual'
+		FROM orders
+		WHERE number = $1`, order)
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		t.Errorf("second accrual of an order error = %v, want a unique violation", err)
+	}
+}
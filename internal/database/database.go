@@ -6,70 +6,300 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/gambruh/gophermart/internal/argon2id"
 	"github.com/gambruh/gophermart/internal/auth"
 	"github.com/gambruh/gophermart/internal/config"
 	"github.com/gambruh/gophermart/internal/helpers"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// SQLdb is the Postgres storage. Users and sessions are handled by the
+// embedded AuthDB sharing the same pool
 type SQLdb struct {
 	DB *sql.DB
+	*auth.AuthDB
 }
 
 type Operation struct {
 	Order       string    `json:"order"`
-	Accrual     float32   `json:"sum"`
+	Accrual     Money     `json:"sum"`
 	ProcessedAt time.Time `json:"processed_at"`
+
+	// the fields only operators see, through OperationRecord
+	ID     int64  `json:"-"`
+	Type   string `json:"-"`
+	Kind   string `json:"-"`
+	RefID  int64  `json:"-"`
+	Reason string `json:"-"`
+	Actor  string `json:"-"`
+}
+
+// operation types
+const (
+	OperationAccrual    = "accrual"
+	OperationWithdrawal = "withdrawal"
+	OperationAdjustment = "adjustment"
+	OperationExpiry     = "expiry"
+	// a refund gives back one withdrawal and lowers the withdrawn sum
+	OperationRefund = "refund"
+)
+
+// OperationTypes are all the operation types
+var OperationTypes = []string{OperationAccrual, OperationWithdrawal, OperationAdjustment, OperationExpiry, OperationRefund}
+
+// kinds of adjustments: a correction changes the balance by any sum, a
+// refund gives back one withdrawal and lowers the withdrawn sum. Other
+// operations have no kind
+const (
+	AdjustmentCorrection = "correction"
+	AdjustmentRefund     = "refund"
+)
+
+// OperationRecord is an operation as operators see it
+type OperationRecord struct {
+	ID          int64     `json:"id"`
+	Type        string    `json:"type"`
+	Kind        string    `json:"kind,omitempty"`
+	RefID       int64     `json:"ref_id,omitempty"`
+	Order       string    `json:"order,omitempty"`
+	Sum         Money     `json:"sum"`
+	Reason      string    `json:"reason,omitempty"`
+	Actor       string    `json:"actor,omitempty"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+// LedgerEntry is an operation in the user's history, with the balance right after it
+type LedgerEntry struct {
+	ID          int64     `json:"id"`
+	Type        string    `json:"type"`
+	Order       string    `json:"order,omitempty"`
+	Sum         Money     `json:"sum"`
+	Balance     Money     `json:"balance"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+// LedgerFilter narrows down the history to some operation types and to
+// operations made in [From, To). Empty fields don't filter
+type LedgerFilter struct {
+	Types []string
+	From  time.Time
+	To    time.Time
+}
+
+// Check validates the filter
+func (f LedgerFilter) Check() error {
+	for _, t := range f.Types {
+		known := false
+		for _, k := range OperationTypes {
+			known = known || t == k
+		}
+		if !known {
+			return fmt.Errorf("%w: %q", ErrUnknownOperationType, t)
+		}
+	}
+	return checkRange(f.From, f.To)
+}
+
+// matches tells whether the operation passes the filter
+func (f LedgerFilter) matches(op Operation) bool {
+	if !inRange(op.ProcessedAt, f.From, f.To) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if op.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderStatuses are the statuses an order goes through. A STALE order was
+// pending for too long and isn't polled any more
+var OrderStatuses = []string{"NEW", "PROCESSING", "INVALID", "PROCESSED", "STALE"}
+
+// OrderFilter narrows down the orders to some statuses and to orders uploaded
+// in [From, To). Empty fields don't filter
+type OrderFilter struct {
+	Statuses []string
+	From     time.Time
+	To       time.Time
+}
+
+// Check validates the filter
+func (f OrderFilter) Check() error {
+	for _, st := range f.Statuses {
+		known := false
+		for _, k := range OrderStatuses {
+			known = known || st == k
+		}
+		if !known {
+			return fmt.Errorf("%w: %q", ErrUnknownStatus, st)
+		}
+	}
+	return checkRange(f.From, f.To)
+}
+
+// matches tells whether the order passes the filter
+func (f OrderFilter) matches(ord Order) bool {
+	if !inRange(ord.UploadedAt, f.From, f.To) {
+		return false
+	}
+	if len(f.Statuses) == 0 {
+		return true
+	}
+	for _, st := range f.Statuses {
+		if ord.Status == st {
+			return true
+		}
+	}
+	return false
+}
+
+// WithdrawalFilter narrows down the withdrawals to those made in [From, To).
+// Zero times don't filter
+type WithdrawalFilter struct {
+	From time.Time
+	To   time.Time
+}
+
+// Check validates the filter
+func (f WithdrawalFilter) Check() error {
+	return checkRange(f.From, f.To)
+}
+
+// Adjustment is a manual change of a user's balance by an operator. A
+// negative one can't take the balance below zero. The reason is mandatory,
+// it is kept with the operation along with the operator
+type Adjustment struct {
+	Login  string `json:"-"`
+	Sum    Money  `json:"sum"`
+	Reason string `json:"reason"`
+	Actor  string `json:"-"`
+}
+
+// Refund gives the user back the points of their withdrawal for the order
+type Refund struct {
+	Login  string `json:"-"`
+	Order  string `json:"order"`
+	Reason string `json:"reason"`
+	Actor  string `json:"-"`
 }
 
 type Balance struct {
-	Current   float32 `json:"current"`
-	Withdrawn float32 `json:"withdrawn"`
+	Current   Money `json:"current"`
+	Withdrawn Money `json:"withdrawn"`
 }
 
 type WithdrawQ struct {
-	Order string  `json:"order"`
-	Sum   float32 `json:"sum"`
+	Order string `json:"order"`
+	Sum   Money  `json:"sum"`
 }
 
 type Order struct {
 	Number     string    `json:"number"`
 	Status     string    `json:"status"`
-	Accrual    *float32  `json:"accrual,omitempty"`
+	Accrual    *Money    `json:"accrual,omitempty"`
 	UploadedAt time.Time `json:"uploaded at"`
+
+	// the accrual polling schedule and lease, kept by MemStorage only
+	LastCheckedAt time.Time `json:"-"`
+	Attempts      int       `json:"-"`
+	NextCheckAt   time.Time `json:"-"`
+	PendingSince  time.Time `json:"-"`
+	LeasedUntil   time.Time `json:"-"`
+}
+
+// Schedule spaces out the accrual checks of a pending order: the first one
+// is due right away, the following ones Interval apart, doubled with every
+// check up to MaxInterval. An order pending for StaleAfter since it was
+// uploaded or rechecked becomes STALE, zero keeps polling it forever
+type Schedule struct {
+	Interval    time.Duration
+	MaxInterval time.Duration
+	StaleAfter  time.Duration
+}
+
+// next returns when an order checked at is due again after attempts checks
+func (s Schedule) next(at time.Time, attempts int) time.Time {
+	wait := s.Interval
+	for i := 0; i < attempts && wait < s.MaxInterval; i++ {
+		wait *= 2
+	}
+	if wait > s.MaxInterval {
+		wait = s.MaxInterval
+	}
+	return at.Add(wait)
+}
+
+// Claim asks for up to Limit orders due for an accrual check At, 0 for all
+// of them. The orders are leased for Lease, other agents don't get them until
+// the lease runs out or a result is saved, whichever comes first
+type Claim struct {
+	At       time.Time
+	Limit    int
+	Schedule Schedule
+	Lease    time.Duration
 }
 
 type ProcessedOrder struct {
-	Number  string   `json:"order"`
-	Status  string   `json:"status"`
-	Accrual *float32 `json:"accrual,omitempty"`
+	Number  string `json:"order"`
+	Status  string `json:"status"`
+	Accrual *Money `json:"accrual,omitempty"`
 }
 
+// Storage keeps users and their orders. Every storage can serve as auth storage too
 type Storage interface {
-	Register(login string, password string) error
-	VerifyCredentials(login string, password string) error
+	auth.AuthStorage
 	SetOrder(string, string) error
-	GetOrders(ctx context.Context) ([]Order, error)
-	GetOrdersForAccrual() ([]string, error)
-	GetPass(username string) (string, error)
+	// GetOrders returns a page of the user's orders, oldest first, and the
+	// cursor of the next page, nil on the last one
+	GetOrders(context.Context, OrderFilter, Page) ([]Order, *Cursor, error)
+	// ClaimOrdersForAccrual leases the orders due for an accrual check and
+	// schedules their next check, so that agents sharing the storage don't
+	// poll the same order. Orders pending for too long are marked STALE first
+	ClaimOrdersForAccrual(context.Context, Claim) ([]string, error)
+	// UpdateAccrual and AddAccrualOperation credit an order once, however
+	// many times its accrual is reported. A processed order doesn't change.
+	// UpdateAccrual skips the results with an unexpected status and stores
+	// the rest, the skipped ones are reported with ErrUnexpectedStatus
 	UpdateAccrual([]ProcessedOrder) error
 	AddAccrualOperation([]ProcessedOrder) error
 	GetBalance(context.Context) (Balance, error)
-	GetWithdrawals(context.Context) ([]Operation, error)
+	// GetWithdrawals pages through the user's withdrawals the way GetOrders does
+	GetWithdrawals(context.Context, WithdrawalFilter, Page) ([]Operation, *Cursor, error)
 	Withdraw(context.Context, WithdrawQ) error
+	// GetLedger returns a page of the user's operations, newest first, and
+	// the cursor of the next page, nil on the last one
+	GetLedger(context.Context, LedgerFilter, Page) ([]LedgerEntry, *Cursor, error)
+
+	// operator actions, see handlers.WebService admin routes
+	GetOperations(context.Context) ([]OperationRecord, error)
+	AdjustBalance(context.Context, Adjustment) error
+	RefundWithdrawal(context.Context, Refund) error
+	RecheckOrder(ctx context.Context, number string) error
+
+	// requests made with idempotency keys, see handlers.WebService.Idempotent
+	BeginRequest(context.Context, IdempotentRequest) (*SavedResponse, error)
+	FinishRequest(ctx context.Context, key string, resp SavedResponse) error
+	ReleaseRequest(ctx context.Context, key string) error
 }
 
 // типы ошибок
+// user errors are shared with the auth package, so that a storage gives the
+// same error values whichever interface it is used through
 var (
-	ErrUserNotFound           = errors.New("user not found in database")
+	ErrUserNotFound           = auth.ErrUserNotFound
 	ErrTableDoesntExist       = errors.New("table doesn't exist")
-	ErrUsernameIsTaken        = errors.New("username is taken")
-	ErrWrongPassword          = errors.New("wrong password")
-	ErrWrongCredentials       = errors.New("wrong login credentials")
+	ErrUsernameIsTaken        = auth.ErrUsernameIsTaken
+	ErrWrongPassword          = auth.ErrWrongPassword
+	ErrWrongCredentials       = auth.ErrWrongCredentials
 	ErrNoOperations           = errors.New("no records found")
 	ErrInsufficientFunds      = errors.New("not enough accrual to withdraw")
 	ErrWrongOrder             = errors.New("wrong order")
@@ -77,12 +307,70 @@ var (
 	ErrOrderLoadedAnotherUser = errors.New("order has been already loaded by another user")
 	ErrWrongOrderNumberFormat = errors.New("order number is wrong - can't pass Luhn algorithm")
 	ErrNoOrders               = errors.New("orders not found for the user")
+	ErrWrongSum               = errors.New("withdrawal sum must be positive")
+	ErrUnexpectedStatus       = errors.New("unexpected order status")
+	ErrZeroAdjustment         = errors.New("adjustment sum must not be zero")
+	ErrNoReason               = errors.New("adjustment needs a reason")
+	ErrOrderNotFound          = errors.New("order not found")
+	ErrOrderProcessed         = errors.New("order has been processed already")
+	ErrWithdrawalNotFound     = errors.New("withdrawal not found")
+	ErrAlreadyRefunded        = errors.New("withdrawal has been refunded already")
+	ErrUnknownOperationType   = errors.New("unknown operation type")
+	ErrBadRange               = errors.New("date range is empty")
+	ErrUnknownStatus          = errors.New("unknown order status")
 )
 
+// uniqueViolation is the postgres error code of a unique constraint violation
+const uniqueViolation = "23505"
+
+// checkAdjustment validates an adjustment before it is applied
+func checkAdjustment(adj Adjustment) error {
+	if adj.Sum == 0 {
+		return ErrZeroAdjustment
+	}
+	return checkReason(adj.Reason, adj.Actor)
+}
+
+// checkReason makes sure a manual operation says why and by whom it is made
+func checkReason(reason, actor string) error {
+	if strings.TrimSpace(reason) == "" || actor == "" {
+		return ErrNoReason
+	}
+	return nil
+}
+
+// accrualStatus maps a status reported by the accrual system to the status stored for the order
+func accrualStatus(status string) (string, error) {
+	switch status {
+	case "NEW":
+		return "NEW", nil
+	case "REGISTERED":
+		return "PROCESSING", nil
+	case "PROCESSING":
+		return "PROCESSING", nil
+	case "PROCESSED":
+		return "PROCESSED", nil
+	case "INVALID":
+		return "INVALID", nil
+	default:
+		log.Println("unexpected order status from accrual:", status)
+		return "", ErrUnexpectedStatus
+	}
+}
+
+// unexpectedStatuses reports the orders whose results were skipped for their status
+func unexpectedStatuses(skipped []string) error {
+	if len(skipped) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w, skipped orders %s", ErrUnexpectedStatus, strings.Join(skipped, ", "))
+}
+
 func NewSQLdb(postgresStr string) *SQLdb {
 	DB, _ := sql.Open("postgres", postgresStr)
 	return &SQLdb{
-		DB: DB,
+		DB:     DB,
+		AuthDB: auth.NewAuthDBFromPool(DB),
 	}
 }
 
@@ -100,6 +388,11 @@ func GetDB() (defstorage Storage) {
 	return defstorage
 }
 
+// Close closes the connection pool once in-flight queries are done
+func (s *SQLdb) Close() error {
+	return s.DB.Close()
+}
+
 func (s *SQLdb) CheckConn(dbAddress string) error {
 	db, err := sql.Open("postgres", config.Cfg.Database)
 	if err != nil {
@@ -118,158 +411,10 @@ func (s *SQLdb) CheckConn(dbAddress string) error {
 	return nil
 }
 
+// InitDatabase brings the schema up to date without touching existing data
 func (s *SQLdb) InitDatabase() error {
-	err := s.CheckNDropTables()
-	if err != nil {
-		return err
-	}
-	err = s.CreateOrdersTable()
-	if err != nil {
-		return err
-	}
-	err = s.CreateOperationsTable()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (s *SQLdb) CheckTableExists(tablename string) error {
-	var check bool
-	db, err := sql.Open("postgres", config.Cfg.Database)
-	if err != nil {
-		fmt.Printf("error opening database: %v", err)
-		return err
-	}
-	defer db.Close()
-
-	err = db.QueryRow(checkTableExistsQuery, tablename).Scan(&check)
-	if err != nil {
-		fmt.Printf("error checking if table exists: %v", err)
-		return err
-	}
-	if !check {
-		return ErrTableDoesntExist
-	}
-	return nil
-}
-
-func (s *SQLdb) CheckNDropTables() error {
-
-	var check bool
-
-	err := s.DB.QueryRow(checkTableExistsQuery, "orders").Scan(&check)
-	if err != nil {
-		fmt.Printf("error checking if table exists: %v", err)
-		return err
-	}
-	if check {
-		_, err = s.DB.Exec(dropOrdersTableQuery)
-		if err != nil {
-			return err
-		}
-	}
-	if err != nil {
-		fmt.Printf("error dropping a table: %v", err)
-		return err
-	}
-
-	err = s.DB.QueryRow(checkTableExistsQuery, "operations").Scan(&check)
-	if err != nil {
-		fmt.Printf("error checking if table exists: %v", err)
-		return err
-	}
-	if check {
-		_, err = s.DB.Exec(dropOperationsTableQuery)
-		if err != nil {
-			fmt.Println("Error when dropping ops table:", err)
-			return err
-		}
-	}
-	if err != nil {
-		fmt.Printf("error dropping a table: %v", err)
-		return err
-	}
-
-	return nil
-}
-
-func (s *SQLdb) CreateOrdersTable() error {
-	err := s.CheckTableExists("orders")
-	if err == ErrTableDoesntExist {
-		_, err := s.DB.Exec(createOrdersTableQuery)
-		log.Println(err)
-		return err
-	}
-	return nil
-
-}
-
-func (s *SQLdb) CreateOperationsTable() error {
-	err := s.CheckTableExists("operations")
-	if err == ErrTableDoesntExist {
-		_, err := s.DB.Exec(createOperationsTableQuery)
-		log.Println(err)
-		return err
-	}
-	return nil
-}
-
-func (s *SQLdb) Register(login string, password string) error {
-	var username string
-	hashedpassword, err := argon2id.CreateHash(password, argon2id.DefaultParams)
-	if err != nil {
-		log.Println("error when trying to hash password:", err)
-		return err
-	}
-	e := s.DB.QueryRow(auth.CheckUsernameQuery, login).Scan(&username)
-
-	switch e {
-	case sql.ErrNoRows:
-		_, err := s.DB.Exec(auth.AddNewUserQuery, login, hashedpassword)
-		return err
-	case nil:
-		err := ErrUsernameIsTaken
-		return err
-	default:
-		fmt.Printf("Something wrong when adding a user in database: %v\n", e)
-		return e
-	}
-}
-
-func (s *SQLdb) VerifyCredentials(login string, password string) error {
-	var (
-		id   int
-		pass string
-	)
-
-	err := s.DB.QueryRow(auth.CheckUsernameQuery, login).Scan(&id)
-	switch err {
-	case sql.ErrNoRows:
-		return nil
-	case nil:
-	default:
-		log.Println("Unexpected case in checking user's credentials in database:", err)
-		return err
-	}
-
-	err = s.DB.QueryRow(auth.CheckPasswordQuery, id).Scan(&pass)
-	if err != nil {
-		log.Println("Unexpected case in checking user's password in database:", err)
-		return err
-	}
-
-	check, err := argon2id.ComparePasswordAndHash(password, pass)
-	if err != nil {
-		log.Println("error when trying to compare password and hash:", err)
-		return err
-	}
-
-	if !check {
-		return ErrWrongPassword
-	}
-
-	return nil
+	_, err := s.MigrateUp(context.Background())
+	return err
 }
 
 // orders
@@ -277,6 +422,9 @@ func (s *SQLdb) SetOrder(ordernumber string, username string) error {
 	var userq string
 	var id string
 	err := s.DB.QueryRow(CheckIDbyUsernameQuery, username).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
 	if err != nil {
 		log.Println("error when trying to connect to database in SetOrder method:", err)
 		return err
@@ -301,100 +449,126 @@ func (s *SQLdb) SetOrder(ordernumber string, username string) error {
 	}
 }
 
-func (s *SQLdb) GetOrders(ctx context.Context) ([]Order, error) {
+func (s *SQLdb) GetOrders(ctx context.Context, filter OrderFilter, page Page) ([]Order, *Cursor, error) {
+	if err := filter.Check(); err != nil {
+		return nil, nil, err
+	}
+	var afterNumber string
+	if page.After != nil {
+		afterNumber = page.After.Key
+	}
+	limit := page.limit()
+
 	var ords []Order
 	username := ctx.Value(config.UserID("userID"))
-	rows, err := s.DB.QueryContext(ctx, getOrdersByUserQuery, username)
+	rows, err := s.DB.QueryContext(ctx, getOrdersByUserQuery, username, pq.Array(filter.Statuses),
+		nullTime(filter.From), nullTime(filter.To), afterTime(page.After), afterNumber, sqlLimit(limit))
 	if err != nil {
 		log.Println("error when getting orders:", err)
-		return nil, err
+		return nil, nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var ord Order
-		err = rows.Scan(&ord.Number, &ord.Status, &ord.UploadedAt)
+		err = rows.Scan(&ord.Number, &ord.Status, &ord.Accrual, &ord.UploadedAt)
 		if err != nil {
 			log.Println("error when scanning rows in GetOrders:", err)
-			return nil, err
-		}
-		if ord.Status == "PROCESSED" {
-			err = s.DB.QueryRowContext(ctx, getOrderAccrualQuery, ord.Number).Scan(&ord.Accrual)
-			if err != nil {
-				log.Println("error when scanning orders accrual in GetOrders:", err)
-				return nil, err
-			}
+			return nil, nil, err
 		}
 		ords = append(ords, ord)
 	}
 	err = rows.Err()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if len(ords) == 0 {
-		return ords, ErrNoOrders
+		return ords, nil, ErrNoOrders
 	}
-	return ords, nil
+	ords, next := cutPage(ords, limit, orderCursor)
+	return ords, next, nil
 }
 
-func (s *SQLdb) GetOrdersForAccrual() (results []string, err error) {
-	rows, err := s.DB.Query(getOrdersAccrualStatusUpdQuery)
+// orderCursor points right after the order
+func orderCursor(ord Order) Cursor {
+	return Cursor{Time: ord.UploadedAt, Key: ord.Number}
+}
+
+func (s *SQLdb) ClaimOrdersForAccrual(ctx context.Context, claim Claim) (results []string, err error) {
+	// Шаг 1 - объявляем транзакцию
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Шаг 1.1 - откат, если ошибка
+	defer tx.Rollback()
+
+	// шаг 2 - stale orders aren't claimed
+	if claim.Schedule.StaleAfter > 0 {
+		if _, err = tx.ExecContext(ctx, staleOrdersQuery, claim.At.Add(-claim.Schedule.StaleAfter)); err != nil {
+			log.Println("error when marking stale orders:", err)
+			return nil, err
+		}
+	}
+
+	// шаг 3
+	limit := sql.NullInt64{Int64: int64(claim.Limit), Valid: claim.Limit > 0}
+	rows, err := tx.QueryContext(ctx, claimOrdersQuery, claim.At, limit,
+		claim.Schedule.Interval.Seconds(), claim.Schedule.MaxInterval.Seconds(),
+		claim.Lease.Seconds())
 	if err != nil {
 		log.Println("error while trying to get orders for accrual status update:", err)
 		return nil, err
 	}
-	var number string
+	defer rows.Close()
 	for rows.Next() {
-		rows.Scan(&number)
+		var number string
+		if err = rows.Scan(&number); err != nil {
+			return nil, err
+		}
 		results = append(results, number)
 	}
 
 	err = rows.Err()
 	if err != nil {
-		log.Println("error when trying to query database in GetOrdersForAccrual:", err)
+		log.Println("error when trying to query database in ClaimOrdersForAccrual:", err)
 		return nil, err
 	}
-	return results, nil
+	return results, tx.Commit()
 }
 
 func (s *SQLdb) UpdateAccrual(ords []ProcessedOrder) (err error) {
-	accAddQ, err := s.DB.Prepare(AccrualAddQuery)
+	// Шаг 1 - объявляем транзакцию
+	tx, err := s.DB.Begin()
 	if err != nil {
-		log.Println("error in preparing SQL query AccrualAdd:", err)
 		return err
 	}
-	statusChangeQ, err := s.DB.Prepare(UpdateStatusQuery)
+
+	// Шаг 1.1 - откат, если ошибка
+	defer tx.Rollback()
+
+	accAddQ, err := tx.Prepare(AccrualAddQuery)
 	if err != nil {
-		log.Println("error in preparing SQL query UPDATESTATUS:", err)
+		log.Println("error in preparing SQL query AccrualAdd:", err)
 		return err
 	}
-
-	// Шаг 1 - объявляем транзакцию
-	tx, err := s.DB.Begin()
+	defer accAddQ.Close()
+	statusChangeQ, err := tx.Prepare(UpdateStatusQuery)
 	if err != nil {
+		log.Println("error in preparing SQL query UPDATESTATUS:", err)
 		return err
 	}
+	defer statusChangeQ.Close()
 
-	// Шаг 1.1 - откат, если ошибка
-	defer tx.Rollback()
-
-	// шаг 2
+	// шаг 2 - результат с неизвестным статусом пропускаем, остальные сохраняем
+	var skipped []string
 	for _, o := range ords {
 		// order status assertion
-		switch o.Status {
-		case "NEW":
-			o.Status = "NEW"
-		case "REGISTERED":
-			o.Status = "PROCESSING"
-		case "PROCESSING":
-			o.Status = "PROCESSING"
-		case "PROCESSED":
-			o.Status = "PROCESSED"
-		case "INVALID":
-			o.Status = "INVALID"
-		default:
-			log.Println("unexpected order status from accrual:", o.Status)
-			return errors.New("unexpected order status")
+		o.Status, err = accrualStatus(o.Status)
+		if err != nil {
+			skipped = append(skipped, o.Number)
+			continue
 		}
 		if o.Accrual != nil {
 			formattedTime := time.Now().Format(time.RFC3339)
@@ -412,11 +586,13 @@ func (s *SQLdb) UpdateAccrual(ords []ProcessedOrder) (err error) {
 		}
 
 	}
-	return tx.Commit()
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return unexpectedStatuses(skipped)
 }
 
 func (s *SQLdb) AddAccrualOperation(ords []ProcessedOrder) error {
-	balanceAddQ, _ := s.DB.Prepare(InsertOperationQuery)
 	// Шаг 1 - объявляем транзакцию
 	tx, err := s.DB.Begin()
 	if err != nil {
@@ -426,96 +602,358 @@ func (s *SQLdb) AddAccrualOperation(ords []ProcessedOrder) error {
 	// Шаг 1.1 - откат, если ошибка
 	defer tx.Rollback()
 
+	balanceAddQ, err := tx.Prepare(InsertOperationQuery)
+	if err != nil {
+		log.Println("error in preparing SQL query InsertOperation:", err)
+		return err
+	}
+	defer balanceAddQ.Close()
+
 	// Ставим время записи в базу как время выполнения операции (accrual не возвращает время)
 	formattedTime := time.Now().Format(time.RFC3339)
 	// шаг 2
 	for _, o := range ords {
-		if *o.Accrual == 0 {
+		if o.Accrual == nil || *o.Accrual == 0 {
 			continue
 		}
-		_, err := balanceAddQ.Exec(o.Number, o.Accrual, formattedTime)
+		var found int
+		err := balanceAddQ.QueryRow(o.Number, o.Accrual, formattedTime).Scan(&found)
 		if err != nil {
 			log.Println("error in executing InsertOperationQuery:", err)
 			return err
 		}
+		if found == 0 {
+			return fmt.Errorf("%w: %s", ErrWrongOrder, o.Number)
+		}
 	}
 
 	return tx.Commit()
 }
 
+// GetBalance reads the user's balance row kept up to date by every operation
 func (s *SQLdb) GetBalance(ctx context.Context) (Balance, error) {
 	var b Balance
 	username := ctx.Value(config.UserID("userID"))
-	err := s.DB.QueryRowContext(ctx, GetBalanceQuery, username).Scan(&b.Current)
-	if err != nil {
+	err := s.DB.QueryRowContext(ctx, GetBalanceQuery, username).Scan(&b.Current, &b.Withdrawn)
+	switch err {
+	case nil:
+		return b, nil
+	case sql.ErrNoRows:
+		// no operations yet
+		return Balance{}, nil
+	default:
+		log.Println("error when trying to connect to database in GetBalance method:", err)
 		return Balance{}, err
 	}
+}
 
-	err = s.DB.QueryRowContext(ctx, GetWithdrawnQuery, username).Scan(&b.Withdrawn)
-	if err != nil {
-		log.Println("error when trying to connect to database in GetBalance method:", err)
-		return Balance{}, err
+func (s *SQLdb) GetWithdrawals(ctx context.Context, filter WithdrawalFilter, page Page) ([]Operation, *Cursor, error) {
+	if err := filter.Check(); err != nil {
+		return nil, nil, err
 	}
-	if b.Withdrawn != 0 {
-		b.Withdrawn *= -1
+	afterID, err := idKey(page.After)
+	if err != nil {
+		return nil, nil, err
 	}
+	limit := page.limit()
 
-	return b, nil
-}
-
-func (s *SQLdb) GetWithdrawals(ctx context.Context) ([]Operation, error) {
 	var ops []Operation
 	username := ctx.Value(config.UserID("userID"))
-	rows, err := s.DB.QueryContext(ctx, GetWithdrawalsQuery, username)
+	rows, err := s.DB.QueryContext(ctx, GetWithdrawalsQuery, username,
+		nullTime(filter.From), nullTime(filter.To), afterTime(page.After), afterID, sqlLimit(limit))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var op Operation
-		err = rows.Scan(&op.Order, &op.Accrual, &op.ProcessedAt)
+		err = rows.Scan(&op.ID, &op.Order, &op.Accrual, &op.ProcessedAt)
 		if err != nil {
 			log.Println("error when scanning rows in getting orders:", err)
-			return nil, err
+			return nil, nil, err
 		}
+		op.Type = OperationWithdrawal
 		op.Accrual *= -1
 		ops = append(ops, op)
 	}
 	err = rows.Err()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return ops, nil
+	if len(ops) == 0 {
+		return nil, nil, ErrNoOperations
+	}
+	ops, next := cutPage(ops, limit, operationCursor)
+	return ops, next, nil
+}
+
+// operationCursor points right after the operation
+func operationCursor(op Operation) Cursor {
+	return Cursor{Time: op.ProcessedAt, Key: strconv.FormatInt(op.ID, 10)}
 }
 
+// Withdraw debits the balance and records the withdrawal in one transaction.
+// The debit only happens if the balance covers it and locks the balance row
+// until commit, so concurrent withdrawals can't spend the same points
 func (s *SQLdb) Withdraw(ctx context.Context, withdrawq WithdrawQ) error {
 	username := ctx.Value(config.UserID("userID"))
-	currentbalance, err := s.GetBalance(ctx)
-	if err != nil {
-		return err
-	}
 	pass := helpers.LuhnCheck(withdrawq.Order)
 	if !pass {
 		return ErrWrongOrder
 	}
+	if withdrawq.Sum <= 0 {
+		return ErrWrongSum
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, CheckIDbyUsernameQuery, username).Scan(&id)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return ErrUserNotFound
+	default:
+		log.Println("error when getting user id in Withdraw method:", err)
+		return err
+	}
 
-	if currentbalance.Current < withdrawq.Sum {
+	res, err := tx.ExecContext(ctx, debitBalanceQuery, id, withdrawq.Sum)
+	if err != nil {
+		log.Println("error when debiting balance in Withdraw method:", err)
+		return err
+	}
+	debited, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if debited == 0 {
 		return ErrInsufficientFunds
 	}
+
 	t := time.Now()
 	formattedtime := t.Format(time.RFC3339)
 
-	_, err = s.DB.ExecContext(ctx, InsertWithdrawOperation, username, withdrawq.Order, withdrawq.Sum*(-1), formattedtime)
-	return err
+	_, err = tx.ExecContext(ctx, InsertWithdrawOperation, username, withdrawq.Order, withdrawq.Sum*(-1), formattedtime)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		// the withdrawal is registered as a new order, its number can't be taken
+		return ErrWrongOrder
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *SQLdb) GetPass(username string) (string, error) {
-	var password string
+func (s *SQLdb) GetLedger(ctx context.Context, filter LedgerFilter, page Page) ([]LedgerEntry, *Cursor, error) {
+	if err := filter.Check(); err != nil {
+		return nil, nil, err
+	}
+	afterID, err := idKey(page.After)
+	if err != nil {
+		return nil, nil, err
+	}
+	limit := page.limit()
 
-	err := s.DB.QueryRow(getPassQuery, username).Scan(&password)
+	username := ctx.Value(config.UserID("userID"))
+	rows, err := s.DB.QueryContext(ctx, getLedgerQuery, username, pq.Array(filter.Types),
+		nullTime(filter.From), nullTime(filter.To), afterTime(page.After), afterID, sqlLimit(limit))
 	if err != nil {
-		return "", err
+		log.Println("error when getting ledger:", err)
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		if err = rows.Scan(&e.ID, &e.Type, &e.Order, &e.Sum, &e.Balance, &e.ProcessedAt); err != nil {
+			log.Println("error when scanning rows in GetLedger:", err)
+			return nil, nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
 	}
+	entries, next := cutPage(entries, limit, ledgerCursor)
+	return entries, next, nil
+}
 
-	return password, nil
+// ledgerCursor points right after the entry
+func ledgerCursor(e LedgerEntry) Cursor {
+	return Cursor{Time: e.ProcessedAt, Key: strconv.FormatInt(e.ID, 10)}
+}
+
+// nullTime makes a zero time NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// GetOperations returns all the operations of the user from ctx, oldest first
+func (s *SQLdb) GetOperations(ctx context.Context) ([]OperationRecord, error) {
+	username := ctx.Value(config.UserID("userID"))
+	rows, err := s.DB.QueryContext(ctx, getOperationsQuery, username)
+	if err != nil {
+		log.Println("error when getting operations:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ops []OperationRecord
+	for rows.Next() {
+		var op OperationRecord
+		err = rows.Scan(&op.ID, &op.Type, &op.Kind, &op.RefID, &op.Order, &op.Sum, &op.Reason, &op.Actor, &op.ProcessedAt)
+		if err != nil {
+			log.Println("error when scanning rows in GetOperations:", err)
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ops) == 0 {
+		return nil, ErrNoOperations
+	}
+	return ops, nil
+}
+
+// AdjustBalance changes the balance of adj.Login and records the adjustment
+// with its reason and actor in one transaction
+func (s *SQLdb) AdjustBalance(ctx context.Context, adj Adjustment) error {
+	if err := checkAdjustment(adj); err != nil {
+		return err
+	}
+
+	// Шаг 1 - объявляем транзакцию
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Шаг 1.1 - откат, если ошибка
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, CheckIDbyUsernameQuery, adj.Login).Scan(&id)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return ErrUserNotFound
+	default:
+		log.Println("error when getting user id in AdjustBalance method:", err)
+		return err
+	}
+
+	// шаг 2 - меняем баланс, строка баланса может ещё не существовать
+	if _, err = tx.ExecContext(ctx, ensureBalanceQuery, id); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, adjustBalanceQuery, id, adj.Sum)
+	if err != nil {
+		log.Println("error when adjusting balance:", err)
+		return err
+	}
+	adjusted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if adjusted == 0 {
+		return ErrInsufficientFunds
+	}
+
+	// шаг 3 - записываем операцию
+	if _, err = tx.ExecContext(ctx, insertAdjustmentQuery, id, adj.Sum, adj.Reason, adj.Actor); err != nil {
+		log.Println("error when recording adjustment:", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+// RefundWithdrawal records the refund of the user's withdrawal and gives the
+// points back in one transaction
+func (s *SQLdb) RefundWithdrawal(ctx context.Context, refund Refund) error {
+	if err := checkReason(refund.Reason, refund.Actor); err != nil {
+		return err
+	}
+
+	// Шаг 1 - объявляем транзакцию
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Шаг 1.1 - откат, если ошибка
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, CheckIDbyUsernameQuery, refund.Login).Scan(&id)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return ErrUserNotFound
+	default:
+		log.Println("error when getting user id in RefundWithdrawal method:", err)
+		return err
+	}
+
+	// шаг 2 - находим списание и блокируем его
+	var (
+		withdrawalID int64
+		sum          Money
+	)
+	err = tx.QueryRowContext(ctx, getWithdrawalQuery, id, refund.Order).Scan(&withdrawalID, &sum)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return ErrWithdrawalNotFound
+	default:
+		log.Println("error when getting withdrawal in RefundWithdrawal method:", err)
+		return err
+	}
+	sum *= -1
+
+	// шаг 3 - записываем возврат, повторный не пройдёт по уникальному индексу
+	_, err = tx.ExecContext(ctx, insertRefundQuery, id, refund.Order, sum, refund.Reason, refund.Actor, withdrawalID)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return ErrAlreadyRefunded
+	}
+	if err != nil {
+		log.Println("error when recording refund:", err)
+		return err
+	}
+
+	// шаг 4 - возвращаем баллы
+	if _, err = tx.ExecContext(ctx, refundBalanceQuery, id, sum); err != nil {
+		log.Println("error when refunding balance:", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecheckOrder makes the accrual worker poll an invalid or stale order again,
+// on a fresh schedule. An order still being polled is put on a fresh schedule
+// too, so that it is checked at once
+func (s *SQLdb) RecheckOrder(ctx context.Context, number string) error {
+	var status string
+	err := s.DB.QueryRowContext(ctx, recheckOrderQuery, number).Scan(&status)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrOrderNotFound
+	case err != nil:
+		log.Println("error when rechecking order:", err)
+		return err
+	case status == "PROCESSED":
+		return ErrOrderProcessed
+	default:
+		return nil
+	}
 }
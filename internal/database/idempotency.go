@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gambruh/gophermart/internal/config"
+)
+
+var (
+	ErrKeyReused      = errors.New("idempotency key is reused for another request")
+	ErrRequestPending = errors.New("request with the idempotency key is still being served")
+)
+
+// SavedResponse is the response to a request made with an idempotency key,
+// replayed to its repeats
+type SavedResponse struct {
+	Status int
+	Body   []byte
+}
+
+// IdempotentRequest is a request of the user from ctx made with an
+// idempotency key. Fingerprint tells the requests made with the same key
+// apart. Keys are kept from Since on, older ones are forgotten. A request
+// still pending since before PendingSince is taken for lost, a crashed
+// server never finishes it, and its key is taken over by the repeat
+type IdempotentRequest struct {
+	Key          string
+	Fingerprint  string
+	Since        time.Time
+	PendingSince time.Time
+}
+
+// BeginRequest reserves the key for the request. It returns the saved
+// response if the request has been served already, ErrKeyReused if the key
+// was used for another request and ErrRequestPending while the request is
+// still being served, unless it has been pending since before PendingSince
+func (s *SQLdb) BeginRequest(ctx context.Context, req IdempotentRequest) (*SavedResponse, error) {
+	username := ctx.Value(config.UserID("userID"))
+
+	// Шаг 1 - объявляем транзакцию
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Шаг 1.1 - откат, если ошибка
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, CheckIDbyUsernameQuery, username).Scan(&id)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, ErrUserNotFound
+	default:
+		log.Println("error when getting user id in BeginRequest method:", err)
+		return nil, err
+	}
+
+	// шаг 2 - забываем старые ключи и резервируем этот
+	if _, err = tx.ExecContext(ctx, purgeRequestsQuery, id, req.Since); err != nil {
+		return nil, err
+	}
+	res, err := tx.ExecContext(ctx, reserveRequestQuery, id, req.Key, req.Fingerprint, req.PendingSince)
+	if err != nil {
+		log.Println("error when reserving idempotency key:", err)
+		return nil, err
+	}
+	reserved, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if reserved == 1 {
+		return nil, tx.Commit()
+	}
+
+	// шаг 3 - ключ уже был
+	var (
+		fingerprint string
+		status      sql.NullInt64
+		body        []byte
+	)
+	err = tx.QueryRowContext(ctx, getRequestQuery, id, req.Key).Scan(&fingerprint, &status, &body)
+	if err != nil {
+		log.Println("error when getting idempotency key:", err)
+		return nil, err
+	}
+	return savedResponse(req, fingerprint, status, body)
+}
+
+// savedResponse sorts out a repeat of the request with the stored one
+func savedResponse(req IdempotentRequest, fingerprint string, status sql.NullInt64, body []byte) (*SavedResponse, error) {
+	switch {
+	case fingerprint != req.Fingerprint:
+		return nil, ErrKeyReused
+	case !status.Valid:
+		return nil, ErrRequestPending
+	default:
+		return &SavedResponse{Status: int(status.Int64), Body: body}, nil
+	}
+}
+
+// FinishRequest saves the response to the request made with the key
+func (s *SQLdb) FinishRequest(ctx context.Context, key string, resp SavedResponse) error {
+	username := ctx.Value(config.UserID("userID"))
+	_, err := s.DB.ExecContext(ctx, finishRequestQuery, username, key, resp.Status, resp.Body)
+	if err != nil {
+		log.Println("error when saving idempotent response:", err)
+	}
+	return err
+}
+
+// ReleaseRequest frees the key of a request which failed to be served, so
+// that it can be retried
+func (s *SQLdb) ReleaseRequest(ctx context.Context, key string) error {
+	username := ctx.Value(config.UserID("userID"))
+	_, err := s.DB.ExecContext(ctx, releaseRequestQuery, username, key)
+	if err != nil {
+		log.Println("error when releasing idempotency key:", err)
+	}
+	return err
+}
@@ -0,0 +1,304 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the schema migrations. Every migration is a pair of
+// files named NNNN_name.up.sql and NNNN_name.down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the key of the advisory lock held while migrating, so
+// that replicas starting at the same time don't apply migrations twice
+const migrationLockID = 8_732_001
+
+var (
+	ErrBadMigrationName  = errors.New("migration file name is not in NNNN_name.(up|down).sql format")
+	ErrMissingMigration  = errors.New("migration is missing its up or down part")
+	ErrUnknownMigration  = errors.New("database has a migration version unknown to this binary")
+	ErrNothingToRollback = errors.New("no applied migrations to roll back")
+)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// LoadMigrations reads the embedded migrations ordered by version
+func LoadMigrations() ([]Migration, error) {
+	return loadMigrations(migrationFiles, "migrations")
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		version, name, direction, err := parseMigrationName(e.Name())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, e.Name())
+		}
+		body, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("%w: version %d is used by %q and %q", ErrBadMigrationName, version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("%w: %04d_%s", ErrMissingMigration, m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// parseMigrationName splits "0001_init.up.sql" into 1, "init" and "up"
+func parseMigrationName(filename string) (version int, name string, direction string, err error) {
+	base := strings.TrimSuffix(filename, ".sql")
+	if base == filename {
+		return 0, "", "", ErrBadMigrationName
+	}
+	dot := strings.LastIndex(base, ".")
+	if dot < 0 {
+		return 0, "", "", ErrBadMigrationName
+	}
+	direction = base[dot+1:]
+	if direction != "up" && direction != "down" {
+		return 0, "", "", ErrBadMigrationName
+	}
+	base = base[:dot]
+
+	prefix, name, found := strings.Cut(base, "_")
+	if !found || name == "" {
+		return 0, "", "", ErrBadMigrationName
+	}
+	version, err = strconv.Atoi(prefix)
+	if err != nil || version <= 0 {
+		return 0, "", "", ErrBadMigrationName
+	}
+	return version, name, direction, nil
+}
+
+// MigrateUp applies every migration that hasn't been applied yet. It is safe to
+// call on every start - already applied versions are skipped
+func (s *SQLdb) MigrateUp(ctx context.Context) (applied int, err error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err = checkKnownVersions(done, migrations); err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := done[m.Version]; ok {
+				continue
+			}
+			err = runMigration(ctx, conn, m.Up, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, insertMigrationVersionQuery, m.Version, m.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("applying migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			log.Printf("applied migration %04d_%s\n", m.Version, m.Name)
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// MigrateDown rolls back the given number of most recently applied migrations
+func (s *SQLdb) MigrateDown(ctx context.Context, steps int) (rolledBack int, err error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err = checkKnownVersions(done, migrations); err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			return ErrNothingToRollback
+		}
+
+		for i := len(migrations) - 1; i >= 0 && rolledBack < steps; i-- {
+			m := migrations[i]
+			if _, ok := done[m.Version]; !ok {
+				continue
+			}
+			err = runMigration(ctx, conn, m.Down, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, deleteMigrationVersionQuery, m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("rolling back migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			log.Printf("rolled back migration %04d_%s\n", m.Version, m.Name)
+			rolledBack++
+		}
+		return nil
+	})
+	return rolledBack, err
+}
+
+// MigrationStatus lists every known migration and when it was applied, if ever
+func (s *SQLdb) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done map[int]time.Time
+	err = s.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		done, err = appliedVersions(ctx, conn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		st := MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := done[m.Version]; ok {
+			at := at
+			st.AppliedAt = &at
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, checkKnownVersions(done, migrations)
+}
+
+// withMigrationLock runs fn on a single connection holding the migration
+// advisory lock, creating the version table first if needed
+func (s *SQLdb) withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := s.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, lockMigrationsQuery, migrationLockID); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), unlockMigrationsQuery, migrationLockID); err != nil {
+			log.Println("error when releasing migrations lock:", err)
+		}
+	}()
+
+	if _, err = conn.ExecContext(ctx, createMigrationsTableQuery); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, getMigrationVersionsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		done[version] = appliedAt
+	}
+	return done, rows.Err()
+}
+
+func checkKnownVersions(done map[int]time.Time, migrations []Migration) error {
+	known := make(map[int]struct{}, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = struct{}{}
+	}
+	for v := range done {
+		if _, ok := known[v]; !ok {
+			return fmt.Errorf("%w: %d", ErrUnknownMigration, v)
+		}
+	}
+	return nil
+}
+
+// runMigration executes a migration script and its bookkeeping in one transaction
+func runMigration(ctx context.Context, conn *sql.Conn, script string, record func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if err = record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
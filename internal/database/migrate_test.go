@@ -0,0 +1,83 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no embedded migrations found")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", m.Name, m.Version, i+1)
+		}
+		if m.Up == "" || m.Down == "" {
+			t.Errorf("migration %04d_%s has an empty part", m.Version, m.Name)
+		}
+	}
+}
+
+func Test_loadMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    []int
+		wantErr error
+	}{
+		{
+			name: "ordered by version",
+			files: fstest.MapFS{
+				"m/0002_second.up.sql":   {Data: []byte("up2")},
+				"m/0002_second.down.sql": {Data: []byte("down2")},
+				"m/0001_first.up.sql":    {Data: []byte("up1")},
+				"m/0001_first.down.sql":  {Data: []byte("down1")},
+			},
+			want: []int{1, 2},
+		},
+		{
+			name: "missing down part",
+			files: fstest.MapFS{
+				"m/0001_first.up.sql": {Data: []byte("up1")},
+			},
+			wantErr: ErrMissingMigration,
+		},
+		{
+			name: "bad file name",
+			files: fstest.MapFS{
+				"m/first.up.sql": {Data: []byte("up1")},
+			},
+			wantErr: ErrBadMigrationName,
+		},
+		{
+			name: "version reused",
+			files: fstest.MapFS{
+				"m/0001_first.up.sql":   {Data: []byte("up1")},
+				"m/0001_other.down.sql": {Data: []byte("down1")},
+			},
+			wantErr: ErrBadMigrationName,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadMigrations(tt.files, "m")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("loadMigrations() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("loadMigrations() returned %d migrations, want %d", len(got), len(tt.want))
+			}
+			for i, v := range tt.want {
+				if got[i].Version != v {
+					t.Errorf("migration %d has version %d, want %d", i, got[i].Version, v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS operations CASCADE;
+DROP TABLE IF EXISTS orders CASCADE;
+DROP TABLE IF EXISTS passwords CASCADE;
+DROP TABLE IF EXISTS users CASCADE;
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL,
+	username text NOT NULL UNIQUE,
+	PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS passwords (
+	id integer PRIMARY KEY,
+	password TEXT NOT NULL,
+	CONSTRAINT fk_users
+		FOREIGN KEY (id) 
+			REFERENCES users(id)
+			ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+	number TEXT UNIQUE NOT NULL PRIMARY KEY,
+	user_id integer NOT NULL,
+	status text NOT NULL,
+	uploaded_at TIMESTAMP WITH TIME ZONE,
+	CONSTRAINT fk_ousers
+		FOREIGN KEY (user_id)
+			REFERENCES users(id)
+			ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS operations (
+	id SERIAL,
+	user_id integer NOT NULL,
+	number TEXT NOT NULL,
+	accrual double precision,
+	processed_at TIMESTAMP WITH TIME ZONE,
+	PRIMARY KEY (id),
+	CONSTRAINT fk_oorders
+		FOREIGN KEY (number)
+			REFERENCES orders(number)
+			ON DELETE CASCADE
+);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS balances (
+	user_id integer PRIMARY KEY,
+	current double precision NOT NULL DEFAULT 0,
+	withdrawn double precision NOT NULL DEFAULT 0,
+	version bigint NOT NULL DEFAULT 0,
+	CONSTRAINT fk_busers
+		FOREIGN KEY (user_id)
+			REFERENCES users(id)
+			ON DELETE CASCADE
+);
+
+INSERT INTO balances (user_id, current, withdrawn)
+SELECT operations.user_id,
+	SUM(operations.accrual),
+	COALESCE(-SUM(operations.accrual) FILTER (WHERE operations.accrual < 0), 0)
+FROM operations
+JOIN users ON users.id = operations.user_id
+GROUP BY operations.user_id
+ON CONFLICT (user_id) DO NOTHING;
@@ -0,0 +1,6 @@
+ALTER TABLE balances
+	ALTER COLUMN current TYPE double precision,
+	ALTER COLUMN withdrawn TYPE double precision;
+
+ALTER TABLE operations
+	ALTER COLUMN accrual TYPE double precision;
@@ -0,0 +1,21 @@
+ALTER TABLE operations
+	ALTER COLUMN accrual TYPE NUMERIC(14, 2) USING ROUND(accrual::numeric, 2);
+
+ALTER TABLE balances
+	ALTER COLUMN current TYPE NUMERIC(14, 2) USING ROUND(current::numeric, 2),
+	ALTER COLUMN withdrawn TYPE NUMERIC(14, 2) USING ROUND(withdrawn::numeric, 2);
+
+-- balances were summed up in floating point, recount them from the rounded operations
+UPDATE balances
+SET current = ops.current,
+	withdrawn = ops.withdrawn,
+	version = balances.version + 1
+FROM (
+	SELECT user_id,
+		SUM(accrual) AS current,
+		COALESCE(-SUM(accrual) FILTER (WHERE accrual < 0), 0) AS withdrawn
+	FROM operations
+	GROUP BY user_id
+) ops
+WHERE ops.user_id = balances.user_id
+AND (balances.current <> ops.current OR balances.withdrawn <> ops.withdrawn);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	user_id integer NOT NULL,
+	refresh_hash TEXT NOT NULL UNIQUE,
+	previous_hash TEXT,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	revoked_at TIMESTAMP WITH TIME ZONE,
+	CONSTRAINT fk_susers
+		FOREIGN KEY (user_id)
+			REFERENCES users(id)
+			ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+CREATE INDEX IF NOT EXISTS sessions_previous_hash_idx ON sessions (previous_hash);
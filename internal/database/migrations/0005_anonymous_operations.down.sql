@@ -0,0 +1,12 @@
+-- the anonymous audit trail can't be kept with the old constraints
+ALTER TABLE operations DROP CONSTRAINT IF EXISTS fk_opusers;
+
+DELETE FROM operations
+WHERE user_id IS NULL
+OR number NOT IN (SELECT number FROM orders);
+
+ALTER TABLE operations ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE operations ADD CONSTRAINT fk_oorders
+	FOREIGN KEY (number)
+		REFERENCES orders(number)
+		ON DELETE CASCADE;
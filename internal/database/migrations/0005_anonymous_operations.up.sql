@@ -0,0 +1,13 @@
+-- operations outlive their orders and users: a deleted user's operations stay
+-- as an anonymous audit trail with user_id set to NULL
+ALTER TABLE operations DROP CONSTRAINT IF EXISTS fk_oorders;
+ALTER TABLE operations ALTER COLUMN user_id DROP NOT NULL;
+
+UPDATE operations
+SET user_id = NULL
+WHERE user_id NOT IN (SELECT id FROM users);
+
+ALTER TABLE operations ADD CONSTRAINT fk_opusers
+	FOREIGN KEY (user_id)
+		REFERENCES users(id)
+		ON DELETE SET NULL;
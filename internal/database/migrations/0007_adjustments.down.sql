@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS operations_user_id_idx;
+
+-- adjustments have no order and can't be kept with the old schema, the
+-- balances they changed have to be reconciled after this
+DELETE FROM operations
+WHERE number IS NULL;
+
+ALTER TABLE operations ALTER COLUMN number SET NOT NULL;
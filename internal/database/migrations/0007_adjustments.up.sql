@@ -0,0 +1,5 @@
+-- manual adjustments aren't bound to an order. Withdrawals are the negative
+-- operations with an order, so that a negative adjustment isn't one
+ALTER TABLE operations ALTER COLUMN number DROP NOT NULL;
+
+CREATE INDEX IF NOT EXISTS operations_user_id_idx ON operations (user_id, processed_at, id);
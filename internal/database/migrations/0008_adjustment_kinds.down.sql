@@ -0,0 +1,10 @@
+-- refunds are left as operations with an order and count as accruals, the
+-- withdrawn sums they lowered have to be reconciled after this
+DROP INDEX IF EXISTS operations_refund_idx;
+ALTER TABLE operations DROP CONSTRAINT IF EXISTS operations_reason_check;
+ALTER TABLE operations DROP CONSTRAINT IF EXISTS operations_kind_check;
+ALTER TABLE operations DROP CONSTRAINT IF EXISTS fk_opref;
+ALTER TABLE operations DROP COLUMN IF EXISTS ref_id;
+ALTER TABLE operations DROP COLUMN IF EXISTS actor;
+ALTER TABLE operations DROP COLUMN IF EXISTS reason;
+ALTER TABLE operations DROP COLUMN IF EXISTS kind;
@@ -0,0 +1,28 @@
+-- adjustments keep their kind and why and by whom they were made. A
+-- correction has no order, a refund gives back one withdrawal, which it
+-- refers to, and lowers the withdrawn sum. A withdrawal can be refunded once.
+-- Accruals and withdrawals have no kind
+ALTER TABLE operations ADD COLUMN IF NOT EXISTS kind text;
+ALTER TABLE operations ADD COLUMN IF NOT EXISTS reason text;
+ALTER TABLE operations ADD COLUMN IF NOT EXISTS actor text;
+ALTER TABLE operations ADD COLUMN IF NOT EXISTS ref_id integer;
+
+-- the reasons of the adjustments made so far went to the log only
+UPDATE operations
+SET kind = 'correction',
+	reason = 'not recorded',
+	actor = 'unknown'
+WHERE number IS NULL;
+
+ALTER TABLE operations ADD CONSTRAINT fk_opref
+	FOREIGN KEY (ref_id)
+		REFERENCES operations(id);
+ALTER TABLE operations ADD CONSTRAINT operations_kind_check
+	CHECK (kind IN ('correction', 'refund')
+		AND (COALESCE(kind, '') = 'correction') = (number IS NULL)
+		AND (COALESCE(kind, '') = 'refund') = (ref_id IS NOT NULL));
+ALTER TABLE operations ADD CONSTRAINT operations_reason_check
+	CHECK (kind IS NULL OR (reason IS NOT NULL AND actor IS NOT NULL));
+
+CREATE UNIQUE INDEX IF NOT EXISTS operations_refund_idx ON operations (ref_id)
+	WHERE kind = 'refund';
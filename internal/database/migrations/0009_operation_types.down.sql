@@ -0,0 +1,8 @@
+-- expiries can't be kept without the types, the balances they changed have
+-- to be reconciled after this
+DELETE FROM operations
+WHERE type = 'expiry';
+
+ALTER TABLE operations DROP CONSTRAINT IF EXISTS operations_type_kind_check;
+ALTER TABLE operations DROP CONSTRAINT IF EXISTS operations_type_check;
+ALTER TABLE operations DROP COLUMN IF EXISTS type;
@@ -0,0 +1,19 @@
+-- operations are told apart by an explicit type instead of the sign of the
+-- sum, the order and the kind. Refunds get a type of their own, they keep
+-- their kind, and points can expire
+ALTER TABLE operations ADD COLUMN IF NOT EXISTS type text NOT NULL DEFAULT 'accrual';
+
+UPDATE operations
+SET type = CASE
+	WHEN kind = 'correction' THEN 'adjustment'
+	WHEN kind = 'refund' THEN 'refund'
+	ELSE 'withdrawal'
+	END
+WHERE kind IS NOT NULL
+OR accrual < 0;
+
+ALTER TABLE operations ADD CONSTRAINT operations_type_check
+	CHECK (type IN ('accrual', 'withdrawal', 'adjustment', 'expiry', 'refund'));
+ALTER TABLE operations ADD CONSTRAINT operations_type_kind_check
+	CHECK ((type = 'adjustment') = (COALESCE(kind, '') = 'correction')
+		AND (type = 'refund') = (COALESCE(kind, '') = 'refund'));
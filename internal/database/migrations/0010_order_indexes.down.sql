@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS operations_number_idx;
+DROP INDEX IF EXISTS orders_user_id_idx;
@@ -0,0 +1,4 @@
+-- the orders of a user are listed by upload time, see getOrdersByUserQuery
+CREATE INDEX IF NOT EXISTS orders_user_id_idx ON orders (user_id, uploaded_at, number);
+-- and come with the accruals of their numbers
+CREATE INDEX IF NOT EXISTS operations_number_idx ON operations (number);
@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS orders_next_check_idx;
+
+-- stale orders are polled again with the old schema
+UPDATE orders
+SET status = 'PROCESSING'
+WHERE status = 'STALE';
+
+ALTER TABLE orders DROP COLUMN IF EXISTS pending_since;
+ALTER TABLE orders DROP COLUMN IF EXISTS next_check_at;
+ALTER TABLE orders DROP COLUMN IF EXISTS attempts;
+ALTER TABLE orders DROP COLUMN IF EXISTS last_checked_at;
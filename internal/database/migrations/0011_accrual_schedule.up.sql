@@ -0,0 +1,14 @@
+-- every order waiting for accrual is checked on its own schedule, the checks
+-- are spaced out more and more while the order stays pending
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS last_checked_at timestamptz;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS next_check_at timestamptz;
+-- an order pending for too long since it was uploaded or rechecked becomes STALE
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS pending_since timestamptz NOT NULL DEFAULT now();
+
+UPDATE orders
+SET pending_since = uploaded_at
+WHERE uploaded_at IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS orders_next_check_idx ON orders (next_check_at NULLS FIRST, number)
+	WHERE status IN ('NEW', 'PROCESSING');
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS operations_accrual_idx;
+
+-- the duplicates stay offset by their corrections
+ALTER TABLE operations DROP COLUMN IF EXISTS duplicate;
+
+ALTER TABLE orders DROP COLUMN IF EXISTS leased_until;
@@ -0,0 +1,43 @@
+-- the agent checking an order holds a lease on it until the result is saved
+-- or the lease runs out, other agents don't claim the order meanwhile
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS leased_until timestamptz;
+
+-- an order is credited once. Accruals recorded again by racing agents are
+-- kept as duplicates and offset by corrections, which take them off the
+-- balances they were credited to
+ALTER TABLE operations ADD COLUMN IF NOT EXISTS duplicate boolean NOT NULL DEFAULT false;
+
+WITH duplicates AS (
+	UPDATE operations
+	SET duplicate = true
+	WHERE type = 'accrual'
+	AND user_id IS NOT NULL
+	AND id NOT IN (
+		SELECT MIN(id)
+		FROM operations
+		WHERE type = 'accrual'
+		AND user_id IS NOT NULL
+		GROUP BY number
+		)
+	RETURNING user_id, number, accrual
+), corrections AS (
+	INSERT INTO operations (user_id, accrual, processed_at, type, kind, reason, actor)
+	SELECT user_id, -accrual, date_trunc('second', now()), 'adjustment', 'correction',
+		'duplicate accrual of order ' || number, 'migration 0012'
+	FROM duplicates
+	RETURNING user_id, accrual
+)
+UPDATE balances
+SET current = balances.current + corrections.total,
+	version = balances.version + 1
+FROM (
+	SELECT user_id, SUM(accrual) AS total
+	FROM corrections
+	GROUP BY user_id
+	) corrections
+WHERE balances.user_id = corrections.user_id;
+
+-- operations left by deleted users don't count, their order numbers may be
+-- uploaded again
+CREATE UNIQUE INDEX IF NOT EXISTS operations_accrual_idx ON operations (number)
+	WHERE type = 'accrual' AND user_id IS NOT NULL AND NOT duplicate;
@@ -0,0 +1,15 @@
+-- requests made with an Idempotency-Key, their responses are replayed to the
+-- repeats. status is NULL while the first request is being served
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	user_id integer NOT NULL,
+	key text NOT NULL,
+	fingerprint text NOT NULL,
+	status integer,
+	body bytea,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (user_id, key),
+	CONSTRAINT fk_ikusers
+		FOREIGN KEY (user_id)
+			REFERENCES users(id)
+			ON DELETE CASCADE
+);
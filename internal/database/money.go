@@ -0,0 +1,120 @@
+package database
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount of loyalty points kept in hundredths, so that sums of
+// operations are exact. On the wire and in the database it is a plain
+// decimal number: 729.98 is Money(72998)
+type Money int64
+
+// moneyScale is the number of minor units in one point
+const moneyScale = 100
+
+var ErrBadMoney = errors.New("amount is not a decimal number")
+
+// ParseMoney parses a decimal amount such as "500", "500.5" or "-42.17".
+// Amounts finer than a hundredth are rounded half away from zero. Fractions
+// such as "1/3", which big.Rat takes as well, are not amounts
+func ParseMoney(s string) (Money, error) {
+	trimmed := strings.TrimSpace(s)
+	if strings.Contains(trimmed, "/") {
+		return 0, fmt.Errorf("%w: %q", ErrBadMoney, s)
+	}
+	r, ok := new(big.Rat).SetString(trimmed)
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrBadMoney, s)
+	}
+	r.Mul(r, big.NewRat(moneyScale, 1))
+
+	minor, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if rem.Sign() != 0 && new(big.Int).Lsh(rem, 1).CmpAbs(r.Denom()) >= 0 {
+		minor.Add(minor, big.NewInt(int64(r.Sign())))
+	}
+	if !minor.IsInt64() {
+		return 0, fmt.Errorf("%w: %q", ErrBadMoney, s)
+	}
+	return Money(minor.Int64()), nil
+}
+
+// Minor returns the amount in hundredths
+func (m Money) Minor() int64 {
+	return int64(m)
+}
+
+// String formats the amount as a decimal number without trailing zeroes
+func (m Money) String() string {
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	whole := strconv.FormatInt(v/moneyScale, 10)
+	frac := v % moneyScale
+	switch {
+	case frac == 0:
+		return sign + whole
+	case frac%10 == 0:
+		return fmt.Sprintf("%s%s.%d", sign, whole, frac/10)
+	default:
+		return fmt.Sprintf("%s%s.%02d", sign, whole, frac)
+	}
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	// quoted amounts are accepted too, some clients send them to avoid floats
+	s = strings.Trim(s, `"`)
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// Value stores the amount as a decimal string for a NUMERIC column
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan reads a NUMERIC column, which lib/pq hands over as text
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+		return nil
+	case []byte:
+		return m.scanString(string(v))
+	case string:
+		return m.scanString(v)
+	case int64:
+		*m = Money(v * moneyScale)
+		return nil
+	default:
+		return fmt.Errorf("can't scan %T into Money", src)
+	}
+}
+
+func (m *Money) scanString(s string) error {
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Money
+		wantErr error
+	}{
+		{in: "500", want: 500_00},
+		{in: "500.5", want: 500_50},
+		{in: "729.98", want: 729_98},
+		{in: "-42.17", want: -42_17},
+		{in: "0.01", want: 1},
+		{in: "1e2", want: 100_00},
+		{in: "0.005", want: 1},
+		{in: "0.0049", want: 0},
+		{in: "-0.005", want: -1},
+		{in: "abc", wantErr: ErrBadMoney},
+		{in: "1/3", wantErr: ErrBadMoney},
+		{in: "", wantErr: ErrBadMoney},
+		{in: "1e30", wantErr: ErrBadMoney},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("ParseMoney(%q) error = %v, want %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMoney(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMoney_String(t *testing.T) {
+	tests := []struct {
+		in   Money
+		want string
+	}{
+		{in: 0, want: "0"},
+		{in: 500_00, want: "500"},
+		{in: 500_50, want: "500.5"},
+		{in: 729_98, want: "729.98"},
+		{in: 5, want: "0.05"},
+		{in: -42_17, want: "-42.17"},
+		{in: -10, want: "-0.1"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Money(%d).String() = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMoney_JSON(t *testing.T) {
+	var b Balance
+	err := json.Unmarshal([]byte(`{"current": 500.5, "withdrawn": 42}`), &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Current != 500_50 || b.Withdrawn != 42_00 {
+		t.Errorf("unmarshaled %+v, want 500.5 and 42", b)
+	}
+
+	out, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"current":500.5,"withdrawn":42}`; string(out) != want {
+		t.Errorf("marshaled %s, want %s", out, want)
+	}
+
+	var p ProcessedOrder
+	if err = json.Unmarshal([]byte(`{"order": "1", "status": "PROCESSED"}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Accrual != nil {
+		t.Errorf("missing accrual unmarshaled as %v", *p.Accrual)
+	}
+}
+
+func TestMoney_SumIsExact(t *testing.T) {
+	var sum Money
+	for i := 0; i < 1000; i++ {
+		sum += 729_98
+		sum -= 729_97
+	}
+	if sum != 10_00 {
+		t.Errorf("sum = %v, want 10", sum)
+	}
+}
+
+func TestMoney_Scan(t *testing.T) {
+	tests := []struct {
+		src  interface{}
+		want Money
+	}{
+		{src: []byte("729.98"), want: 729_98},
+		{src: "-12.50", want: -12_50},
+		{src: int64(7), want: 7_00},
+		{src: nil, want: 0},
+	}
+	for _, tt := range tests {
+		var m Money = 1
+		if err := m.Scan(tt.src); err != nil {
+			t.Errorf("Scan(%v) error = %v", tt.src, err)
+			continue
+		}
+		if m != tt.want {
+			t.Errorf("Scan(%v) = %d, want %d", tt.src, m, tt.want)
+		}
+	}
+	var m Money
+	if err := m.Scan(1.5); err == nil {
+		t.Error("Scan(float64) should fail")
+	}
+}
@@ -0,0 +1,105 @@
+package database_test
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"testing"
+
+	"github.com/gambruh/gophermart/internal/config"
+	"github.com/gambruh/gophermart/internal/database"
+	"github.com/gambruh/gophermart/internal/storagetest"
+)
+
+// BenchmarkSQLdb_GetOrders lists the orders of users with thousands of them,
+// all processed, with the single query of GetOrders and with a query per
+// order for the accrual, the way GetOrders used to do
+func BenchmarkSQLdb_GetOrders(b *testing.B) {
+	for _, n := range []int{1000, 5000} {
+		st := storagetest.NewPostgres(b)
+		login := "user" + strconv.Itoa(n)
+		if err := st.Register(login, "secretpass"); err != nil {
+			b.Fatal(err)
+		}
+		fillOrders(b, st.DB, login, n)
+		ctx := context.WithValue(context.Background(), config.UserID("userID"), login)
+
+		b.Run(strconv.Itoa(n)+"/joined", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ords, _, err := st.GetOrders(ctx, database.OrderFilter{}, database.AllItems)
+				if err != nil || len(ords) != n {
+					b.Fatalf("GetOrders() = %d orders, error %v", len(ords), err)
+				}
+			}
+		})
+		b.Run(strconv.Itoa(n)+"/per_order", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ords, err := ordersPerOrder(ctx, st.DB, login)
+				if err != nil || len(ords) != n {
+					b.Fatalf("ordersPerOrder() = %d orders, error %v", len(ords), err)
+				}
+			}
+		})
+	}
+}
+
+// fillOrders gives the user n processed orders with accruals
+func fillOrders(b *testing.B, db *sql.DB, login string, n int) {
+	b.Helper()
+	var id int
+	if err := db.QueryRow(`SELECT id FROM users WHERE username = $1`, login).Scan(&id); err != nil {
+		b.Fatal(err)
+	}
+	_, err := db.Exec(`
+		INSERT INTO orders (number, user_id, status, uploaded_at)
+		SELECT n::text, $1, 'PROCESSED', now()
+		FROM generate_series(1, $2) n`, id, n)
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, err = db.Exec(`
+		INSERT INTO operations (user_id, number, accrual, processed_at, type)
+		SELECT $1, n::text, 10, now(), 'accrual'
+		FROM generate_series(1, $2) n`, id, n)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err = db.Exec(`ANALYZE orders, operations`); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// ordersPerOrder reads the orders and then the accrual of every processed one
+func ordersPerOrder(ctx context.Context, db *sql.DB, login string) ([]database.Order, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT orders.number, orders.status, orders.uploaded_at
+		FROM orders
+		JOIN users ON orders.user_id = users.id
+		WHERE users.username = $1
+		ORDER BY orders.uploaded_at, orders.number`, login)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ords []database.Order
+	for rows.Next() {
+		var ord database.Order
+		if err = rows.Scan(&ord.Number, &ord.Status, &ord.UploadedAt); err != nil {
+			return nil, err
+		}
+		if ord.Status == "PROCESSED" {
+			err = db.QueryRowContext(ctx, `
+				SELECT operations.accrual
+				FROM operations
+				JOIN orders ON orders.number = operations.number
+					AND orders.user_id = operations.user_id
+				WHERE operations.number = $1`, ord.Number).Scan(&ord.Accrual)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+		}
+		ords = append(ords, ord)
+	}
+	return ords, rows.Err()
+}
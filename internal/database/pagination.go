@@ -0,0 +1,124 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// page sizes when the client gives none and the most it may ask for
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+var ErrBadCursor = errors.New("bad page cursor")
+
+// Cursor points at the last item of a page, the next page starts right after
+// it. Items are ordered by time, Key breaks ties between items of the same time
+type Cursor struct {
+	Time time.Time
+	Key  string
+}
+
+// Page asks for Limit items following After, or from the start if After is nil
+type Page struct {
+	Limit int
+	After *Cursor
+}
+
+// NoLimit as Page.Limit asks for all the items at once
+const NoLimit = -1
+
+// AllItems is the page holding the whole list
+var AllItems = Page{Limit: NoLimit}
+
+// String encodes the cursor for a client, who gets it back to us unchanged
+func (c Cursor) String() string {
+	raw := strconv.FormatInt(c.Time.UnixNano(), 10) + ":" + c.Key
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseCursor decodes a cursor given out by Cursor.String
+func ParseCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrBadCursor
+	}
+	nanos, key, found := strings.Cut(string(raw), ":")
+	if !found || key == "" {
+		return Cursor{}, ErrBadCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return Cursor{}, ErrBadCursor
+	}
+	return Cursor{Time: time.Unix(0, n), Key: key}, nil
+}
+
+// limit returns the page size to query, 0 for no limit
+func (p Page) limit() int {
+	switch {
+	case p.Limit == NoLimit:
+		return 0
+	case p.Limit <= 0:
+		return DefaultPageSize
+	case p.Limit > MaxPageSize:
+		return MaxPageSize
+	default:
+		return p.Limit
+	}
+}
+
+// sqlLimit is the LIMIT of a page query. It asks for one item more than fits
+// on the page to tell whether there is a next one, NULL gives everything
+func sqlLimit(limit int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(limit) + 1, Valid: limit > 0}
+}
+
+// cutPage cuts the items queried with sqlLimit down to the page and returns
+// the cursor of the next page if there are more items
+func cutPage[T any](items []T, limit int, cursor func(T) Cursor) ([]T, *Cursor) {
+	if limit == 0 || len(items) <= limit {
+		return items, nil
+	}
+	items = items[:limit]
+	next := cursor(items[limit-1])
+	return items, &next
+}
+
+// idKey parses the key of a cursor made of an id
+func idKey(c *Cursor) (int64, error) {
+	if c == nil {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(c.Key, 10, 64)
+	if err != nil {
+		return 0, ErrBadCursor
+	}
+	return id, nil
+}
+
+// afterTime is the time of the cursor for a query, NULL on the first page
+func afterTime(c *Cursor) sql.NullTime {
+	if c == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: c.Time, Valid: true}
+}
+
+// checkRange validates the time range [from, to), zero ends are open
+func checkRange(from, to time.Time) error {
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return ErrBadRange
+	}
+	return nil
+}
+
+// inRange tells whether t is in the range [from, to)
+func inRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCursor_RoundTrip(t *testing.T) {
+	tests := []Cursor{
+		{Time: time.Date(2023, 4, 1, 10, 30, 0, 123456000, time.UTC), Key: "42"},
+		{Time: time.Unix(0, 0), Key: "12345678903"},
+		{Time: time.Date(2023, 4, 1, 10, 30, 0, 0, time.UTC), Key: "a:b"},
+	}
+	for _, c := range tests {
+		got, err := ParseCursor(c.String())
+		if err != nil {
+			t.Errorf("ParseCursor(%v) error = %v", c, err)
+			continue
+		}
+		if !got.Time.Equal(c.Time) || got.Key != c.Key {
+			t.Errorf("ParseCursor() = %+v, want %+v", got, c)
+		}
+	}
+}
+
+func TestParseCursor_Errors(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{name: "not base64", in: "!!!"},
+		{name: "no key", in: encode("1680345000000000000:")},
+		{name: "no separator", in: encode("1680345000000000000")},
+		{name: "bad time", in: encode("yesterday:42")},
+	}
+	for _, tt := range tests {
+		if _, err := ParseCursor(tt.in); !errors.Is(err, ErrBadCursor) {
+			t.Errorf("%s: ParseCursor(%q) error = %v, want %v", tt.name, tt.in, err, ErrBadCursor)
+		}
+	}
+}
+
+func TestPage_limit(t *testing.T) {
+	tests := []struct {
+		limit int
+		want  int
+	}{
+		{limit: 0, want: DefaultPageSize},
+		{limit: -2, want: DefaultPageSize},
+		{limit: NoLimit, want: 0},
+		{limit: 10, want: 10},
+		{limit: MaxPageSize + 1, want: MaxPageSize},
+	}
+	for _, tt := range tests {
+		if got := (Page{Limit: tt.limit}).limit(); got != tt.want {
+			t.Errorf("Page{Limit: %d}.limit() = %d, want %d", tt.limit, got, tt.want)
+		}
+	}
+}
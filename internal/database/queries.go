@@ -1,49 +1,37 @@
 package database
 
 // SQL queries
-// database init queries
-const checkTableExistsQuery = `
-	SELECT EXISTS (
-		SELECT 	1 
-		FROM 	information_schema.tables
-		WHERE 	table_name = $1
+// migration queries
+const createMigrationsTableQuery = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
 	);
 `
 
-const dropOrdersTableQuery = `
-	DROP TABLE orders CASCADE;
+const getMigrationVersionsQuery = `
+	SELECT version, applied_at
+	FROM schema_migrations
+	ORDER BY version;
 `
 
-const dropOperationsTableQuery = `
-	DROP TABLE operations CASCADE;
+const insertMigrationVersionQuery = `
+	INSERT INTO schema_migrations (version, name)
+	VALUES ($1, $2);
 `
 
-const createOrdersTableQuery = `
-	CREATE TABLE orders (
-		number TEXT UNIQUE NOT NULL PRIMARY KEY,
-		user_id integer NOT NULL,
-		status text NOT NULL,
-		uploaded_at TIMESTAMP WITH TIME ZONE,
-		CONSTRAINT fk_ousers
-			FOREIGN KEY (user_id)
-				REFERENCES users(id)
-				ON DELETE CASCADE
-	);
+const deleteMigrationVersionQuery = `
+	DELETE FROM schema_migrations
+	WHERE version = $1;
 `
 
-const createOperationsTableQuery = `
-	CREATE TABLE operations (
-		id SERIAL,
-		user_id integer NOT NULL,
-		number TEXT NOT NULL,
-		accrual double precision,
-		processed_at TIMESTAMP WITH TIME ZONE,
-		PRIMARY KEY (id),
-		CONSTRAINT fk_oorders
-			FOREIGN KEY (number)
-				REFERENCES orders(number)
-				ON DELETE CASCADE
-	);
+const lockMigrationsQuery = `
+	SELECT pg_advisory_lock($1);
+`
+
+const unlockMigrationsQuery = `
+	SELECT pg_advisory_unlock($1);
 `
 
 // orders queries
@@ -58,18 +46,32 @@ const getOrdersQuery = `
 	JOIN users ON orders.user_id = users.id;
 `
 
+// getOrdersByUserQuery pages through the orders of user $1, oldest first,
+// filtered by statuses $2 and upload time range [$3, $4). A page starts after
+// the order ($5, $6), LIMIT $7 may be NULL for all of them. Processed orders
+// come with their accrual, if any. Operations left by a deleted user who had
+// the same order number are skipped
 const getOrdersByUserQuery = `
-	SELECT orders.number, orders.status, orders.uploaded_at
+	SELECT orders.number, orders.status, accruals.accrual, orders.uploaded_at
 	FROM orders
 	JOIN users ON orders.user_id = users.id
-	WHERE users.username = $1;
+	LEFT JOIN LATERAL (
+		SELECT operations.accrual
+		FROM operations
+		WHERE operations.number = orders.number
+		AND operations.user_id = orders.user_id
+		AND operations.type = 'accrual'
+		LIMIT 1
+		) accruals ON orders.status = 'PROCESSED'
+	WHERE users.username = $1
+	AND (cardinality($2::text[]) = 0 OR orders.status = ANY($2::text[]))
+	AND ($3::timestamptz IS NULL OR orders.uploaded_at >= $3)
+	AND ($4::timestamptz IS NULL OR orders.uploaded_at < $4)
+	AND ($5::timestamptz IS NULL OR (orders.uploaded_at, orders.number) > ($5, $6::text))
+	ORDER BY orders.uploaded_at, orders.number
+	LIMIT $7;
 `
 
-const getOrderAccrualQuery = `
-	SELECT accrual 
-	FROM operations
-	WHERE number = $1`
-
 const getUsernameByNumberQuery = `
 	SELECT users.username
 	FROM orders
@@ -85,69 +87,168 @@ const CheckIDbyUsernameQuery = `
 
 // accrual worker queries
 
+// AccrualAddQuery sets the order status, records the accrual and credits the
+// user's balance in one statement, ending the lease on the order. Nothing is
+// recorded for an unknown order. The accrual of an order is credited once:
+// a processed order is left as it is, and an accrual recorded meanwhile by
+// another agent makes this one a no-op
 const AccrualAddQuery = `
 	WITH new_order AS (
 		UPDATE orders
-		SET status = $1
+		SET status = $1,
+			leased_until = NULL
 		WHERE number = $2
+		AND status <> 'PROCESSED'
 		RETURNING user_id
+	), new_operation AS (
+		INSERT INTO operations (user_id, number, accrual, processed_at, type)
+		SELECT user_id,
+			$2,
+			$3,
+			TO_TIMESTAMP($4,'YYYY-MM-DD"T"HH24:MI:SS"Z"TZH:TZM'),
+			'accrual'
+		FROM new_order
+		ON CONFLICT (number) WHERE type = 'accrual' AND user_id IS NOT NULL AND NOT duplicate DO NOTHING
+		RETURNING user_id, accrual
 	)
-	INSERT INTO operations (user_id, number, accrual, processed_at)
-	VALUES ((SELECT user_id FROM new_order),
-		$2, 
-		$3, 
-		TO_TIMESTAMP($4,'YYYY-MM-DD"T"HH24:MI:SS"Z"TZH:TZM') 
-	);
+	INSERT INTO balances (user_id, current, version)
+	SELECT user_id, accrual, 1
+	FROM new_operation
+	ON CONFLICT (user_id) DO UPDATE
+	SET current = balances.current + EXCLUDED.current,
+		version = balances.version + 1;
 `
+
+// UpdateStatusQuery doesn't take a processed order back, a late or repeated
+// result can't change it any more
 const UpdateStatusQuery = `
 	UPDATE orders
-	SET status = $1
-	WHERE number = $2;
+	SET status = $1,
+		leased_until = NULL
+	WHERE number = $2
+	AND status <> 'PROCESSED';
 `
 
-// SQL queries
+// balance queries
 const GetBalanceQuery = `
-	SELECT COALESCE(SUM(accrual),0)
-	FROM operations
-	WHERE user_id = (
-		SELECT id 
-		FROM users 
-		WHERE username = $1
-		); 
+	SELECT balances.current, balances.withdrawn
+	FROM balances
+	JOIN users ON users.id = balances.user_id
+	WHERE users.username = $1;
+`
+
+// debitBalanceQuery withdraws $2 from the balance of user $1 if there is
+// enough on it. The row lock it takes is held until the transaction ends, so
+// concurrent withdrawals of the user re-check the condition one by one
+const debitBalanceQuery = `
+	UPDATE balances
+	SET current = current - $2,
+		withdrawn = withdrawn + $2,
+		version = version + 1
+	WHERE user_id = $1
+	AND current >= $2;
+`
+
+// reconcileBalancesQuery compares stored balances with the ones computed from operations
+const reconcileBalancesQuery = `
+	SELECT users.id, users.username,
+		COALESCE(balances.current, 0), COALESCE(balances.withdrawn, 0),
+		COALESCE(ops.current, 0), COALESCE(ops.withdrawn, 0)
+	FROM users
+	LEFT JOIN balances ON balances.user_id = users.id
+	LEFT JOIN (
+		SELECT user_id,
+			SUM(accrual) AS current,
+			COALESCE(-SUM(accrual) FILTER (WHERE type IN ('withdrawal', 'refund')), 0) AS withdrawn
+		FROM operations
+		GROUP BY user_id
+	) ops ON ops.user_id = users.id
+	WHERE COALESCE(balances.current, 0) <> COALESCE(ops.current, 0)
+	OR COALESCE(balances.withdrawn, 0) <> COALESCE(ops.withdrawn, 0)
+	ORDER BY users.id;
+`
+
+// ensureBalanceQuery creates an empty balance row so that it can be locked
+const ensureBalanceQuery = `
+	INSERT INTO balances (user_id)
+	VALUES ($1)
+	ON CONFLICT (user_id) DO NOTHING;
 `
 
-const GetWithdrawnQuery = `
-	SELECT COALESCE(SUM(accrual),0)
+const lockBalanceQuery = `
+	SELECT user_id
+	FROM balances
+	WHERE user_id = $1
+	FOR UPDATE;
+`
+
+const computeBalanceQuery = `
+	SELECT COALESCE(SUM(accrual), 0),
+		COALESCE(-SUM(accrual) FILTER (WHERE type IN ('withdrawal', 'refund')), 0)
 	FROM operations
-	WHERE user_id = (
-		SELECT id 
-		FROM users 
-		WHERE username = $1
-		)
-	AND	accrual < 0; 
+	WHERE user_id = $1;
 `
 
+const setBalanceQuery = `
+	UPDATE balances
+	SET current = $2,
+		withdrawn = $3,
+		version = version + 1
+	WHERE user_id = $1;
+`
+
+// GetWithdrawalsQuery pages through the withdrawals of user $1 made in
+// [$2, $3), oldest first, starting after the operation ($4, $5). It leaves
+// out refunded withdrawals, they don't count as withdrawn
 const GetWithdrawalsQuery = `
-	SELECT number, accrual, processed_at
+	SELECT id, number, accrual, processed_at
 	FROM operations
 	WHERE user_id = (
 		SELECT id
 		FROM users
 		WHERE username = $1
 		) 
-	AND	accrual < 0;
+	AND	type = 'withdrawal'
+	AND NOT EXISTS (
+		SELECT 1
+		FROM operations refunds
+		WHERE refunds.ref_id = operations.id
+		)
+	AND ($2::timestamptz IS NULL OR processed_at >= $2)
+	AND ($3::timestamptz IS NULL OR processed_at < $3)
+	AND ($4::timestamptz IS NULL OR (processed_at, id) > ($4, $5::integer))
+	ORDER BY processed_at, id
+	LIMIT $6;
 `
 
+// InsertOperationQuery records an accrual for order $1 and credits its owner,
+// unless the order has been credited already. It returns the number of
+// orders found, 0 if the order is unknown
 const InsertOperationQuery = `
-	INSERT INTO operations (user_id, number, accrual, processed_at)
-	VALUES (
-		(SELECT user_id 
-		FROM orders 
-		WHERE number = $1),
-		$1,
-		$2, 
-		TO_TIMESTAMP($3,'YYYY-MM-DD"T"HH24:MI:SS"Z"TZH:TZM')
-	);
+	WITH target AS (
+		SELECT user_id
+		FROM orders
+		WHERE number = $1
+	), new_operation AS (
+		INSERT INTO operations (user_id, number, accrual, processed_at, type)
+		SELECT user_id,
+			$1,
+			$2,
+			TO_TIMESTAMP($3,'YYYY-MM-DD"T"HH24:MI:SS"Z"TZH:TZM'),
+			'accrual'
+		FROM target
+		ON CONFLICT (number) WHERE type = 'accrual' AND user_id IS NOT NULL AND NOT duplicate DO NOTHING
+		RETURNING user_id, accrual
+	), credit AS (
+		INSERT INTO balances (user_id, current, version)
+		SELECT user_id, accrual, 1
+		FROM new_operation
+		ON CONFLICT (user_id) DO UPDATE
+		SET current = balances.current + EXCLUDED.current,
+			version = balances.version + 1
+	)
+	SELECT COUNT(*)
+	FROM target;
 `
 
 const InsertWithdrawOperation = `
@@ -160,26 +261,195 @@ const InsertWithdrawOperation = `
 			'NEW',
 			TO_TIMESTAMP($4,'YYYY-MM-DD"T"HH24:MI:SS"Z"TZH:TZM'))
 		RETURNING user_id)
-	INSERT INTO operations (user_id, number, accrual, processed_at)
+	INSERT INTO operations (user_id, number, accrual, processed_at, type)
 	VALUES (
 		(SELECT user_id 
 		FROM new_order),
 		$2,
 		$3, 
-		TO_TIMESTAMP($4,'YYYY-MM-DD"T"HH24:MI:SS"Z"TZH:TZM')
+		TO_TIMESTAMP($4,'YYYY-MM-DD"T"HH24:MI:SS"Z"TZH:TZM'),
+		'withdrawal'
 	);
 `
 
-const getPassQuery = `
-		SELECT password
-		FROM passwords
-		JOIN users ON users.id = passwords.user_id
-		WHERE users.username = $1
-	`
+// staleOrdersQuery gives up on the orders pending since before $1
+const staleOrdersQuery = `
+	UPDATE orders
+	SET status = 'STALE',
+		next_check_at = NULL
+	WHERE status IN ('NEW', 'PROCESSING')
+	AND pending_since < $1;
+`
 
-const getOrdersAccrualStatusUpdQuery = `
-	SELECT number
-	FROM orders
-	WHERE status='NEW' 
-		OR status='PROCESSING';
+// claimOrdersQuery takes up to $2 orders due for a check at $1, LIMIT may be
+// NULL for all of them. Orders being claimed or leased by another agent are
+// skipped. The orders are leased for $5 seconds, saving a result ends the
+// lease. The next check is scheduled right away, $3 seconds after this
+// one, doubled with every check up to $4 seconds, so an order whose result
+// never comes is polled again
+const claimOrdersQuery = `
+	WITH due AS (
+		SELECT number
+		FROM orders
+		WHERE status IN ('NEW', 'PROCESSING')
+		AND (next_check_at IS NULL OR next_check_at <= $1)
+		AND (leased_until IS NULL OR leased_until <= $1)
+		ORDER BY next_check_at NULLS FIRST, number
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+		)
+	UPDATE orders
+	SET last_checked_at = $1,
+		attempts = orders.attempts + 1,
+		next_check_at = $1::timestamptz + make_interval(secs =>
+			LEAST($3::float8 * power(2, LEAST(orders.attempts, 30)), $4::float8)),
+		leased_until = $1::timestamptz + make_interval(secs => $5::float8)
+	FROM due
+	WHERE orders.number = due.number
+	RETURNING orders.number;
+`
+
+// getLedgerQuery pages through the operations of user $1, newest first. The
+// balance after each operation is summed up over all of them before the
+// filters by types $2 and time range [$3, $4) are applied. A page starts
+// after the operation ($5, $6), LIMIT $7 may be NULL for all of them
+const getLedgerQuery = `
+	WITH ledger AS (
+		SELECT id, type, number, accrual, processed_at,
+			SUM(accrual) OVER (ORDER BY processed_at, id) AS balance
+		FROM operations
+		WHERE user_id = (
+			SELECT id
+			FROM users
+			WHERE username = $1
+			)
+	)
+	SELECT id, type, COALESCE(number, ''), accrual, balance, processed_at
+	FROM ledger
+	WHERE (cardinality($2::text[]) = 0 OR type = ANY($2::text[]))
+	AND ($3::timestamptz IS NULL OR processed_at >= $3)
+	AND ($4::timestamptz IS NULL OR processed_at < $4)
+	AND ($5::timestamptz IS NULL OR (processed_at, id) < ($5, $6::integer))
+	ORDER BY processed_at DESC, id DESC
+	LIMIT $7;
+`
+
+// admin queries
+const getOperationsQuery = `
+	SELECT id, type, COALESCE(kind, ''), COALESCE(ref_id, 0), COALESCE(number, ''), accrual,
+		COALESCE(reason, ''), COALESCE(actor, ''), processed_at
+	FROM operations
+	WHERE user_id = (
+		SELECT id
+		FROM users
+		WHERE username = $1
+		)
+	ORDER BY processed_at, id;
+`
+
+// adjustBalanceQuery changes the balance of user $1 by $2 unless it would
+// go below zero. Withdrawn points stay as they are
+const adjustBalanceQuery = `
+	UPDATE balances
+	SET current = current + $2,
+		version = version + 1
+	WHERE user_id = $1
+	AND current + $2 >= 0;
+`
+
+// insertAdjustmentQuery records a correction, it has no order. Operations
+// are stored to the second, like the ones made from the Go side, so that
+// operations of the same second are ordered by id
+const insertAdjustmentQuery = `
+	INSERT INTO operations (user_id, accrual, processed_at, type, kind, reason, actor)
+	VALUES ($1, $2, date_trunc('second', now()), 'adjustment', 'correction', $3, $4);
+`
+
+// getWithdrawalQuery finds the withdrawal of user $1 for order $2 and locks
+// it, so that concurrent refunds of it go one by one
+const getWithdrawalQuery = `
+	SELECT id, accrual
+	FROM operations
+	WHERE user_id = $1
+	AND number = $2
+	AND type = 'withdrawal'
+	FOR UPDATE;
+`
+
+// insertRefundQuery records the refund of withdrawal $6. The unique index on
+// ref_id keeps a withdrawal from being refunded twice
+const insertRefundQuery = `
+	INSERT INTO operations (user_id, number, accrual, processed_at, type, kind, reason, actor, ref_id)
+	VALUES ($1, $2, $3, date_trunc('second', now()), 'refund', 'refund', $4, $5, $6);
+`
+
+// refundBalanceQuery gives back $2 withdrawn from the balance of user $1
+const refundBalanceQuery = `
+	UPDATE balances
+	SET current = current + $2,
+		withdrawn = withdrawn - $2,
+		version = version + 1
+	WHERE user_id = $1;
+`
+
+// recheckOrderQuery sends an order rejected by the accrual system or given up
+// on back to polling, on a fresh schedule. A pending order which has backed
+// off is checked at once. Processed orders are left alone, their accrual is
+// credited already
+const recheckOrderQuery = `
+	UPDATE orders
+	SET status = CASE WHEN status IN ('INVALID', 'STALE') THEN 'PROCESSING' ELSE status END,
+		attempts = CASE WHEN status = 'PROCESSED' THEN attempts ELSE 0 END,
+		next_check_at = CASE WHEN status = 'PROCESSED' THEN next_check_at ELSE NULL END,
+		pending_since = CASE WHEN status IN ('INVALID', 'STALE') THEN now() ELSE pending_since END
+	WHERE number = $1
+	RETURNING status;
+`
+
+// idempotency keys queries
+const purgeRequestsQuery = `
+	DELETE FROM idempotency_keys
+	WHERE user_id = $1
+	AND created_at < $2;
+`
+
+const reserveRequestQuery = `
+	INSERT INTO idempotency_keys (user_id, key, fingerprint)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (user_id, key) DO UPDATE
+	SET created_at = now()
+	WHERE idempotency_keys.status IS NULL
+	AND idempotency_keys.fingerprint = EXCLUDED.fingerprint
+	AND idempotency_keys.created_at < $4;
+`
+
+const getRequestQuery = `
+	SELECT fingerprint, status, body
+	FROM idempotency_keys
+	WHERE user_id = $1
+	AND key = $2;
+`
+
+const finishRequestQuery = `
+	UPDATE idempotency_keys
+	SET status = $3,
+		body = $4
+	WHERE user_id = (
+		SELECT id
+		FROM users
+		WHERE username = $1
+		)
+	AND key = $2;
+`
+
+// releaseRequestQuery forgets a request still being served, so that it can be retried
+const releaseRequestQuery = `
+	DELETE FROM idempotency_keys
+	WHERE user_id = (
+		SELECT id
+		FROM users
+		WHERE username = $1
+		)
+	AND key = $2
+	AND status IS NULL;
 `
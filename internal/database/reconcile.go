@@ -0,0 +1,83 @@
+package database
+
+import (
+	"context"
+	"log"
+)
+
+// BalanceDrift is a user whose stored balance differs from the sum of their operations
+type BalanceDrift struct {
+	UserID   int
+	Login    string
+	Recorded Balance
+	Actual   Balance
+}
+
+// ReconcileBalances recomputes balances from the operations table and reports
+// the ones that have drifted. With fix set, the drifted balances are rewritten
+func (s *SQLdb) ReconcileBalances(ctx context.Context, fix bool) ([]BalanceDrift, error) {
+	rows, err := s.DB.QueryContext(ctx, reconcileBalancesQuery)
+	if err != nil {
+		log.Println("error when reconciling balances:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var drifts []BalanceDrift
+	for rows.Next() {
+		var d BalanceDrift
+		err = rows.Scan(&d.UserID, &d.Login,
+			&d.Recorded.Current, &d.Recorded.Withdrawn,
+			&d.Actual.Current, &d.Actual.Withdrawn)
+		if err != nil {
+			log.Println("error when scanning rows in ReconcileBalances:", err)
+			return nil, err
+		}
+		drifts = append(drifts, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if !fix {
+		return drifts, nil
+	}
+
+	for i := range drifts {
+		actual, err := s.fixBalance(ctx, drifts[i].UserID)
+		if err != nil {
+			return drifts, err
+		}
+		drifts[i].Actual = actual
+	}
+	return drifts, nil
+}
+
+// fixBalance rewrites the balance of a user from their operations. The balance
+// row is locked first: operations committed before that are summed up, the
+// ones still in flight add to the rewritten row once the lock is released
+func (s *SQLdb) fixBalance(ctx context.Context, userID int) (Balance, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Balance{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, ensureBalanceQuery, userID); err != nil {
+		return Balance{}, err
+	}
+	var locked int
+	err = tx.QueryRowContext(ctx, lockBalanceQuery, userID).Scan(&locked)
+	if err != nil {
+		return Balance{}, err
+	}
+
+	var b Balance
+	err = tx.QueryRowContext(ctx, computeBalanceQuery, userID).Scan(&b.Current, &b.Withdrawn)
+	if err != nil {
+		return Balance{}, err
+	}
+	if _, err = tx.ExecContext(ctx, setBalanceQuery, userID, b.Current, b.Withdrawn); err != nil {
+		return Balance{}, err
+	}
+	return b, tx.Commit()
+}
@@ -0,0 +1,73 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gambruh/gophermart/internal/config"
+	"github.com/gambruh/gophermart/internal/database"
+	"github.com/gambruh/gophermart/internal/storagetest"
+)
+
+func TestSQLdb_ReconcileBalances(t *testing.T) {
+	st := storagetest.NewPostgres(t)
+	for _, login := range []string{"alice", "bob"} {
+		if err := st.Register(login, "secretpass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	order := storagetest.LuhnNumber(100)
+	if err := st.SetOrder(order, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var accrual database.Money = 50_00
+	if err := st.UpdateAccrual([]database.ProcessedOrder{{Number: order, Status: "PROCESSED", Accrual: &accrual}}); err != nil {
+		t.Fatal(err)
+	}
+	alice := context.WithValue(context.Background(), config.UserID("userID"), "alice")
+	withdrawal := storagetest.LuhnNumber(200)
+	if err := st.Withdraw(alice, database.WithdrawQ{Order: withdrawal, Sum: 20_00}); err != nil {
+		t.Fatal(err)
+	}
+	err := st.RefundWithdrawal(context.Background(), database.Refund{Login: "alice", Order: withdrawal, Reason: "cancelled", Actor: "operator"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drifts, err := st.ReconcileBalances(context.Background(), false)
+	if err != nil || len(drifts) != 0 {
+		t.Fatalf("ReconcileBalances() of consistent balances = %+v, %v, want none", drifts, err)
+	}
+
+	// the refund is lost from the stored balance
+	if _, err = st.DB.Exec(`
+		UPDATE balances
+		SET current = 30, withdrawn = 20
+		WHERE user_id = (SELECT id FROM users WHERE username = 'alice')`); err != nil {
+		t.Fatal(err)
+	}
+	want := database.Balance{Current: 50_00, Withdrawn: 0}
+	corrupted := database.Balance{Current: 30_00, Withdrawn: 20_00}
+
+	drifts, err = st.ReconcileBalances(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 1 || drifts[0].Login != "alice" || drifts[0].Recorded != corrupted || drifts[0].Actual != want {
+		t.Fatalf("ReconcileBalances() = %+v, want alice recorded %+v, actual %+v", drifts, corrupted, want)
+	}
+	if balance, _ := st.GetBalance(alice); balance != corrupted {
+		t.Errorf("balance after a report = %+v, want it left %+v", balance, corrupted)
+	}
+
+	drifts, err = st.ReconcileBalances(context.Background(), true)
+	if err != nil || len(drifts) != 1 || drifts[0].Actual != want {
+		t.Fatalf("ReconcileBalances(fix) = %+v, %v, want alice fixed to %+v", drifts, err, want)
+	}
+	if balance, _ := st.GetBalance(alice); balance != want {
+		t.Errorf("fixed balance = %+v, want %+v", balance, want)
+	}
+	if drifts, err = st.ReconcileBalances(context.Background(), false); err != nil || len(drifts) != 0 {
+		t.Errorf("ReconcileBalances() after the fix = %+v, %v, want none", drifts, err)
+	}
+}
@@ -2,20 +2,21 @@ package database
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/gambruh/gophermart/internal/auth"
 	"github.com/gambruh/gophermart/internal/config"
+	"github.com/gambruh/gophermart/internal/helpers"
 )
 
-var ()
-
+// MemStorage is the in-memory counterpart of SQLdb. Users are kept by the
+// embedded AuthMemStorage, so a MemStorage can serve as auth storage too
 type MemStorage struct {
-	// loginpass pairs
-	Data map[string]string
+	*auth.AuthMemStorage
 
 	// ordernumber - username key-value pair
 	Umap map[string]string
@@ -26,155 +27,604 @@ type MemStorage struct {
 	// map with username - slice of operations pairs
 	Operations map[string][]Operation
 
+	// operations of deleted users, kept without the username
+	Archive []Operation
+
+	// id of the last recorded operation
+	lastOperationID int64
+
+	// requests made with idempotency keys by username and key
+	requests map[string]map[string]*storedRequest
+
 	// to ensure possible concurrent usage
 	Mu *sync.Mutex
 }
 
 func NewStorage() *MemStorage {
 	return &MemStorage{
-		Data:       make(map[string]string),
-		Umap:       make(map[string]string),
-		Orders:     make(map[string][]Order),
-		Operations: make(map[string][]Operation),
-		Mu:         &sync.Mutex{},
+		AuthMemStorage: auth.NewMemStorage(),
+		Umap:           make(map[string]string),
+		Orders:         make(map[string][]Order),
+		Operations:     make(map[string][]Operation),
+		requests:       make(map[string]map[string]*storedRequest),
+		Mu:             &sync.Mutex{},
 	}
 }
 
-func (s *MemStorage) GetStorage() map[string]string {
-	return s.Data
+func (s *MemStorage) Close() error {
+	return nil
 }
 
-func (s *MemStorage) GetPass(username string) (string, error) {
-	password, contains := s.Data[username]
-	if !contains {
-		return "", ErrUserNotFound
+// GetStorage returns a copy of the login - password hash pairs
+func (s *MemStorage) GetStorage() map[string]string {
+	s.AuthMemStorage.Mu.RLock()
+	defer s.AuthMemStorage.Mu.RUnlock()
+	data := make(map[string]string, len(s.Data))
+	for login, hash := range s.Data {
+		data[login] = hash
 	}
+	return data
+}
 
-	return password, nil
+// userExists checks the user is registered, like the users table lookups of SQLdb do.
+// s.Mu must be held, so that the user isn't deleted meanwhile
+func (s *MemStorage) userExists(username string) error {
+	_, err := s.GetPass(username)
+	return err
 }
 
-func (s *MemStorage) Register(login string, password string) error {
-	_, contains := s.Data[login]
-	if contains {
-		return ErrUsernameIsTaken
-	} else {
-		s.Data[login] = password
+// DeleteUser removes the user with their orders. The operations are moved to
+// the archive, as SQLdb keeps them without the user
+func (s *MemStorage) DeleteUser(login string) error {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if err := s.AuthMemStorage.DeleteUser(login); err != nil {
+		return err
 	}
+
+	for _, o := range s.Orders[login] {
+		delete(s.Umap, o.Number)
+	}
+	delete(s.Orders, login)
+	s.Archive = append(s.Archive, s.Operations[login]...)
+	delete(s.Operations, login)
+	delete(s.requests, login)
 	return nil
 }
 
-func (s MemStorage) VerifyCredentials(login string, password string) error {
-	check, contains := s.Data[login]
-	if contains && check == password {
-		return nil
-	} else {
-		return ErrWrongPassword
-	}
+// now returns the current time truncated to seconds, as it is stored in the database
+func now() time.Time {
+	return time.Now().Truncate(time.Second)
 }
 
 func (s *MemStorage) SetOrder(ordernumber string, username string) error {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if err := s.userExists(username); err != nil {
+		return err
+	}
 	uname, contains := s.Umap[ordernumber]
 
 	switch {
 	case !contains:
-		t := time.Now()
-		formattedTime := t.Format(time.RFC3339)
-		t, err := time.Parse(time.RFC3339, formattedTime)
-		if err != nil {
-			fmt.Println("return when parsing time in SetOrder handler")
-			return err
-		}
-		s.Orders[username] = append(s.Orders[username],
-			Order{
-				Number:     ordernumber,
-				Status:     "NEW",
-				UploadedAt: t,
-			})
-		s.Umap[ordernumber] = username
+		s.addOrder(ordernumber, username)
 		return nil
-	case contains && uname == username:
-		fmt.Println("Order has been loaded by the user already:", username)
+	case uname == username:
 		return ErrOrderLoadedThisUser
-	case contains && uname != username:
-		fmt.Println("order has been loaded by another user")
-		return ErrOrderLoadedAnotherUser
 	default:
-		return errors.New("unexpected case when trying to load order into storage")
+		return ErrOrderLoadedAnotherUser
+	}
+}
+
+// addOrder registers a new order, s.Mu must be held
+func (s *MemStorage) addOrder(ordernumber string, username string) {
+	s.Orders[username] = append(s.Orders[username],
+		Order{
+			Number:       ordernumber,
+			Status:       "NEW",
+			UploadedAt:   now(),
+			PendingSince: now(),
+		})
+	s.Umap[ordernumber] = username
+}
+
+// findOrder returns the stored order by its number, s.Mu must be held
+func (s *MemStorage) findOrder(ordernumber string) *Order {
+	username, contains := s.Umap[ordernumber]
+	if !contains {
+		return nil
 	}
+	for i := range s.Orders[username] {
+		if s.Orders[username][i].Number == ordernumber {
+			return &s.Orders[username][i]
+		}
+	}
+	return nil
 }
 
-func (s *MemStorage) GetOrders(ctx context.Context) ([]Order, error) {
+func (s *MemStorage) GetOrders(ctx context.Context, filter OrderFilter, page Page) ([]Order, *Cursor, error) {
+	if err := filter.Check(); err != nil {
+		return nil, nil, err
+	}
+	limit := page.limit()
+
 	username := ctx.Value(config.UserID("userID"))
-	return s.Orders[username.(string)], nil
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	stored := s.Orders[username.(string)]
+	if len(stored) == 0 {
+		return nil, nil, ErrNoOrders
+	}
+	sorted := make([]Order, len(stored))
+	copy(sorted, stored)
+	// orders uploaded within a second are ordered by number, as SQLdb does
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].UploadedAt.Equal(sorted[j].UploadedAt) {
+			return sorted[i].UploadedAt.Before(sorted[j].UploadedAt)
+		}
+		return sorted[i].Number < sorted[j].Number
+	})
+
+	var ords []Order
+	for _, ord := range sorted {
+		if limit > 0 && len(ords) > limit {
+			break
+		}
+		if page.After != nil && !orderAfter(ord, *page.After) {
+			continue
+		}
+		if !filter.matches(ord) {
+			continue
+		}
+		if ord.Accrual != nil {
+			accrual := *ord.Accrual
+			ord.Accrual = &accrual
+		}
+		ords = append(ords, ord)
+	}
+	if len(ords) == 0 {
+		return nil, nil, ErrNoOrders
+	}
+	ords, next := cutPage(ords, limit, orderCursor)
+	return ords, next, nil
 }
 
-func (s *MemStorage) GetOrdersForAccrual() ([]string, error) {
-	var preparr []string
+// orderAfter tells whether the order comes after the cursor
+func orderAfter(ord Order, c Cursor) bool {
+	if !ord.UploadedAt.Equal(c.Time) {
+		return ord.UploadedAt.After(c.Time)
+	}
+	return ord.Number > c.Key
+}
+
+// ClaimOrdersForAccrual claims the due orders in the order SQLdb does
+func (s *MemStorage) ClaimOrdersForAccrual(ctx context.Context, claim Claim) ([]string, error) {
+	var due []*Order
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
 
+	staleBefore := claim.At.Add(-claim.Schedule.StaleAfter)
 	for _, v := range s.Orders {
-		for _, o := range v {
-			if o.Status == "PROCESSING" || o.Status == "NEW" {
-				preparr = append(preparr, o.Number)
+		for i := range v {
+			o := &v[i]
+			if o.Status != "PROCESSING" && o.Status != "NEW" {
+				continue
 			}
+			if claim.Schedule.StaleAfter > 0 && o.PendingSince.Before(staleBefore) {
+				o.Status = "STALE"
+				o.NextCheckAt = time.Time{}
+				continue
+			}
+			if o.NextCheckAt.After(claim.At) || o.LeasedUntil.After(claim.At) {
+				continue
+			}
+			due = append(due, o)
 		}
 	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextCheckAt.Equal(due[j].NextCheckAt) {
+			return due[i].NextCheckAt.Before(due[j].NextCheckAt)
+		}
+		return due[i].Number < due[j].Number
+	})
+	if claim.Limit > 0 && len(due) > claim.Limit {
+		due = due[:claim.Limit]
+	}
+
+	var preparr []string
+	for _, o := range due {
+		o.LastCheckedAt = claim.At
+		o.NextCheckAt = claim.Schedule.next(claim.At, o.Attempts)
+		o.Attempts++
+		o.LeasedUntil = claim.At.Add(claim.Lease)
+		preparr = append(preparr, o.Number)
+	}
 	return preparr, nil
 }
 
-func (s *MemStorage) UpdateAccrual([]ProcessedOrder) error {
-	return nil
+// UpdateAccrual applies accrual results like SQLdb does. Results with an
+// unexpected status, unknown and processed orders are skipped
+func (s *MemStorage) UpdateAccrual(ords []ProcessedOrder) error {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	var skipped []string
+	for _, o := range ords {
+		status, err := accrualStatus(o.Status)
+		if err != nil {
+			skipped = append(skipped, o.Number)
+			continue
+		}
+		order := s.findOrder(o.Number)
+		if order == nil {
+			log.Println("accrual result for unknown order:", o.Number)
+			continue
+		}
+		if order.Status == "PROCESSED" {
+			continue
+		}
+		order.Status = status
+		order.LeasedUntil = time.Time{}
+		if o.Accrual != nil && s.credit(o.Number, *o.Accrual) {
+			accrual := *o.Accrual
+			order.Accrual = &accrual
+		}
+	}
+	return unexpectedStatuses(skipped)
 }
-func (s *MemStorage) AddAccrualOperation([]ProcessedOrder) error {
+
+func (s *MemStorage) AddAccrualOperation(ords []ProcessedOrder) error {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	for _, o := range ords {
+		if o.Accrual == nil || *o.Accrual == 0 {
+			continue
+		}
+		if s.findOrder(o.Number) == nil {
+			return fmt.Errorf("%w: %s", ErrWrongOrder, o.Number)
+		}
+	}
+	for _, o := range ords {
+		if o.Accrual == nil || *o.Accrual == 0 {
+			continue
+		}
+		s.credit(o.Number, *o.Accrual)
+	}
 	return nil
 }
 
+// credit records the accrual of the order unless it has been credited
+// already and tells whether it has been recorded, s.Mu must be held
+func (s *MemStorage) credit(number string, accrual Money) bool {
+	username := s.Umap[number]
+	for _, op := range s.Operations[username] {
+		if op.Type == OperationAccrual && op.Order == number {
+			return false
+		}
+	}
+	s.addOperation(username, Operation{Order: number, Accrual: accrual, Type: OperationAccrual})
+	return true
+}
+
+// addOperation records an operation of the user, s.Mu must be held
+func (s *MemStorage) addOperation(username string, op Operation) {
+	s.lastOperationID++
+	op.ID = s.lastOperationID
+	op.ProcessedAt = now()
+	s.Operations[username] = append(s.Operations[username], op)
+}
+
 func (s *MemStorage) GetBalance(ctx context.Context) (Balance, error) {
-	var b Balance
 	username := ctx.Value(config.UserID("userID"))
-	if len(s.Operations[username.(string)]) == 0 {
-		return Balance{Current: 0, Withdrawn: 0}, nil
-	}
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	return s.balance(username.(string)), nil
+}
 
-	for _, op := range s.Operations[username.(string)] {
+// balance sums up the user's operations, s.Mu must be held
+func (s *MemStorage) balance(username string) Balance {
+	var b Balance
+	for _, op := range s.Operations[username] {
 		b.Current += op.Accrual
-		if op.Accrual < 0 {
+		// a refund gives back what was withdrawn
+		if op.Type == OperationWithdrawal || op.Type == OperationRefund {
 			value := op.Accrual * (-1)
 			b.Withdrawn += value
 		}
 	}
 
-	return b, nil
+	return b
 }
 
-func (s *MemStorage) GetWithdrawals(ctx context.Context) ([]Operation, error) {
+func (s *MemStorage) GetWithdrawals(ctx context.Context, filter WithdrawalFilter, page Page) ([]Operation, *Cursor, error) {
+	if err := filter.Check(); err != nil {
+		return nil, nil, err
+	}
+	afterID, err := idKey(page.After)
+	if err != nil {
+		return nil, nil, err
+	}
+	limit := page.limit()
+
+	var ops []Operation
 	username := ctx.Value(config.UserID("userID"))
-	return s.Operations[username.(string)], nil
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	refunded := s.refunded(username.(string))
+	// operations are recorded in order, so their ids order them as SQLdb does
+	for _, op := range s.Operations[username.(string)] {
+		if limit > 0 && len(ops) > limit {
+			break
+		}
+		if op.Type != OperationWithdrawal || refunded[op.ID] {
+			continue
+		}
+		if page.After != nil && op.ID <= afterID {
+			continue
+		}
+		if !inRange(op.ProcessedAt, filter.From, filter.To) {
+			continue
+		}
+		op.Accrual *= -1
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, nil, ErrNoOperations
+	}
+	ops, next := cutPage(ops, limit, operationCursor)
+	return ops, next, nil
 }
 
+// Withdraw registers the withdrawal order and debits the balance, the same way SQLdb does
 func (s *MemStorage) Withdraw(ctx context.Context, withdrawq WithdrawQ) error {
-	username := ctx.Value(config.UserID("userID"))
-	currentbalance, err := s.GetBalance(ctx)
-	if err != nil {
-		log.Println("error in Withdraw:", err)
+	username := ctx.Value(config.UserID("userID")).(string)
+	if !helpers.LuhnCheck(withdrawq.Order) {
+		return ErrWrongOrder
+	}
+	if withdrawq.Sum <= 0 {
+		return ErrWrongSum
+	}
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if err := s.userExists(username); err != nil {
 		return err
 	}
 
-	if currentbalance.Current >= withdrawq.Sum {
-		var withdrawal Operation
+	currentbalance := s.balance(username)
+	if currentbalance.Current < withdrawq.Sum {
+		return ErrInsufficientFunds
+	}
+	if _, taken := s.Umap[withdrawq.Order]; taken {
+		return ErrWrongOrder
+	}
 
-		t := time.Now()
-		formattedTime := t.Format(time.RFC3339)
-		t, err := time.Parse(time.RFC3339, formattedTime)
-		if err != nil {
-			log.Println("error when parsing time in Withdraw op:", err)
-			return err
-		}
-		withdrawal.Accrual = withdrawq.Sum
-		withdrawal.Order = withdrawq.Order
-		withdrawal.ProcessedAt = t
-		s.Operations[username.(string)] = append(s.Operations[username.(string)], withdrawal)
-	} else {
+	s.addOrder(withdrawq.Order, username)
+	s.addOperation(username, Operation{Order: withdrawq.Order, Accrual: withdrawq.Sum * (-1), Type: OperationWithdrawal})
+	return nil
+}
+
+func (s *MemStorage) GetLedger(ctx context.Context, filter LedgerFilter, page Page) ([]LedgerEntry, *Cursor, error) {
+	if err := filter.Check(); err != nil {
+		return nil, nil, err
+	}
+	afterID, err := idKey(page.After)
+	if err != nil {
+		return nil, nil, err
+	}
+	limit := page.limit()
+
+	username := ctx.Value(config.UserID("userID"))
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	// operations are recorded in order, so their ids order them as SQLdb does
+	ops := s.Operations[username.(string)]
+	balances := make([]Money, len(ops))
+	var balance Money
+	for i, op := range ops {
+		balance += op.Accrual
+		balances[i] = balance
+	}
+
+	var entries []LedgerEntry
+	for i := len(ops) - 1; i >= 0 && (limit == 0 || len(entries) <= limit); i-- {
+		op := ops[i]
+		if page.After != nil && op.ID >= afterID {
+			continue
+		}
+		if !filter.matches(op) {
+			continue
+		}
+		entries = append(entries, LedgerEntry{
+			ID:          op.ID,
+			Type:        op.Type,
+			Order:       op.Order,
+			Sum:         op.Accrual,
+			Balance:     balances[i],
+			ProcessedAt: op.ProcessedAt,
+		})
+	}
+	entries, next := cutPage(entries, limit, ledgerCursor)
+	return entries, next, nil
+}
+
+func (s *MemStorage) GetOperations(ctx context.Context) ([]OperationRecord, error) {
+	username := ctx.Value(config.UserID("userID"))
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	var ops []OperationRecord
+	for _, op := range s.Operations[username.(string)] {
+		ops = append(ops, OperationRecord{
+			ID:          op.ID,
+			Type:        op.Type,
+			Kind:        op.Kind,
+			RefID:       op.RefID,
+			Order:       op.Order,
+			Sum:         op.Accrual,
+			Reason:      op.Reason,
+			Actor:       op.Actor,
+			ProcessedAt: op.ProcessedAt,
+		})
+	}
+	if len(ops) == 0 {
+		return nil, ErrNoOperations
+	}
+	return ops, nil
+}
+
+func (s *MemStorage) AdjustBalance(ctx context.Context, adj Adjustment) error {
+	if err := checkAdjustment(adj); err != nil {
+		return err
+	}
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if err := s.userExists(adj.Login); err != nil {
+		return err
+	}
+	if s.balance(adj.Login).Current+adj.Sum < 0 {
 		return ErrInsufficientFunds
 	}
+	s.addOperation(adj.Login, Operation{
+		Accrual: adj.Sum,
+		Type:    OperationAdjustment,
+		Kind:    AdjustmentCorrection,
+		Reason:  adj.Reason,
+		Actor:   adj.Actor,
+	})
+	return nil
+}
+
+// refunded returns the ids of the user's refunded withdrawals, s.Mu must be held
+func (s *MemStorage) refunded(username string) map[int64]bool {
+	refunded := make(map[int64]bool)
+	for _, op := range s.Operations[username] {
+		if op.Type == OperationRefund {
+			refunded[op.RefID] = true
+		}
+	}
+	return refunded
+}
+
+func (s *MemStorage) RefundWithdrawal(ctx context.Context, refund Refund) error {
+	if err := checkReason(refund.Reason, refund.Actor); err != nil {
+		return err
+	}
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if err := s.userExists(refund.Login); err != nil {
+		return err
+	}
+
+	var (
+		withdrawal Operation
+		found      bool
+	)
+	for _, op := range s.Operations[refund.Login] {
+		if op.Type == OperationWithdrawal && op.Order == refund.Order {
+			withdrawal, found = op, true
+			break
+		}
+	}
+	if !found {
+		return ErrWithdrawalNotFound
+	}
+	if s.refunded(refund.Login)[withdrawal.ID] {
+		return ErrAlreadyRefunded
+	}
+	s.addOperation(refund.Login, Operation{
+		Order:   refund.Order,
+		Accrual: withdrawal.Accrual * (-1),
+		Type:    OperationRefund,
+		Kind:    AdjustmentRefund,
+		RefID:   withdrawal.ID,
+		Reason:  refund.Reason,
+		Actor:   refund.Actor,
+	})
+	return nil
+}
+
+func (s *MemStorage) RecheckOrder(ctx context.Context, number string) error {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	order := s.findOrder(number)
+	switch {
+	case order == nil:
+		return ErrOrderNotFound
+	case order.Status == "PROCESSED":
+		return ErrOrderProcessed
+	case order.Status == "INVALID" || order.Status == "STALE":
+		order.Status = "PROCESSING"
+		order.PendingSince = now()
+	}
+	order.Attempts = 0
+	order.NextCheckAt = time.Time{}
+	return nil
+}
+
+// storedRequest is a request made with an idempotency key, resp is nil while
+// it is being served
+type storedRequest struct {
+	fingerprint string
+	resp        *SavedResponse
+	createdAt   time.Time
+}
+
+// BeginRequest reserves the key the way SQLdb does
+func (s *MemStorage) BeginRequest(ctx context.Context, req IdempotentRequest) (*SavedResponse, error) {
+	username := ctx.Value(config.UserID("userID")).(string)
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if err := s.userExists(username); err != nil {
+		return nil, err
+	}
+
+	requests := s.requests[username]
+	if requests == nil {
+		requests = make(map[string]*storedRequest)
+		s.requests[username] = requests
+	}
+	for key, stored := range requests {
+		if stored.createdAt.Before(req.Since) {
+			delete(requests, key)
+		}
+	}
+
+	stored, ok := requests[req.Key]
+	switch {
+	case !ok:
+		requests[req.Key] = &storedRequest{fingerprint: req.Fingerprint, createdAt: time.Now()}
+		return nil, nil
+	case stored.fingerprint != req.Fingerprint:
+		return nil, ErrKeyReused
+	case stored.resp == nil && stored.createdAt.Before(req.PendingSince):
+		stored.createdAt = time.Now()
+		return nil, nil
+	case stored.resp == nil:
+		return nil, ErrRequestPending
+	}
+	resp := *stored.resp
+	return &resp, nil
+}
+
+func (s *MemStorage) FinishRequest(ctx context.Context, key string, resp SavedResponse) error {
+	username := ctx.Value(config.UserID("userID")).(string)
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if stored, ok := s.requests[username][key]; ok {
+		stored.resp = &resp
+	}
+	return nil
+}
+
+func (s *MemStorage) ReleaseRequest(ctx context.Context, key string) error {
+	username := ctx.Value(config.UserID("userID")).(string)
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if stored, ok := s.requests[username][key]; ok && stored.resp == nil {
+		delete(s.requests[username], key)
+	}
 	return nil
 }
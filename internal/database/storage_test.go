@@ -0,0 +1,111 @@
+package database
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gambruh/gophermart/internal/config"
+)
+
+// TestMemStorage_Concurrent is meant for go test -race: users upload orders,
+// get accruals and withdraw all at once, while others sign up
+func TestMemStorage_Concurrent(t *testing.T) {
+	const users = 4
+	const ordersPerUser = 25
+
+	s := NewStorage()
+	for u := 0; u < users; u++ {
+		if err := s.Register("user"+strconv.Itoa(u), "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	for u := 0; u < users; u++ {
+		wg.Add(1)
+		go func(u int) {
+			defer wg.Done()
+			login := "user" + strconv.Itoa(u)
+			ctx := context.WithValue(context.Background(), config.UserID("userID"), login)
+			for i := 0; i < ordersPerUser; i++ {
+				number := strconv.Itoa(u*1000 + i)
+				if err := s.SetOrder(number, login); err != nil {
+					t.Error(err)
+					return
+				}
+				var accrual Money = 1_00
+				err := s.UpdateAccrual([]ProcessedOrder{{Number: number, Status: "PROCESSED", Accrual: &accrual}})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, _, err = s.GetOrders(ctx, OrderFilter{}, AllItems); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(u)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < users*ordersPerUser; i++ {
+			if _, err := s.ClaimOrdersForAccrual(context.Background(), Claim{At: time.Now()}); err != nil {
+				t.Error(err)
+				return
+			}
+			s.GetStorage()
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < users; i++ {
+			if err := s.Register("late"+strconv.Itoa(i), "secret"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	for u := 0; u < users; u++ {
+		ctx := context.WithValue(context.Background(), config.UserID("userID"), "user"+strconv.Itoa(u))
+		b, err := s.GetBalance(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Current != ordersPerUser*1_00 {
+			t.Errorf("user%d balance = %v, want %d", u, b.Current, ordersPerUser)
+		}
+	}
+}
+
+func TestMemStorage_DeleteUserArchivesOperations(t *testing.T) {
+	s := NewStorage()
+	if err := s.Register("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetOrder("1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var accrual Money = 50_00
+	if err := s.UpdateAccrual([]ProcessedOrder{{Number: "1", Status: "PROCESSED", Accrual: &accrual}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Archive) != 1 || s.Archive[0].Order != "1" || s.Archive[0].Accrual != accrual {
+		t.Errorf("archive = %+v, want the accrual of order 1", s.Archive)
+	}
+	if len(s.Operations) != 0 || len(s.Orders) != 0 || len(s.Umap) != 0 {
+		t.Errorf("data of the deleted user is left: %+v %+v %+v", s.Operations, s.Orders, s.Umap)
+	}
+}
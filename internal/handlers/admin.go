@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/gambruh/gophermart/internal/accrualworker"
+	"github.com/gambruh/gophermart/internal/auth"
+	"github.com/gambruh/gophermart/internal/config"
+	"github.com/gambruh/gophermart/internal/database"
+)
+
+// adminRoutes are the operator endpoints, open to users with the admin role only
+func (h *WebService) adminRoutes(r chi.Router) {
+	r.Use(auth.AuthMiddleware(h.AuthStorage))
+	r.Use(auth.RequireRole(h.AuthStorage, auth.RoleAdmin))
+
+	r.Get("/users", h.AdminListUsers)
+	r.Put("/users/{login}/roles", h.AdminSetRoles)
+	r.Get("/users/{login}/orders", h.AdminGetOrders)
+	r.Get("/users/{login}/balance", h.AdminGetBalance)
+	r.Get("/users/{login}/operations", h.AdminGetOperations)
+	r.Post("/users/{login}/adjustments", h.AdminAdjustBalance)
+	r.Post("/users/{login}/refunds", h.AdminRefundWithdrawal)
+	r.Post("/orders/{number}/recheck", h.AdminRecheckOrder)
+	r.Get("/accrual", h.AdminAccrualState)
+}
+
+// AccrualState is what the admin API reads of the accrual agent
+type AccrualState interface {
+	BreakerState() accrualworker.BreakerState
+}
+
+// userContext returns the request context as if the user from the path had
+// made the request, so that the user endpoints' storage methods can serve
+// operators too. It writes 404 if there is no such user
+func (h *WebService) userContext(w http.ResponseWriter, r *http.Request) (context.Context, bool) {
+	login := chi.URLParam(r, "login")
+	_, err := h.AuthStorage.GetRoles(r.Context(), login)
+	switch err {
+	case nil:
+		return context.WithValue(r.Context(), config.UserID("userID"), login), true
+	case auth.ErrUserNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		log.Println("error when looking up user for admin:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	return nil, false
+}
+
+// actor returns the login of the operator making the request
+func actor(r *http.Request) string {
+	return r.Context().Value(config.UserID("userID")).(string)
+}
+
+func (h *WebService) AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := h.AuthStorage.ListUsers(r.Context())
+	if err != nil {
+		log.Println("error in AdminListUsers handler:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(users)
+}
+
+// AdminSetRoles replaces the roles of a user. They get into the user's
+// tokens on the next login or token refresh, while a revoked role is denied
+// at once by RequireRole
+func (h *WebService) AdminSetRoles(w http.ResponseWriter, r *http.Request) {
+	var data auth.RoleChange
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	login := chi.URLParam(r, "login")
+
+	err := h.AuthStorage.SetRoles(r.Context(), login, data.Roles)
+	switch {
+	case err == nil:
+		log.Printf("admin %s set roles of %s to %v\n", actor(r), login, data.Roles)
+		w.WriteHeader(http.StatusOK)
+	case errors.Is(err, auth.ErrUnknownRole):
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, auth.ErrUserNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		log.Println("error in AdminSetRoles handler:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (h *WebService) AdminGetOrders(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := h.userContext(w, r)
+	if !ok {
+		return
+	}
+	h.GetOrders(w, r.WithContext(ctx))
+}
+
+func (h *WebService) AdminGetBalance(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := h.userContext(w, r)
+	if !ok {
+		return
+	}
+	h.GetBalance(w, r.WithContext(ctx))
+}
+
+// AdminGetOperations lists every operation of the user: accruals,
+// withdrawals and adjustments with their reasons
+func (h *WebService) AdminGetOperations(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := h.userContext(w, r)
+	if !ok {
+		return
+	}
+	ops, err := h.Storage.GetOperations(ctx)
+	switch err {
+	case nil:
+		w.Header().Add("Content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ops)
+	case database.ErrNoOperations:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		log.Println("error in AdminGetOperations handler:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// AdminAdjustBalance credits or debits the user's balance by hand, as a
+// correction. The reason is mandatory and is kept with the operation along
+// with the operator
+func (h *WebService) AdminAdjustBalance(w http.ResponseWriter, r *http.Request) {
+	var adj database.Adjustment
+	if err := json.NewDecoder(r.Body).Decode(&adj); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	adj.Login = chi.URLParam(r, "login")
+	adj.Actor = actor(r)
+
+	err := h.Storage.AdjustBalance(r.Context(), adj)
+	switch err {
+	case nil:
+		log.Printf("admin %s adjusted balance of %s by %v: %s\n", adj.Actor, adj.Login, adj.Sum, adj.Reason)
+		w.WriteHeader(http.StatusOK)
+	case database.ErrZeroAdjustment, database.ErrNoReason:
+		w.WriteHeader(http.StatusBadRequest)
+	case database.ErrUserNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	case database.ErrInsufficientFunds:
+		w.WriteHeader(http.StatusConflict)
+	default:
+		log.Println("error in AdminAdjustBalance handler:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// AdminRefundWithdrawal gives the user back the points of a withdrawal. The
+// withdrawal no longer counts as withdrawn and a withdrawal can be refunded once
+func (h *WebService) AdminRefundWithdrawal(w http.ResponseWriter, r *http.Request) {
+	var refund database.Refund
+	if err := json.NewDecoder(r.Body).Decode(&refund); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	refund.Login = chi.URLParam(r, "login")
+	refund.Actor = actor(r)
+
+	err := h.Storage.RefundWithdrawal(r.Context(), refund)
+	switch err {
+	case nil:
+		log.Printf("admin %s refunded withdrawal %s of %s: %s\n", refund.Actor, refund.Order, refund.Login, refund.Reason)
+		w.WriteHeader(http.StatusOK)
+	case database.ErrNoReason:
+		w.WriteHeader(http.StatusBadRequest)
+	case database.ErrUserNotFound, database.ErrWithdrawalNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	case database.ErrAlreadyRefunded:
+		w.WriteHeader(http.StatusConflict)
+	default:
+		log.Println("error in AdminRefundWithdrawal handler:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// AdminRecheckOrder makes the accrual worker poll an order again after the
+// accrual system has rejected it, or at once if it is pending
+func (h *WebService) AdminRecheckOrder(w http.ResponseWriter, r *http.Request) {
+	number := chi.URLParam(r, "number")
+	err := h.Storage.RecheckOrder(r.Context(), number)
+	switch err {
+	case nil:
+		log.Printf("admin %s sent order %s to recheck\n", actor(r), number)
+		w.WriteHeader(http.StatusAccepted)
+	case database.ErrOrderNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	case database.ErrOrderProcessed:
+		w.WriteHeader(http.StatusConflict)
+	default:
+		log.Println("error in AdminRecheckOrder handler:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// AdminAccrualState reports whether the accrual system is polled: the state
+// of the agent's circuit breaker, "closed", "open" or "half-open"
+func (h *WebService) AdminAccrualState(w http.ResponseWriter, r *http.Request) {
+	if h.Accrual == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	state := struct {
+		Breaker accrualworker.BreakerState `json:"breaker"`
+	}{Breaker: h.Accrual.BreakerState()}
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(state)
+}
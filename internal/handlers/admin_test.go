@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gambruh/gophermart/internal/accrualworker"
+	"github.com/gambruh/gophermart/internal/auth"
+	"github.com/gambruh/gophermart/internal/config"
+	"github.com/gambruh/gophermart/internal/database"
+	"github.com/gambruh/gophermart/internal/storagetest"
+)
+
+func TestWebService_Admin(t *testing.T) {
+	config.Cfg.Key = "abcd"
+	st := registeredStorage(t, "customer", "secretpass")
+	if err := st.Register("operator", "secretpass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetRoles(context.Background(), "operator", []string{auth.RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	invalid := storagetest.LuhnNumber(100)
+	if err := st.SetOrder(invalid, "customer"); err != nil {
+		t.Fatal(err)
+	}
+	withdrawal := storagetest.LuhnNumber(200)
+	if err := st.UpdateAccrual([]database.ProcessedOrder{{Number: invalid, Status: "INVALID"}}); err != nil {
+		t.Fatal(err)
+	}
+	service := NewService(st, st).Service()
+
+	cookie := func(login string) *http.Cookie {
+		tokens, err := auth.NewSession(context.Background(), st, login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: auth.AccessCookie, Value: tokens.Access}
+	}
+	operator, customer := cookie("operator"), cookie("customer")
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   interface{}
+		cookie *http.Cookie
+		want   int
+	}{
+		{name: "no token", method: http.MethodGet, target: "/api/admin/users", want: http.StatusUnauthorized},
+		{name: "not an admin", method: http.MethodGet, target: "/api/admin/users", cookie: customer, want: http.StatusForbidden},
+		{name: "not an admin adjusting", method: http.MethodPost, target: "/api/admin/users/customer/adjustments", cookie: customer,
+			body: database.Adjustment{Sum: 100_00, Reason: "self-service"}, want: http.StatusForbidden},
+		{name: "list users", method: http.MethodGet, target: "/api/admin/users", cookie: operator, want: http.StatusOK},
+		{name: "orders", method: http.MethodGet, target: "/api/admin/users/customer/orders", cookie: operator, want: http.StatusOK},
+		{name: "orders of unknown user", method: http.MethodGet, target: "/api/admin/users/nobody/orders", cookie: operator, want: http.StatusNotFound},
+		{name: "no operations", method: http.MethodGet, target: "/api/admin/users/customer/operations", cookie: operator, want: http.StatusNoContent},
+		{name: "adjustment without reason", method: http.MethodPost, target: "/api/admin/users/customer/adjustments", cookie: operator,
+			body: database.Adjustment{Sum: 10_00}, want: http.StatusBadRequest},
+		{name: "adjustment below zero", method: http.MethodPost, target: "/api/admin/users/customer/adjustments", cookie: operator,
+			body: database.Adjustment{Sum: -10_00, Reason: "refund"}, want: http.StatusConflict},
+		{name: "adjustment", method: http.MethodPost, target: "/api/admin/users/customer/adjustments", cookie: operator,
+			body: database.Adjustment{Sum: 10_00, Reason: "goodwill"}, want: http.StatusOK},
+		{name: "withdrawal", method: http.MethodPost, target: "/api/user/balance/withdraw", cookie: customer,
+			body: database.WithdrawQ{Order: withdrawal, Sum: 4_00}, want: http.StatusOK},
+		{name: "refund of unknown withdrawal", method: http.MethodPost, target: "/api/admin/users/customer/refunds", cookie: operator,
+			body: database.Refund{Order: invalid, Reason: "cancelled"}, want: http.StatusNotFound},
+		{name: "refund", method: http.MethodPost, target: "/api/admin/users/customer/refunds", cookie: operator,
+			body: database.Refund{Order: withdrawal, Reason: "cancelled"}, want: http.StatusOK},
+		{name: "second refund", method: http.MethodPost, target: "/api/admin/users/customer/refunds", cookie: operator,
+			body: database.Refund{Order: withdrawal, Reason: "cancelled"}, want: http.StatusConflict},
+		{name: "no withdrawals left", method: http.MethodGet, target: "/api/user/withdrawals", cookie: customer, want: http.StatusNoContent},
+		{name: "operations", method: http.MethodGet, target: "/api/admin/users/customer/operations", cookie: operator, want: http.StatusOK},
+		{name: "recheck", method: http.MethodPost, target: "/api/admin/orders/" + invalid + "/recheck", cookie: operator, want: http.StatusAccepted},
+		{name: "recheck unknown order", method: http.MethodPost, target: "/api/admin/orders/" + storagetest.LuhnNumber(101) + "/recheck", cookie: operator, want: http.StatusNotFound},
+		{name: "unknown role", method: http.MethodPut, target: "/api/admin/users/customer/roles", cookie: operator,
+			body: auth.RoleChange{Roles: []string{"root"}}, want: http.StatusBadRequest},
+		{name: "grant admin", method: http.MethodPut, target: "/api/admin/users/customer/roles", cookie: operator,
+			body: auth.RoleChange{Roles: []string{auth.RoleAdmin}}, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			if tt.body != nil {
+				body, _ = json.Marshal(tt.body)
+			}
+			req := httptest.NewRequest(tt.method, tt.target, bytes.NewReader(body))
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			rr := httptest.NewRecorder()
+			service.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("got %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+
+	ops, err := st.GetOperations(context.WithValue(context.Background(), config.UserID("userID"), "customer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 3 || ops[0].Actor != "operator" || ops[0].Reason != "goodwill" || ops[0].Sum != 10_00 {
+		t.Errorf("recorded operations = %+v, want the adjustment by operator", ops)
+	}
+	if len(ops) == 3 && (ops[2].Kind != database.AdjustmentRefund || ops[2].RefID != ops[1].ID) {
+		t.Errorf("refund = %+v, want a refund of %+v", ops[2], ops[1])
+	}
+
+	// the role gets into the token of the next session
+	granted := cookie("customer")
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+	req.AddCookie(granted)
+	rr := httptest.NewRecorder()
+	service.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("new session of granted admin: got %d, want 200", rr.Code)
+	}
+	var users []auth.User
+	if err = json.NewDecoder(rr.Body).Decode(&users); err != nil || len(users) != 2 {
+		t.Errorf("listed users = %+v, %v", users, err)
+	}
+
+	// a demoted admin is turned away though the token still has the role
+	body, _ := json.Marshal(auth.RoleChange{Roles: []string{}})
+	req = httptest.NewRequest(http.MethodPut, "/api/admin/users/customer/roles", bytes.NewReader(body))
+	req.AddCookie(operator)
+	rr = httptest.NewRecorder()
+	service.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("demotion: got %d, want 200", rr.Code)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+	req.AddCookie(granted)
+	rr = httptest.NewRecorder()
+	service.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("demoted admin: got %d, want 403", rr.Code)
+	}
+}
+
+// breakerState stands in for the accrual agent
+type breakerState accrualworker.BreakerState
+
+func (s breakerState) BreakerState() accrualworker.BreakerState {
+	return accrualworker.BreakerState(s)
+}
+
+func TestWebService_AdminAccrualState(t *testing.T) {
+	config.Cfg.Key = "abcd"
+	st := registeredStorage(t, "operator", "secretpass")
+	if err := st.SetRoles(context.Background(), "operator", []string{auth.RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := auth.NewSession(context.Background(), st, "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewService(st, st)
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/accrual", nil)
+		req.AddCookie(&http.Cookie{Name: auth.AccessCookie, Value: tokens.Access})
+		rr := httptest.NewRecorder()
+		h.Service().ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := get(); rr.Code != http.StatusNotFound {
+		t.Errorf("without an agent: got %d, want 404", rr.Code)
+	}
+
+	h.Accrual = breakerState(accrualworker.BreakerOpen)
+	rr := get()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", rr.Code)
+	}
+	if want := `{"breaker":"open"}` + "\n"; rr.Body.String() != want {
+		t.Errorf("body = %q, want %q", rr.Body.String(), want)
+	}
+}
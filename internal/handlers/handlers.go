@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -21,7 +24,10 @@ import (
 type WebService struct {
 	Storage     database.Storage
 	AuthStorage auth.AuthStorage
+	Guard       *auth.LoginGuard
 	Mu          *sync.Mutex
+	// Accrual is the agent polling the accrual system, nil if it isn't run
+	Accrual AccrualState
 }
 
 var ErrWrongCredentials = errors.New("wrong login/password")
@@ -34,16 +40,26 @@ func (h *WebService) Service() http.Handler {
 
 	r.Post("/api/user/register", h.Register)
 	r.Post("/api/user/login", h.Login)
+	r.Post("/api/user/token/refresh", h.RefreshToken)
+	r.Get("/.well-known/jwks.json", h.JWKS)
 
 	r.Group(func(r chi.Router) {
-		r.Use(auth.AuthMiddleware)
-		r.Post("/api/user/orders", h.PostOrder)
+		r.Use(auth.AuthMiddleware(h.AuthStorage))
+		r.Post("/api/user/logout", h.Logout)
+		r.Post("/api/user/logout/all", h.LogoutAll)
+		r.Put("/api/user/password", h.ChangePassword)
+		r.Delete("/api/user", h.DeleteUser)
+		r.Post("/api/user/orders", h.Idempotent(h.PostOrder))
 		r.Get("/api/user/orders", h.GetOrders)
 		r.Get("/api/user/balance", h.GetBalance)
-		r.Post("/api/user/balance/withdraw", h.Withdraw)
+		r.Post("/api/user/balance/withdraw", h.Idempotent(h.Withdraw))
 		r.Get("/api/user/withdrawals", h.GetWithdrawals)
+		r.Get("/api/user/operations", h.GetLedger)
 	})
 
+	r.Route("/api/admin", h.adminRoutes)
+	r.Post("/api/internal/accrual/callback", h.AccrualCallback)
+
 	return r
 }
 
@@ -51,6 +67,7 @@ func NewService(storage database.Storage, authstorage auth.AuthStorage) *WebServ
 	return &WebService{
 		Storage:     storage,
 		AuthStorage: authstorage,
+		Guard:       auth.NewLoginGuard(auth.GuardConfigFromCfg()),
 		Mu:          &sync.Mutex{},
 	}
 }
@@ -75,27 +92,20 @@ func (h *WebService) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	release, err := h.Guard.AcquireHash(r.Context())
+	if err != nil {
+		tooManyRequests(w, time.Second)
+		return
+	}
 	err = h.AuthStorage.Register(data.Login, data.Password)
+	release()
 	switch err {
 	case auth.ErrUsernameIsTaken:
 		fmt.Println("Username is taken")
 		w.WriteHeader(http.StatusConflict)
 		return
 	case nil:
-		// Generate token
-		token, err := auth.GenerateToken(data.Login)
-		if err != nil {
-			fmt.Println("error when generating token", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		// Set the token in "Cookies"
-		http.SetCookie(w, &http.Cookie{
-			Name:  "gophermart-auth",
-			Value: token,
-		})
-		// Return a success response
-		w.WriteHeader(http.StatusOK)
+		h.startSession(w, r, data.Login)
 	default:
 		log.Println("Unexpected case in new user registration:", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -112,38 +122,189 @@ func (h *WebService) Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify the user's credentials
-	err = h.AuthStorage.VerifyCredentials(data.Login, data.Password)
+	if !h.checkPassword(w, r, data.Login, data.Password) {
+		return
+	}
+
+	h.startSession(w, r, data.Login)
+}
+
+// tooManyRequests asks the client to come back after wait
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// clientIP returns the address the request came from. Forwarding headers
+// aren't trusted, anyone can set them
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// startSession logs the user in by setting the cookies of a new session
+func (h *WebService) startSession(w http.ResponseWriter, r *http.Request, login string) {
+	tokens, err := auth.NewSession(r.Context(), h.AuthStorage, login)
+	if err != nil {
+		fmt.Println("error when starting session", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	auth.SetTokenCookies(w, tokens)
+	w.WriteHeader(http.StatusOK)
+}
+
+// RefreshToken issues new tokens in exchange for the refresh token cookie
+func (h *WebService) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(auth.RefreshCookie)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := auth.RefreshSession(r.Context(), h.AuthStorage, cookie.Value)
 	switch err {
 	case nil:
-		//login and password are verified
-	case auth.ErrWrongPassword:
-		fmt.Println("Invalid login credentials:", data.Login)
+		auth.SetTokenCookies(w, tokens)
+		w.WriteHeader(http.StatusOK)
+	case auth.ErrSessionNotFound, auth.ErrRefreshReused:
+		auth.ClearTokenCookies(w)
 		w.WriteHeader(http.StatusUnauthorized)
-		return
 	default:
-		fmt.Println("error when verifying login credentials:", err)
+		log.Println("error when refreshing token:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// JWKS publishes the public keys access tokens can be verified with
+func (h *WebService) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(auth.CurrentKeyring().JWKS())
+}
+
+// Logout revokes the current session
+func (h *WebService) Logout(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.Context().Value(config.SessionID("sessionID"))
+	err := h.AuthStorage.RevokeSession(r.Context(), sessionID.(string))
+	if err != nil {
+		log.Println("error when revoking session:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	auth.ClearTokenCookies(w)
+	w.WriteHeader(http.StatusOK)
+}
 
-	// Generate a token
-	token, err := auth.GenerateToken(data.Login)
+// LogoutAll revokes every session of the user, on all devices
+func (h *WebService) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(config.UserID("userID"))
+	err := h.AuthStorage.RevokeUserSessions(r.Context(), username.(string))
 	if err != nil {
-		fmt.Println("error when generating token", err)
+		log.Println("error when revoking sessions:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	auth.ClearTokenCookies(w)
+	w.WriteHeader(http.StatusOK)
+}
 
-	// Set the token as a cookie in the response
-	http.SetCookie(w, &http.Cookie{
-		Name:  "gophermart-auth",
-		Value: token,
-	})
+// ChangePassword sets a new password and logs the user out everywhere but
+// in the session of this request, which gets new tokens
+func (h *WebService) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var data auth.PasswordChange
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil || data.NewPassword == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	username := r.Context().Value(config.UserID("userID")).(string)
+
+	if !h.checkPassword(w, r, username, data.OldPassword) {
+		return
+	}
+	release, err := h.Guard.AcquireHash(r.Context())
+	if err != nil {
+		tooManyRequests(w, time.Second)
+		return
+	}
+	err = h.AuthStorage.ChangePassword(username, data.NewPassword)
+	release()
+	if err != nil {
+		log.Println("error when changing password:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err = h.AuthStorage.RevokeUserSessions(r.Context(), username); err != nil {
+		log.Println("error when revoking sessions:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.startSession(w, r, username)
+}
 
-	// Return a success response
+// DeleteUser closes the account. The user's operations stay anonymously
+func (h *WebService) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	var data auth.AccountDeletion
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	username := r.Context().Value(config.UserID("userID")).(string)
+
+	if !h.checkPassword(w, r, username, data.Password) {
+		return
+	}
+	if err = h.AuthStorage.DeleteUser(username); err != nil {
+		log.Println("error when deleting user:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	auth.ClearTokenCookies(w)
 	w.WriteHeader(http.StatusOK)
 }
 
+// checkPassword verifies the user's password, it writes the response if the
+// password is wrong or can't be checked now. Failures are reported to the
+// guard, which holds back further attempts for the login and the address
+func (h *WebService) checkPassword(w http.ResponseWriter, r *http.Request, username string, password string) bool {
+	ip := clientIP(r)
+	if wait, ok := h.Guard.Allow(username, ip); !ok {
+		log.Println("password attempts are held back for", username, ip)
+		tooManyRequests(w, wait)
+		return false
+	}
+	release, err := h.Guard.AcquireHash(r.Context())
+	if err != nil {
+		tooManyRequests(w, time.Second)
+		return false
+	}
+	err = h.AuthStorage.VerifyCredentials(username, password)
+	release()
+
+	switch err {
+	case nil:
+		h.Guard.Succeed(username)
+		return true
+	case auth.ErrWrongPassword, auth.ErrUserNotFound:
+		fmt.Println("Invalid login credentials:", username)
+		h.Guard.Fail(username, ip)
+		w.WriteHeader(http.StatusUnauthorized)
+	default:
+		log.Println("error when verifying login credentials:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	return false
+}
+
 func (h *WebService) PostOrder(w http.ResponseWriter, r *http.Request) {
 	contentType := r.Header.Get("Content-type")
 	if contentType != "text/plain" {
@@ -182,20 +343,39 @@ func (h *WebService) PostOrder(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetOrders returns the user's orders, oldest first. It takes the filters
+//
+//	status=NEW,PROCESSED  order statuses, the parameter may be repeated
+//	from=, to=            RFC 3339 upload times, to is exclusive
+//
+// and the paging parameters, see parsePage
 func (h *WebService) GetOrders(w http.ResponseWriter, r *http.Request) {
-	ords, err := h.Storage.GetOrders(r.Context())
-	w.Header().Add("Content-type", "application/json")
-	switch err {
-	case nil:
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(ords)
-	case database.ErrNoOrders:
+	page, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	filter := database.OrderFilter{Statuses: parseList(r, "status")}
+	if filter.From, filter.To, err = parseRange(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ords, next, err := h.Storage.GetOrders(r.Context(), filter, page)
+	switch {
+	case err == nil:
+	case errors.Is(err, database.ErrNoOrders):
 		w.WriteHeader(http.StatusNoContent)
+		return
+	case errors.Is(err, database.ErrBadCursor), errors.Is(err, database.ErrUnknownStatus), errors.Is(err, database.ErrBadRange):
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	default:
 		log.Println("error in GetOrders handler:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	writePage(w, ords, len(ords), next)
 }
 
 func (h *WebService) GetBalance(w http.ResponseWriter, r *http.Request) {
@@ -212,20 +392,68 @@ func (h *WebService) GetBalance(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetWithdrawals returns the user's withdrawals, oldest first. It takes the
+// from= and to= filters and the paging parameters the way GetOrders does
 func (h *WebService) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
-	withdrawals, err := h.Storage.GetWithdrawals(r.Context())
-	switch err {
-	case nil:
-		w.Header().Add("Content-type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(withdrawals)
-	case database.ErrNoOperations:
+	page, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var filter database.WithdrawalFilter
+	if filter.From, filter.To, err = parseRange(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	withdrawals, next, err := h.Storage.GetWithdrawals(r.Context(), filter, page)
+	switch {
+	case err == nil:
+	case errors.Is(err, database.ErrNoOperations):
 		w.WriteHeader(http.StatusNoContent)
+		return
+	case errors.Is(err, database.ErrBadCursor), errors.Is(err, database.ErrBadRange):
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	default:
 		log.Println("error in GetWithdrawals handler:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	writePage(w, withdrawals, len(withdrawals), next)
+}
+
+// GetLedger returns the user's history of operations with the balance after
+// each of them, newest first. It takes the filters
+//
+//	type=accrual,withdrawal  operation types, the parameter may be repeated
+//	from=, to=               RFC 3339 times, to is exclusive
+//
+// and the paging parameters, see parsePage
+func (h *WebService) GetLedger(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	filter := database.LedgerFilter{Types: parseList(r, "type")}
+	if filter.From, filter.To, err = parseRange(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	entries, next, err := h.Storage.GetLedger(r.Context(), filter, page)
+	switch {
+	case err == nil:
+	case errors.Is(err, database.ErrBadCursor), errors.Is(err, database.ErrUnknownOperationType), errors.Is(err, database.ErrBadRange):
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	default:
+		log.Println("error in GetLedger handler:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writePage(w, entries, len(entries), next)
 }
 
 func (h *WebService) Withdraw(w http.ResponseWriter, r *http.Request) {
@@ -234,7 +462,8 @@ func (h *WebService) Withdraw(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&withdrawReq)
 	if err != nil {
 		log.Println("error in Withdraw handler:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
 	err = h.Storage.Withdraw(r.Context(), withdrawReq)
@@ -243,6 +472,8 @@ func (h *WebService) Withdraw(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	case database.ErrWrongOrder:
 		w.WriteHeader(http.StatusUnprocessableEntity)
+	case database.ErrWrongSum:
+		w.WriteHeader(http.StatusBadRequest)
 	case database.ErrInsufficientFunds:
 		w.WriteHeader(http.StatusPaymentRequired)
 	default:
@@ -2,18 +2,36 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/gambruh/gophermart/internal/auth"
 	"github.com/gambruh/gophermart/internal/config"
 	"github.com/gambruh/gophermart/internal/database"
+	"github.com/gambruh/gophermart/internal/storagetest"
 )
 
+// registeredStorage returns an in-memory storage with the user already registered
+func registeredStorage(t *testing.T, login, password string) *database.MemStorage {
+	t.Helper()
+	st := database.NewStorage()
+	if err := st.Register(login, password); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
 func TestWebService_Register(t *testing.T) {
+	existing := registeredStorage(t, "user123", "secretpass")
+
 	tests := []struct {
 		name      string
 		h         *WebService
@@ -23,8 +41,8 @@ func TestWebService_Register(t *testing.T) {
 		{
 			name: "test 1 write login data to storage",
 			h: &WebService{
-				Storage:     &database.MemStorage{Data: make(map[string]string)},
-				AuthStorage: &auth.AuthMemStorage{Data: make(map[string]string)},
+				Storage:     database.NewStorage(),
+				AuthStorage: auth.NewMemStorage(),
 				Mu:          &sync.Mutex{},
 			},
 			loginData: auth.LoginData{
@@ -36,7 +54,7 @@ func TestWebService_Register(t *testing.T) {
 		{
 			name: "test 2 empty password",
 			h: &WebService{
-				Storage: &database.MemStorage{Data: make(map[string]string)},
+				Storage: database.NewStorage(),
 				Mu:      &sync.Mutex{},
 			},
 			loginData: auth.LoginData{
@@ -48,8 +66,8 @@ func TestWebService_Register(t *testing.T) {
 		{
 			name: "test 3 username already exists",
 			h: &WebService{
-				Storage:     &database.MemStorage{Data: map[string]string{"user123": "secretpass"}},
-				AuthStorage: &auth.AuthMemStorage{Data: map[string]string{"user123": "secretpass"}},
+				Storage:     existing,
+				AuthStorage: existing,
 				Mu:          &sync.Mutex{},
 			},
 			loginData: auth.LoginData{
@@ -80,12 +98,16 @@ func TestWebService_Register(t *testing.T) {
 				t.Errorf("expected status %d, got %d", tt.want, rr.Code)
 			}
 			if tt.want == http.StatusOK {
+				err := tt.h.AuthStorage.VerifyCredentials(tt.loginData.Login, tt.loginData.Password)
+				if err != nil {
+					t.Errorf("registered user can't log in: %v", err)
+				}
 				pass, err := tt.h.AuthStorage.GetPass(tt.loginData.Login)
 				if err != nil {
 					t.Errorf("user not found in test storage: %v", err)
 				}
-				if pass != tt.loginData.Password {
-					t.Errorf("wrong password")
+				if pass == tt.loginData.Password {
+					t.Errorf("password is stored in plain text")
 				}
 			}
 		})
@@ -95,30 +117,17 @@ func TestWebService_Register(t *testing.T) {
 func TestWebService_Login(t *testing.T) {
 	key := "abcd"
 	config.Cfg.Key = key
-	mockAuthstorage := &auth.AuthMemStorage{
-		Data: make(map[string]string),
-	}
-	mockstorage := &database.MemStorage{
-		Data: make(map[string]string),
-	}
-
-	mockAuthstorage.Data["user123"] = "secretpass"
+	mockstorage := registeredStorage(t, "user123", "secretpass")
 
 	var mockservice = &(WebService{
 		Storage:     mockstorage,
-		AuthStorage: mockAuthstorage,
+		AuthStorage: mockstorage,
 		Mu:          &sync.Mutex{},
 	})
 
-	token123, err := auth.GenerateToken("user123")
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	tests := []struct {
 		name      string
 		loginData auth.LoginData
-		token     string
 		want      int
 	}{
 		{
@@ -127,8 +136,7 @@ func TestWebService_Login(t *testing.T) {
 				Login:    "user123",
 				Password: "secretpass",
 			},
-			token: token123,
-			want:  http.StatusOK,
+			want: http.StatusOK,
 		},
 		{
 			name: "Wrong user",
@@ -136,8 +144,7 @@ func TestWebService_Login(t *testing.T) {
 				Login:    "unknownuser",
 				Password: "verysecretpassword",
 			},
-			token: "",
-			want:  http.StatusUnauthorized,
+			want: http.StatusUnauthorized,
 		},
 	}
 	for _, tt := range tests {
@@ -165,3 +172,417 @@ func TestWebService_Login(t *testing.T) {
 		})
 	}
 }
+
+func TestWebService_WithdrawConcurrent(t *testing.T) {
+	config.Cfg.Key = "abcd"
+
+	t.Run("memory storage", func(t *testing.T) {
+		st := registeredStorage(t, "user123", "secretpass")
+		order := storagetest.LuhnNumber(100)
+		if err := st.SetOrder(order, "user123"); err != nil {
+			t.Fatal(err)
+		}
+		var accrual database.Money = 100_00
+		err := st.UpdateAccrual([]database.ProcessedOrder{{Number: order, Status: "PROCESSED", Accrual: &accrual}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testWithdrawConcurrent(t, st, "user123")
+	})
+
+	t.Run("postgres storage", func(t *testing.T) {
+		st := storagetest.NewPostgres(t)
+		if err := st.Register("user123", "secretpass"); err != nil {
+			t.Fatal(err)
+		}
+		order := storagetest.LuhnNumber(100)
+		if err := st.SetOrder(order, "user123"); err != nil {
+			t.Fatal(err)
+		}
+		var accrual database.Money = 100_00
+		err := st.UpdateAccrual([]database.ProcessedOrder{{Number: order, Status: "PROCESSED", Accrual: &accrual}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testWithdrawConcurrent(t, st, "user123")
+	})
+}
+
+// testWithdrawConcurrent fires parallel withdrawals of 10 points each at a
+// user with exactly 100 points: 10 of them must pass, the rest must get 402
+func testWithdrawConcurrent(t *testing.T, st database.Storage, login string) {
+	const (
+		requests                = 50
+		sum      database.Money = 10_00
+	)
+	h := NewService(st, st)
+	service := h.Service()
+
+	tokens, err := auth.NewSession(context.Background(), st, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes := make(chan int, requests)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body, _ := json.Marshal(database.WithdrawQ{Order: storagetest.LuhnNumber(1000 + int64(i)), Sum: sum})
+			req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", bytes.NewReader(body))
+			req.AddCookie(&http.Cookie{Name: auth.AccessCookie, Value: tokens.Access})
+			rr := httptest.NewRecorder()
+			service.ServeHTTP(rr, req)
+			codes <- rr.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	got := make(map[int]int)
+	for code := range codes {
+		got[code]++
+	}
+	if got[http.StatusOK] != 10 || got[http.StatusPaymentRequired] != requests-10 {
+		t.Errorf("got status codes %v, want 10 x 200 and %d x 402", got, requests-10)
+	}
+
+	ctx := context.WithValue(context.Background(), config.UserID("userID"), login)
+	balance, err := st.GetBalance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Current != 0 || balance.Withdrawn != 100_00 {
+		t.Errorf("balance after withdrawals = %+v, want 0 current and 100 withdrawn", balance)
+	}
+}
+
+func TestWebService_Sessions(t *testing.T) {
+	config.Cfg.Key = "abcd"
+	st := registeredStorage(t, "user123", "secretpass")
+	service := NewService(st, st).Service()
+
+	// do sends a request with the cookies and returns the response cookies by name
+	do := func(method, target string, body []byte, cookies ...*http.Cookie) (int, map[string]*http.Cookie) {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		service.ServeHTTP(rr, req)
+		got := make(map[string]*http.Cookie)
+		for _, c := range rr.Result().Cookies() {
+			got[c.Name] = c
+		}
+		return rr.Code, got
+	}
+
+	body, _ := json.Marshal(auth.LoginData{Login: "user123", Password: "secretpass"})
+	code, first := do(http.MethodPost, "/api/user/login", body)
+	if code != http.StatusOK || first[auth.AccessCookie] == nil || first[auth.RefreshCookie] == nil {
+		t.Fatalf("login: got %d with cookies %v, want 200 with both tokens", code, first)
+	}
+	_, other := do(http.MethodPost, "/api/user/login", body)
+
+	code, second := do(http.MethodPost, "/api/user/token/refresh", nil, first[auth.RefreshCookie])
+	if code != http.StatusOK || second[auth.RefreshCookie].Value == first[auth.RefreshCookie].Value {
+		t.Fatalf("refresh: got %d, want 200 with a new refresh token", code)
+	}
+	if code, _ = do(http.MethodGet, "/api/user/balance", nil, second[auth.AccessCookie]); code != http.StatusOK {
+		t.Errorf("refreshed access token: got %d, want 200", code)
+	}
+
+	// the used refresh token is rejected and takes its session down
+	if code, _ = do(http.MethodPost, "/api/user/token/refresh", nil, first[auth.RefreshCookie]); code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token: got %d, want 401", code)
+	}
+	if code, _ = do(http.MethodGet, "/api/user/balance", nil, second[auth.AccessCookie]); code != http.StatusUnauthorized {
+		t.Errorf("access token of the revoked session: got %d, want 401", code)
+	}
+
+	if code, _ = do(http.MethodPost, "/api/user/logout", nil, other[auth.AccessCookie]); code != http.StatusOK {
+		t.Errorf("logout: got %d, want 200", code)
+	}
+	if code, _ = do(http.MethodGet, "/api/user/balance", nil, other[auth.AccessCookie]); code != http.StatusUnauthorized {
+		t.Errorf("access token after logout: got %d, want 401", code)
+	}
+	if code, _ = do(http.MethodPost, "/api/user/token/refresh", nil, other[auth.RefreshCookie]); code != http.StatusUnauthorized {
+		t.Errorf("refresh token after logout: got %d, want 401", code)
+	}
+
+	_, a := do(http.MethodPost, "/api/user/login", body)
+	_, b := do(http.MethodPost, "/api/user/login", body)
+	if code, _ = do(http.MethodPost, "/api/user/logout/all", nil, a[auth.AccessCookie]); code != http.StatusOK {
+		t.Errorf("logout from all sessions: got %d, want 200", code)
+	}
+	if code, _ = do(http.MethodGet, "/api/user/balance", nil, b[auth.AccessCookie]); code != http.StatusUnauthorized {
+		t.Errorf("access token of another session after logout from all: got %d, want 401", code)
+	}
+}
+
+func TestWebService_ChangePasswordAndDelete(t *testing.T) {
+	config.Cfg.Key = "abcd"
+	st := registeredStorage(t, "user123", "secretpass")
+	h := NewService(st, st)
+	// a wrong password mustn't hold back the next requests here
+	h.Guard = auth.NewLoginGuard(auth.GuardConfig{Delay: time.Nanosecond})
+	service := h.Service()
+
+	do := func(method, target string, body interface{}, cookie *http.Cookie) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, target, bytes.NewReader(b))
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		service.ServeHTTP(rr, req)
+		return rr
+	}
+	accessCookie := func(rr *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == auth.AccessCookie {
+				return c
+			}
+		}
+		t.Fatal("no access token cookie")
+		return nil
+	}
+
+	login := auth.LoginData{Login: "user123", Password: "secretpass"}
+	current := accessCookie(do(http.MethodPost, "/api/user/login", login, nil))
+	other := accessCookie(do(http.MethodPost, "/api/user/login", login, nil))
+
+	tests := []struct {
+		name string
+		body auth.PasswordChange
+		want int
+	}{
+		{name: "wrong old password", body: auth.PasswordChange{OldPassword: "nope", NewPassword: "newpass"}, want: http.StatusUnauthorized},
+		{name: "empty new password", body: auth.PasswordChange{OldPassword: "secretpass"}, want: http.StatusBadRequest},
+		{name: "password changed", body: auth.PasswordChange{OldPassword: "secretpass", NewPassword: "newpass"}, want: http.StatusOK},
+	}
+	var rr *httptest.ResponseRecorder
+	for _, tt := range tests {
+		rr = do(http.MethodPut, "/api/user/password", tt.body, current)
+		if rr.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, rr.Code, tt.want)
+		}
+	}
+	renewed := accessCookie(rr)
+
+	if code := do(http.MethodGet, "/api/user/balance", nil, other).Code; code != http.StatusUnauthorized {
+		t.Errorf("other session after password change: got %d, want 401", code)
+	}
+	if code := do(http.MethodGet, "/api/user/balance", nil, renewed).Code; code != http.StatusOK {
+		t.Errorf("renewed session after password change: got %d, want 200", code)
+	}
+	if err := st.VerifyCredentials("user123", "newpass"); err != nil {
+		t.Errorf("new password doesn't work: %v", err)
+	}
+
+	if code := do(http.MethodDelete, "/api/user", auth.AccountDeletion{Password: "secretpass"}, renewed).Code; code != http.StatusUnauthorized {
+		t.Errorf("deletion with the old password: got %d, want 401", code)
+	}
+	if code := do(http.MethodDelete, "/api/user", auth.AccountDeletion{Password: "newpass"}, renewed).Code; code != http.StatusOK {
+		t.Errorf("deletion: got %d, want 200", code)
+	}
+	if _, err := st.GetPass("user123"); err != auth.ErrUserNotFound {
+		t.Errorf("deleted user is still stored: %v", err)
+	}
+	if code := do(http.MethodGet, "/api/user/balance", nil, renewed).Code; code != http.StatusUnauthorized {
+		t.Errorf("session of deleted user: got %d, want 401", code)
+	}
+}
+
+func TestWebService_LoginLockout(t *testing.T) {
+	config.Cfg.Key = "abcd"
+	st := registeredStorage(t, "user123", "secretpass")
+	h := NewService(st, st)
+	h.Guard = auth.NewLoginGuard(auth.GuardConfig{MaxFailures: 3, Delay: time.Nanosecond, Lockout: time.Minute})
+	service := h.Service()
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(auth.LoginData{Login: "user123", Password: password})
+		req := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		service.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if code := login("wrong").Code; code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: got %d, want 401", code)
+	}
+	time.Sleep(time.Millisecond)
+	// a right password clears the failures
+	if code := login("secretpass").Code; code != http.StatusOK {
+		t.Fatalf("right password: got %d, want 200", code)
+	}
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond)
+		if code := login("wrong").Code; code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: got %d, want 401", i, code)
+		}
+	}
+	rr := login("secretpass")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked out login: got %d, want 429", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+}
+
+func TestWebService_GetLedger(t *testing.T) {
+	config.Cfg.Key = "abcd"
+	st := registeredStorage(t, "user123", "secretpass")
+	service := NewService(st, st).Service()
+	tokens, err := auth.NewSession(context.Background(), st, "user123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.AddCookie(&http.Cookie{Name: auth.AccessCookie, Value: tokens.Access})
+		rr := httptest.NewRecorder()
+		service.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if code := get("/api/user/operations").Code; code != http.StatusNoContent {
+		t.Errorf("empty ledger: got %d, want 204", code)
+	}
+	for i := int64(0); i < 3; i++ {
+		number := storagetest.LuhnNumber(100 + i)
+		if err = st.SetOrder(number, "user123"); err != nil {
+			t.Fatal(err)
+		}
+		accrual := database.Money(10_00)
+		if err = st.UpdateAccrual([]database.ProcessedOrder{{Number: number, Status: "PROCESSED", Accrual: &accrual}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{name: "unknown type", target: "/api/user/operations?type=gift", want: http.StatusBadRequest},
+		{name: "bad limit", target: "/api/user/operations?limit=0", want: http.StatusBadRequest},
+		{name: "bad cursor", target: "/api/user/operations?after=abc", want: http.StatusBadRequest},
+		{name: "bad date", target: "/api/user/operations?from=yesterday", want: http.StatusBadRequest},
+		{name: "no withdrawals", target: "/api/user/operations?type=withdrawal,refund", want: http.StatusNoContent},
+		{name: "accruals", target: "/api/user/operations?type=accrual&from=2023-01-01T00:00:00Z", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := get(tt.target).Code; code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, code, tt.want)
+		}
+	}
+
+	var balances []database.Money
+	target := "/api/user/operations?limit=2"
+	for target != "" {
+		rr := get(target)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("page %s: got %d, want 200", target, rr.Code)
+		}
+		var entries []database.LedgerEntry
+		if err = json.NewDecoder(rr.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			balances = append(balances, e.Balance)
+		}
+		target = ""
+		if next := rr.Header().Get(NextCursorHeader); next != "" {
+			target = "/api/user/operations?limit=2&after=" + next
+		}
+	}
+	if want := []database.Money{30_00, 20_00, 10_00}; !reflect.DeepEqual(balances, want) {
+		t.Errorf("balances over pages = %v, want %v", balances, want)
+	}
+}
+
+func TestWebService_GetOrdersPages(t *testing.T) {
+	config.Cfg.Key = "abcd"
+	st := registeredStorage(t, "user123", "secretpass")
+	service := NewService(st, st).Service()
+	tokens, err := auth.NewSession(context.Background(), st, "user123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.AddCookie(&http.Cookie{Name: auth.AccessCookie, Value: tokens.Access})
+		rr := httptest.NewRecorder()
+		service.ServeHTTP(rr, req)
+		return rr
+	}
+
+	var want []string
+	for i := int64(0); i <= database.DefaultPageSize; i++ {
+		number := storagetest.LuhnNumber(100 + i)
+		if err = st.SetOrder(number, "user123"); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, number)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{name: "unknown status", target: "/api/user/orders?status=LOST", want: http.StatusBadRequest},
+		{name: "bad limit", target: "/api/user/orders?limit=-1", want: http.StatusBadRequest},
+		{name: "too large limit", target: "/api/user/withdrawals?limit=" + strconv.Itoa(database.MaxPageSize+1), want: http.StatusBadRequest},
+		{name: "bad cursor", target: "/api/user/withdrawals?after=abc", want: http.StatusBadRequest},
+		{name: "bad date", target: "/api/user/withdrawals?to=tomorrow", want: http.StatusBadRequest},
+		{name: "no processed orders", target: "/api/user/orders?status=PROCESSED,INVALID", want: http.StatusNoContent},
+		{name: "new orders", target: "/api/user/orders?status=NEW&from=2023-01-01T00:00:00Z", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := get(tt.target).Code; code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, code, tt.want)
+		}
+	}
+
+	// without a limit the list comes in pages of the default size
+	rr := get("/api/user/orders")
+	var first []database.Order
+	if err = json.NewDecoder(rr.Body).Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || len(first) != database.DefaultPageSize || rr.Header().Get(NextCursorHeader) == "" {
+		t.Errorf("orders without a limit: got %d, %d orders and next cursor %q, want a page of %d",
+			rr.Code, len(first), rr.Header().Get(NextCursorHeader), database.DefaultPageSize)
+	}
+
+	var numbers []string
+	target := "/api/user/orders?limit=2"
+	for target != "" {
+		rr := get(target)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("page %s: got %d, want 200", target, rr.Code)
+		}
+		var ords []database.Order
+		if err = json.NewDecoder(rr.Body).Decode(&ords); err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range ords {
+			numbers = append(numbers, o.Number)
+		}
+		target = ""
+		if next := rr.Header().Get(NextCursorHeader); next != "" {
+			target = "/api/user/orders?limit=2&after=" + next
+		}
+	}
+	sort.Strings(numbers)
+	sort.Strings(want)
+	if !reflect.DeepEqual(numbers, want) {
+		t.Errorf("orders over pages = %v, want %v", numbers, want)
+	}
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gambruh/gophermart/internal/config"
+	"github.com/gambruh/gophermart/internal/database"
+)
+
+// IdempotencyKeyHeader lets a client retry a request without having it
+// served twice
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// ReplayedHeader marks a response replayed to a repeated request
+const ReplayedHeader = "Idempotent-Replayed"
+
+// maxKeyLength limits the idempotency keys
+const maxKeyLength = 255
+
+// maxIdempotentBody limits the body of a request with an idempotency key
+const maxIdempotentBody = 1 << 20
+
+// defaultIdempotencyTTL is used when the config leaves IdempotencyTTL empty
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// pendingLease is how long a request is served at most. A key still pending
+// after it belongs to a request the server crashed in the middle of and is
+// taken over by the repeat
+const pendingLease = time.Minute
+
+// saveTimeout limits saving the outcome of a served request
+const saveTimeout = 5 * time.Second
+
+func idempotencyTTL() time.Duration {
+	if config.Cfg.IdempotencyTTL > 0 {
+		return config.Cfg.IdempotencyTTL
+	}
+	return defaultIdempotencyTTL
+}
+
+// Idempotent serves a request made with an Idempotency-Key once. Repeats
+// within config.Cfg.IdempotencyTTL get the saved response, a request made
+// with a key used for another one gets 422 and a repeat of a request still
+// being served gets 409 for pendingLease. A request failing with 5xx is
+// forgotten, so that it can be retried. Requests without the key are served
+// as usual
+func (h *WebService) Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		saved, err := h.Storage.BeginRequest(r.Context(), database.IdempotentRequest{
+			Key:          key,
+			Fingerprint:  fingerprint(r, body),
+			Since:        time.Now().Add(-idempotencyTTL()),
+			PendingSince: time.Now().Add(-pendingLease),
+		})
+		switch {
+		case err == nil:
+		case errors.Is(err, database.ErrKeyReused):
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		case errors.Is(err, database.ErrRequestPending):
+			w.WriteHeader(http.StatusConflict)
+			return
+		default:
+			log.Println("error in Idempotent middleware:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if saved != nil {
+			w.Header().Set(ReplayedHeader, "true")
+			w.WriteHeader(saved.Status)
+			w.Write(saved.Body)
+			return
+		}
+
+		rec := &recordingWriter{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		// the client may be gone by now, the outcome is kept all the same
+		ctx, cancel := detached(r)
+		defer cancel()
+		if rec.status >= http.StatusInternalServerError {
+			if err = h.Storage.ReleaseRequest(ctx, key); err != nil {
+				log.Println("error in Idempotent middleware:", err)
+			}
+			return
+		}
+		err = h.Storage.FinishRequest(ctx, key, database.SavedResponse{Status: rec.status, Body: rec.body.Bytes()})
+		if err != nil {
+			log.Println("error in Idempotent middleware:", err)
+		}
+	}
+}
+
+// detached returns a context of the user of the request which isn't canceled
+// when the client gives up on it
+func detached(r *http.Request) (context.Context, context.CancelFunc) {
+	userID := config.UserID("userID")
+	ctx := context.WithValue(context.Background(), userID, r.Context().Value(userID))
+	return context.WithTimeout(ctx, saveTimeout)
+}
+
+// fingerprint tells the requests made with the same key apart
+func fingerprint(r *http.Request, body []byte) string {
+	sum := sha256.New()
+	io.WriteString(sum, r.Method+" "+r.URL.Path+"\n"+r.Header.Get("Content-Type")+"\n")
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// recordingWriter keeps a copy of the response it writes
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
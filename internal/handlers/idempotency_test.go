@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gambruh/gophermart/internal/auth"
+	"github.com/gambruh/gophermart/internal/config"
+	"github.com/gambruh/gophermart/internal/database"
+	"github.com/gambruh/gophermart/internal/storagetest"
+)
+
+func TestWebService_Idempotent(t *testing.T) {
+	config.Cfg.Key = "abcd"
+	st := registeredStorage(t, "user123", "secretpass")
+	credited := storagetest.LuhnNumber(100)
+	if err := st.SetOrder(credited, "user123"); err != nil {
+		t.Fatal(err)
+	}
+	accrual := database.Money(10_00)
+	if err := st.UpdateAccrual([]database.ProcessedOrder{{Number: credited, Status: "PROCESSED", Accrual: &accrual}}); err != nil {
+		t.Fatal(err)
+	}
+	service := NewService(st, st).Service()
+	tokens, err := auth.NewSession(context.Background(), st, "user123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withdraw := `{"order":"` + storagetest.LuhnNumber(200) + `","sum":3}`
+	order := storagetest.LuhnNumber(300)
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		key         string
+		body        string
+		want        int
+		replayed    bool
+	}{
+		{name: "withdrawal", target: "/api/user/balance/withdraw", contentType: "application/json", key: "w1", body: withdraw, want: http.StatusOK},
+		{name: "withdrawal retried", target: "/api/user/balance/withdraw", contentType: "application/json", key: "w1", body: withdraw, want: http.StatusOK, replayed: true},
+		{name: "key reused", target: "/api/user/balance/withdraw", contentType: "application/json", key: "w1", body: `{"order":"` + order + `","sum":1}`, want: http.StatusUnprocessableEntity},
+		{name: "key reused on orders", target: "/api/user/orders", contentType: "text/plain", key: "w1", body: order, want: http.StatusUnprocessableEntity},
+		{name: "withdrawal without key", target: "/api/user/balance/withdraw", contentType: "application/json", body: withdraw, want: http.StatusUnprocessableEntity},
+		{name: "order", target: "/api/user/orders", contentType: "text/plain", key: "o1", body: order, want: http.StatusAccepted},
+		{name: "order retried", target: "/api/user/orders", contentType: "text/plain", key: "o1", body: order, want: http.StatusAccepted, replayed: true},
+		{name: "order retried without key", target: "/api/user/orders", contentType: "text/plain", body: order, want: http.StatusOK},
+		{name: "too long key", target: "/api/user/orders", contentType: "text/plain", key: strings.Repeat("k", maxKeyLength+1), body: order, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		if tt.key != "" {
+			req.Header.Set(IdempotencyKeyHeader, tt.key)
+		}
+		req.AddCookie(&http.Cookie{Name: auth.AccessCookie, Value: tokens.Access})
+		rr := httptest.NewRecorder()
+		service.ServeHTTP(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, rr.Code, tt.want)
+		}
+		if replayed := rr.Header().Get(ReplayedHeader) != ""; replayed != tt.replayed {
+			t.Errorf("%s: replayed = %v, want %v", tt.name, replayed, tt.replayed)
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), config.UserID("userID"), "user123")
+	balance, err := st.GetBalance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (database.Balance{Current: 7_00, Withdrawn: 3_00}); balance != want {
+		t.Errorf("balance = %+v, want the withdrawal made once, %+v", balance, want)
+	}
+}
+
+// doneStorage fails to save once the context is done, the way SQLdb does
+type doneStorage struct {
+	*database.MemStorage
+}
+
+func (s doneStorage) FinishRequest(ctx context.Context, key string, resp database.SavedResponse) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.MemStorage.FinishRequest(ctx, key, resp)
+}
+
+func (s doneStorage) ReleaseRequest(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.MemStorage.ReleaseRequest(ctx, key)
+}
+
+func TestWebService_IdempotentClientGone(t *testing.T) {
+	st := registeredStorage(t, "user123", "secretpass")
+	credited := storagetest.LuhnNumber(100)
+	if err := st.SetOrder(credited, "user123"); err != nil {
+		t.Fatal(err)
+	}
+	accrual := database.Money(10_00)
+	if err := st.UpdateAccrual([]database.ProcessedOrder{{Number: credited, Status: "PROCESSED", Accrual: &accrual}}); err != nil {
+		t.Fatal(err)
+	}
+	h := NewService(doneStorage{st}, st)
+	withdraw := `{"order":"` + storagetest.LuhnNumber(200) + `","sum":3}`
+	userCtx := context.WithValue(context.Background(), config.UserID("userID"), "user123")
+
+	send := func(ctx context.Context, next http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(withdraw))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(IdempotencyKeyHeader, "w1")
+		rr := httptest.NewRecorder()
+		h.Idempotent(next)(rr, req.WithContext(ctx))
+		return rr
+	}
+
+	// the client gives up right after the withdrawal is made
+	ctx, cancel := context.WithCancel(userCtx)
+	rr := send(ctx, func(w http.ResponseWriter, r *http.Request) {
+		h.Withdraw(w, r)
+		cancel()
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("withdrawal: got %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	rr = send(userCtx, h.Withdraw)
+	if rr.Code != http.StatusOK || rr.Header().Get(ReplayedHeader) == "" {
+		t.Errorf("retry: got %d, replayed %q, want the saved %d", rr.Code, rr.Header().Get(ReplayedHeader), http.StatusOK)
+	}
+	balance, err := st.GetBalance(userCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (database.Balance{Current: 7_00, Withdrawn: 3_00}); balance != want {
+		t.Errorf("balance = %+v, want the withdrawal made once, %+v", balance, want)
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gambruh/gophermart/internal/database"
+)
+
+// NextCursorHeader carries the cursor of the next page, it is absent on the last page
+const NextCursorHeader = "X-Next-Cursor"
+
+var ErrBadLimit = errors.New("bad page limit")
+
+// parsePage reads the paging parameters of a list request:
+//
+//	limit= items on the page, database.DefaultPageSize if not given and
+//	       database.MaxPageSize at most
+//	after= the X-Next-Cursor header of the previous page
+func parsePage(r *http.Request) (database.Page, error) {
+	page := database.Page{Limit: database.DefaultPageSize}
+	query := r.URL.Query()
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > database.MaxPageSize {
+			return page, ErrBadLimit
+		}
+		page.Limit = n
+	}
+	if after := query.Get("after"); after != "" {
+		c, err := database.ParseCursor(after)
+		if err != nil {
+			return page, err
+		}
+		page.After = &c
+	}
+	return page, nil
+}
+
+// writePage writes a page of items, with 204 if there are none
+func writePage(w http.ResponseWriter, items interface{}, count int, next *database.Cursor) {
+	if count == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if next != nil {
+		w.Header().Set(NextCursorHeader, next.String())
+	}
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(items)
+}
+
+// parseRange reads the time range filter of a list request:
+//
+//	from=, to= RFC 3339 times, to is exclusive
+func parseRange(r *http.Request) (from, to time.Time, err error) {
+	query := r.URL.Query()
+	if s := query.Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			return from, to, err
+		}
+	}
+	if s := query.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			return from, to, err
+		}
+	}
+	return from, to, nil
+}
+
+// parseList reads the values of a list parameter, which may be repeated and
+// hold comma separated values
+func parseList(r *http.Request, name string) []string {
+	var values []string
+	for _, v := range r.URL.Query()[name] {
+		values = append(values, strings.Split(v, ",")...)
+	}
+	return values
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gambruh/gophermart/internal/config"
+	"github.com/gambruh/gophermart/internal/database"
+)
+
+// SignatureHeader carries the signature of an accrual callback body
+const SignatureHeader = "X-Accrual-Signature"
+
+// TimestampHeader carries the unix time, in seconds, a callback was signed at
+const TimestampHeader = "X-Accrual-Timestamp"
+
+// maxCallbackAge is how far the timestamp of a callback may be from now, an
+// older callback is taken for a replayed one
+const maxCallbackAge = 5 * time.Minute
+
+// signaturePrefix names the algorithm of the signature
+const signaturePrefix = "sha256="
+
+// maxCallbackSize limits the body of an accrual callback
+const maxCallbackSize = 64 << 10
+
+// SignCallback returns the signature header value of an accrual callback
+// signed at timestamp, the TimestampHeader value: the hex HMAC-SHA256 of the
+// timestamp, a dot and the body with the shared secret
+func SignCallback(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp+".")
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSignature checks the signature in constant time and that it was made
+// within maxCallbackAge of now
+func validSignature(secret string, body []byte, timestamp, signature string, now time.Time) bool {
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(sec, 0)); age > maxCallbackAge || age < -maxCallbackAge {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(SignCallback(secret, timestamp, body)))
+}
+
+// AccrualCallback lets the accrual system push the result of an order as
+// soon as it is ready instead of waiting to be polled. The body is the
+// ProcessedOrder the accrual system answers polls with, signed in
+// SignatureHeader along with the TimestampHeader. A callback signed more than
+// maxCallbackAge away from now is refused, so that a captured one can't be
+// replayed later. The result is applied the way polled ones are, so an order
+// which never gets a callback is still polled. The endpoint is off, 404,
+// unless config.Cfg.AccrualWebhookSecret is set
+func (h *WebService) AccrualCallback(w http.ResponseWriter, r *http.Request) {
+	secret := config.Cfg.AccrualWebhookSecret
+	if secret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCallbackSize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !validSignature(secret, body, r.Header.Get(TimestampHeader), r.Header.Get(SignatureHeader), time.Now()) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var result database.ProcessedOrder
+	if err = json.Unmarshal(body, &result); err != nil || result.Number == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = h.Storage.UpdateAccrual([]database.ProcessedOrder{result})
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	case errors.Is(err, database.ErrUnexpectedStatus):
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		log.Println("error in AccrualCallback handler:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gambruh/gophermart/internal/config"
+	"github.com/gambruh/gophermart/internal/database"
+	"github.com/gambruh/gophermart/internal/storagetest"
+)
+
+func TestWebService_AccrualCallback(t *testing.T) {
+	st := registeredStorage(t, "user123", "secretpass")
+	processed := storagetest.LuhnNumber(100)
+	waiting := storagetest.LuhnNumber(101)
+	for _, number := range []string{processed, waiting} {
+		if err := st.SetOrder(number, "user123"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service := NewService(st, st).Service()
+
+	const secret = "webhook secret"
+	defer func() { config.Cfg.AccrualWebhookSecret = "" }()
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-maxCallbackAge-time.Minute).Unix(), 10)
+	sign := func(secret, body string) string { return SignCallback(secret, now, []byte(body)) }
+
+	result := `{"order":"` + processed + `","status":"PROCESSED","accrual":729.98}`
+	tests := []struct {
+		name      string
+		secret    string
+		body      string
+		timestamp string
+		signature string
+		want      int
+	}{
+		{name: "webhook off", body: result, signature: sign(secret, result), want: http.StatusNotFound},
+		{name: "no signature", secret: secret, body: result, want: http.StatusUnauthorized},
+		{name: "other secret", secret: secret, body: result, signature: sign("guess", result), want: http.StatusUnauthorized},
+		{name: "bare hex", secret: secret, body: result, signature: strings.TrimPrefix(sign(secret, result), signaturePrefix), want: http.StatusUnauthorized},
+		{name: "no timestamp", secret: secret, body: result, timestamp: "-", signature: sign(secret, result), want: http.StatusUnauthorized},
+		{name: "other timestamp", secret: secret, body: result, timestamp: stale, signature: sign(secret, result), want: http.StatusUnauthorized},
+		{name: "stale signature", secret: secret, body: result, timestamp: stale, signature: SignCallback(secret, stale, []byte(result)), want: http.StatusUnauthorized},
+		{name: "bad json", secret: secret, body: `{"order":`, signature: sign(secret, `{"order":`), want: http.StatusBadRequest},
+		{name: "no order", secret: secret, body: `{"status":"NEW"}`, signature: sign(secret, `{"status":"NEW"}`), want: http.StatusBadRequest},
+		{name: "unknown status", secret: secret, body: `{"order":"` + waiting + `","status":"LOST"}`, signature: sign(secret, `{"order":"`+waiting+`","status":"LOST"}`), want: http.StatusBadRequest},
+		{name: "unknown order", secret: secret, body: `{"order":"12345678903","status":"INVALID"}`, signature: sign(secret, `{"order":"12345678903","status":"INVALID"}`), want: http.StatusOK},
+		{name: "processed", secret: secret, body: result, signature: sign(secret, result), want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		config.Cfg.AccrualWebhookSecret = tt.secret
+		req := httptest.NewRequest(http.MethodPost, "/api/internal/accrual/callback", strings.NewReader(tt.body))
+		switch tt.timestamp {
+		case "":
+			req.Header.Set(TimestampHeader, now)
+		case "-":
+		default:
+			req.Header.Set(TimestampHeader, tt.timestamp)
+		}
+		if tt.signature != "" {
+			req.Header.Set(SignatureHeader, tt.signature)
+		}
+		rr := httptest.NewRecorder()
+		service.ServeHTTP(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, rr.Code, tt.want)
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), config.UserID("userID"), "user123")
+	ords, _, err := st.GetOrders(ctx, database.OrderFilter{Statuses: []string{"PROCESSED"}}, database.AllItems)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ords) != 1 || ords[0].Number != processed || ords[0].Accrual == nil || *ords[0].Accrual != 729_98 {
+		t.Errorf("processed orders after callback = %+v", ords)
+	}
+	// the order without a callback is still left to polling
+	polled, err := st.ClaimOrdersForAccrual(context.Background(), database.Claim{At: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(polled) != 1 || polled[0] != waiting {
+		t.Errorf("orders to poll = %v, want [%s]", polled, waiting)
+	}
+}
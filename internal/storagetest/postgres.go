@@ -0,0 +1,70 @@
+package storagetest
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gambruh/gophermart/internal/database"
+)
+
+// DatabaseEnv names the variable with a Postgres uri for the tests that need
+// a real database. They are skipped when it's not set
+const DatabaseEnv = "GOPHERMART_TEST_DATABASE_URI"
+
+// PostgresURI creates an empty schema with all migrations applied and returns
+// the uri of DatabaseEnv pointed at it. The schema is dropped when the test ends
+func PostgresURI(t testing.TB) string {
+	t.Helper()
+	uri := os.Getenv(DatabaseEnv)
+	if uri == "" {
+		t.Skipf("%s is not set", DatabaseEnv)
+	}
+
+	admin, err := sql.Open("postgres", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("storagetest_%d", time.Now().UnixNano())
+	if _, err = admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		defer admin.Close()
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("can't drop schema %s: %v", schema, err)
+		}
+	})
+
+	uri = withSearchPath(uri, schema)
+	db := database.NewSQLdb(uri)
+	defer db.Close()
+	if err = db.InitDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	return uri
+}
+
+// NewPostgres returns a SQLdb working in a fresh schema, see PostgresURI
+func NewPostgres(t testing.TB) *database.SQLdb {
+	t.Helper()
+	db := database.NewSQLdb(PostgresURI(t))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// withSearchPath adds the search_path run-time parameter to a connection
+// string, lib/pq passes unknown parameters on to the server
+func withSearchPath(uri, schema string) string {
+	if !strings.HasPrefix(uri, "postgres://") && !strings.HasPrefix(uri, "postgresql://") {
+		return uri + " search_path=" + schema
+	}
+	if strings.Contains(uri, "?") {
+		return uri + "&search_path=" + schema
+	}
+	return uri + "?search_path=" + schema
+}
@@ -0,0 +1,1615 @@
+// Package storagetest is a conformance suite for the database.Storage and
+// auth.AuthStorage implementations. Every implementation has to give the same
+// results and the same error values for the same calls, so that handlers
+// behave alike whichever storage they run on
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gambruh/gophermart/internal/auth"
+	"github.com/gambruh/gophermart/internal/config"
+	"github.com/gambruh/gophermart/internal/database"
+	"github.com/gambruh/gophermart/internal/helpers"
+)
+
+const password = "secretpass"
+
+// Run runs the suite against storages made by newStorage. Every subtest
+// gets a new empty storage
+func Run(t *testing.T, newStorage func(t *testing.T) database.Storage) {
+	t.Run("Auth", func(t *testing.T) {
+		RunAuth(t, func(t *testing.T) auth.AuthStorage { return newStorage(t) })
+	})
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, st database.Storage)
+	}{
+		{name: "OrderOwnership", test: testOrderOwnership},
+		{name: "GetOrders", test: testGetOrders},
+		{name: "AccrualStatuses", test: testAccrualStatuses},
+		{name: "AccrualUnexpectedStatus", test: testAccrualUnexpectedStatus},
+		{name: "AccrualUnknownOrder", test: testAccrualUnknownOrder},
+		{name: "AccrualSchedule", test: testAccrualSchedule},
+		{name: "AccrualStale", test: testAccrualStale},
+		{name: "AccrualLeases", test: testAccrualLeases},
+		{name: "AccrualConcurrentClaims", test: testAccrualConcurrentClaims},
+		{name: "AccrualReportedTwice", test: testAccrualReportedTwice},
+		{name: "IdempotencyKeys", test: testIdempotencyKeys},
+		{name: "AddAccrualOperation", test: testAddAccrualOperation},
+		{name: "AccrualCreditedOnce", test: testAccrualCreditedOnce},
+		{name: "BalanceMath", test: testBalanceMath},
+		{name: "WithdrawErrors", test: testWithdrawErrors},
+		{name: "WithdrawalsOrder", test: testWithdrawalsOrder},
+		{name: "DeletedUserData", test: testDeletedUserData},
+		{name: "Adjustments", test: testAdjustments},
+		{name: "AdjustmentErrors", test: testAdjustmentErrors},
+		{name: "Refunds", test: testRefunds},
+		{name: "RefundConcurrent", test: testRefundConcurrent},
+		{name: "RecheckOrder", test: testRecheckOrder},
+		{name: "RecheckPendingOrder", test: testRecheckPendingOrder},
+		{name: "Ledger", test: testLedger},
+		{name: "LedgerPages", test: testLedgerPages},
+		{name: "LedgerFilters", test: testLedgerFilters},
+		{name: "OrderPages", test: testOrderPages},
+		{name: "OrderFilters", test: testOrderFilters},
+		{name: "WithdrawalPages", test: testWithdrawalPages},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+// RunAuth runs the users and sessions part of the suite
+func RunAuth(t *testing.T, newStorage func(t *testing.T) auth.AuthStorage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, st auth.AuthStorage)
+	}{
+		{name: "Register", test: testRegister},
+		{name: "RegisterConcurrent", test: testRegisterConcurrent},
+		{name: "VerifyCredentials", test: testVerifyCredentials},
+		{name: "GetPass", test: testGetPass},
+		{name: "Sessions", test: testSessions},
+		{name: "SessionRotation", test: testSessionRotation},
+		{name: "RefreshReuse", test: testRefreshReuse},
+		{name: "RevokeUserSessions", test: testRevokeUserSessions},
+		{name: "ChangePassword", test: testChangePassword},
+		{name: "DeleteUser", test: testDeleteUser},
+		{name: "Roles", test: testRoles},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+// LuhnNumber appends a Luhn check digit to base
+func LuhnNumber(base int64) string {
+	digits := strconv.FormatInt(base, 10)
+	for d := 0; d < 10; d++ {
+		number := digits + strconv.Itoa(d)
+		if helpers.LuhnCheck(number) {
+			return number
+		}
+	}
+	panic("unreachable")
+}
+
+func userCtx(login string) context.Context {
+	return context.WithValue(context.Background(), config.UserID("userID"), login)
+}
+
+func register(t *testing.T, st auth.AuthStorage, logins ...string) {
+	t.Helper()
+	for _, login := range logins {
+		if err := st.Register(login, password); err != nil {
+			t.Fatalf("Register(%q) error = %v", login, err)
+		}
+	}
+}
+
+func setOrders(t *testing.T, st database.Storage, login string, numbers ...string) {
+	t.Helper()
+	for _, number := range numbers {
+		if err := st.SetOrder(number, login); err != nil {
+			t.Fatalf("SetOrder(%q, %q) error = %v", number, login, err)
+		}
+	}
+}
+
+func processed(number string, accrual database.Money) database.ProcessedOrder {
+	return database.ProcessedOrder{Number: number, Status: "PROCESSED", Accrual: &accrual}
+}
+
+func updateAccrual(t *testing.T, st database.Storage, ords ...database.ProcessedOrder) {
+	t.Helper()
+	if err := st.UpdateAccrual(ords); err != nil {
+		t.Fatalf("UpdateAccrual() error = %v", err)
+	}
+}
+
+// credit gives the user sum points through a processed order
+func credit(t *testing.T, st database.Storage, login string, base int64, sum database.Money) {
+	t.Helper()
+	number := LuhnNumber(base)
+	setOrders(t, st, login, number)
+	updateAccrual(t, st, processed(number, sum))
+}
+
+func checkBalance(t *testing.T, st database.Storage, login string, want database.Balance) {
+	t.Helper()
+	got, err := st.GetBalance(userCtx(login))
+	if err != nil {
+		t.Fatalf("GetBalance(%q) error = %v", login, err)
+	}
+	if got != want {
+		t.Errorf("GetBalance(%q) = %+v, want %+v", login, got, want)
+	}
+}
+
+// ordersByNumber returns the user's orders keyed by number
+func ordersByNumber(t *testing.T, st database.Storage, login string) map[string]database.Order {
+	t.Helper()
+	ords, _, err := st.GetOrders(userCtx(login), database.OrderFilter{}, database.AllItems)
+	if err != nil {
+		t.Fatalf("GetOrders(%q) error = %v", login, err)
+	}
+	res := make(map[string]database.Order, len(ords))
+	for _, o := range ords {
+		res[o.Number] = o
+	}
+	return res
+}
+
+// ordersForAccrual claims every pending order, without a schedule they stay due
+func ordersForAccrual(t *testing.T, st database.Storage) []string {
+	t.Helper()
+	numbers, err := st.ClaimOrdersForAccrual(context.Background(), database.Claim{At: time.Now()})
+	if err != nil {
+		t.Fatalf("ClaimOrdersForAccrual() error = %v", err)
+	}
+	sort.Strings(numbers)
+	return numbers
+}
+
+func testRegister(t *testing.T, st auth.AuthStorage) {
+	register(t, st, "alice")
+	if err := st.Register("alice", "another"); !errors.Is(err, auth.ErrUsernameIsTaken) {
+		t.Errorf("second Register() error = %v, want %v", err, auth.ErrUsernameIsTaken)
+	}
+	// the first registration stays in force
+	if err := st.VerifyCredentials("alice", password); err != nil {
+		t.Errorf("VerifyCredentials() error = %v", err)
+	}
+}
+
+func testRegisterConcurrent(t *testing.T, st auth.AuthStorage) {
+	const attempts = 8
+	errs := make(chan error, attempts)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- st.Register("alice", password)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	registered := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			registered++
+		case !errors.Is(err, auth.ErrUsernameIsTaken):
+			t.Errorf("Register() error = %v, want nil or %v", err, auth.ErrUsernameIsTaken)
+		}
+	}
+	if registered != 1 {
+		t.Errorf("user registered %d times, want once", registered)
+	}
+}
+
+func testVerifyCredentials(t *testing.T, st auth.AuthStorage) {
+	register(t, st, "alice")
+	tests := []struct {
+		login    string
+		password string
+		want     error
+	}{
+		{login: "alice", password: password},
+		{login: "alice", password: "wrong", want: auth.ErrWrongPassword},
+		{login: "bob", password: password, want: auth.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		if err := st.VerifyCredentials(tt.login, tt.password); !errors.Is(err, tt.want) {
+			t.Errorf("VerifyCredentials(%q, %q) error = %v, want %v", tt.login, tt.password, err, tt.want)
+		}
+	}
+}
+
+func testGetPass(t *testing.T, st auth.AuthStorage) {
+	register(t, st, "alice")
+	hash, err := st.GetPass("alice")
+	if err != nil {
+		t.Fatalf("GetPass() error = %v", err)
+	}
+	if hash == "" || hash == password {
+		t.Errorf("GetPass() = %q, want a password hash", hash)
+	}
+	if _, err = st.GetPass("bob"); !errors.Is(err, auth.ErrUserNotFound) {
+		t.Errorf("GetPass() of unknown user error = %v, want %v", err, auth.ErrUserNotFound)
+	}
+}
+
+func newSession(t *testing.T, st auth.AuthStorage, login, id string) auth.Session {
+	t.Helper()
+	s := auth.Session{
+		ID:          id,
+		Login:       login,
+		RefreshHash: auth.HashToken(id + "-refresh"),
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+	if err := st.CreateSession(context.Background(), s); err != nil {
+		t.Fatalf("CreateSession(%q) error = %v", id, err)
+	}
+	return s
+}
+
+func checkSession(t *testing.T, st auth.AuthStorage, id string, want error) {
+	t.Helper()
+	if err := st.CheckSession(context.Background(), id); !errors.Is(err, want) {
+		t.Errorf("CheckSession(%q) error = %v, want %v", id, err, want)
+	}
+}
+
+func testSessions(t *testing.T, st auth.AuthStorage) {
+	ctx := context.Background()
+	register(t, st, "alice")
+	newSession(t, st, "alice", "s1")
+	newSession(t, st, "alice", "s2")
+	checkSession(t, st, "s1", nil)
+	checkSession(t, st, "nope", auth.ErrSessionNotFound)
+
+	err := st.CreateSession(ctx, auth.Session{ID: "s3", Login: "bob", RefreshHash: "h", ExpiresAt: time.Now().Add(time.Hour)})
+	if !errors.Is(err, auth.ErrUserNotFound) {
+		t.Errorf("CreateSession() for unknown user error = %v, want %v", err, auth.ErrUserNotFound)
+	}
+
+	expired := auth.Session{ID: "s4", Login: "alice", RefreshHash: auth.HashToken("old"), ExpiresAt: time.Now().Add(-time.Minute)}
+	if err = st.CreateSession(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	checkSession(t, st, "s4", auth.ErrSessionRevoked)
+	if _, err = st.RotateSession(ctx, expired.RefreshHash, "new", time.Now().Add(time.Hour)); !errors.Is(err, auth.ErrSessionNotFound) {
+		t.Errorf("RotateSession() of expired session error = %v, want %v", err, auth.ErrSessionNotFound)
+	}
+
+	if err = st.RevokeSession(ctx, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	checkSession(t, st, "s1", auth.ErrSessionRevoked)
+	checkSession(t, st, "s2", nil)
+}
+
+func testSessionRotation(t *testing.T, st auth.AuthStorage) {
+	ctx := context.Background()
+	register(t, st, "alice")
+	s := newSession(t, st, "alice", "s1")
+
+	expires := time.Now().Add(2 * time.Hour)
+	got, err := st.RotateSession(ctx, s.RefreshHash, auth.HashToken("second"), expires)
+	if err != nil {
+		t.Fatalf("RotateSession() error = %v", err)
+	}
+	if got.ID != "s1" || got.Login != "alice" {
+		t.Errorf("RotateSession() = %+v, want session s1 of alice", got)
+	}
+	if _, err = st.RotateSession(ctx, auth.HashToken("second"), auth.HashToken("third"), expires); err != nil {
+		t.Fatalf("second RotateSession() error = %v", err)
+	}
+	checkSession(t, st, "s1", nil)
+
+	if _, err = st.RotateSession(ctx, auth.HashToken("unknown"), auth.HashToken("fourth"), expires); !errors.Is(err, auth.ErrSessionNotFound) {
+		t.Errorf("RotateSession() of unknown token error = %v, want %v", err, auth.ErrSessionNotFound)
+	}
+
+	if err = st.RevokeSession(ctx, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = st.RotateSession(ctx, auth.HashToken("third"), auth.HashToken("fourth"), expires); !errors.Is(err, auth.ErrSessionNotFound) {
+		t.Errorf("RotateSession() of revoked session error = %v, want %v", err, auth.ErrSessionNotFound)
+	}
+}
+
+func testRefreshReuse(t *testing.T, st auth.AuthStorage) {
+	ctx := context.Background()
+	register(t, st, "alice")
+	s := newSession(t, st, "alice", "s1")
+	other := newSession(t, st, "alice", "s2")
+
+	expires := time.Now().Add(time.Hour)
+	if _, err := st.RotateSession(ctx, s.RefreshHash, auth.HashToken("second"), expires); err != nil {
+		t.Fatal(err)
+	}
+	// the rotated token is presented once more: somebody else has a copy
+	if _, err := st.RotateSession(ctx, s.RefreshHash, auth.HashToken("third"), expires); !errors.Is(err, auth.ErrRefreshReused) {
+		t.Errorf("RotateSession() with reused token error = %v, want %v", err, auth.ErrRefreshReused)
+	}
+	checkSession(t, st, "s1", auth.ErrSessionRevoked)
+	if _, err := st.RotateSession(ctx, auth.HashToken("second"), auth.HashToken("third"), expires); err == nil {
+		t.Error("session revoked for token reuse can still be refreshed")
+	}
+	checkSession(t, st, other.ID, nil)
+}
+
+func testRevokeUserSessions(t *testing.T, st auth.AuthStorage) {
+	register(t, st, "alice", "bob")
+	newSession(t, st, "alice", "s1")
+	newSession(t, st, "alice", "s2")
+	newSession(t, st, "bob", "s3")
+
+	if err := st.RevokeUserSessions(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	checkSession(t, st, "s1", auth.ErrSessionRevoked)
+	checkSession(t, st, "s2", auth.ErrSessionRevoked)
+	checkSession(t, st, "s3", nil)
+}
+
+func testChangePassword(t *testing.T, st auth.AuthStorage) {
+	register(t, st, "alice", "bob")
+	if err := st.ChangePassword("alice", "newpass"); err != nil {
+		t.Fatalf("ChangePassword() error = %v", err)
+	}
+	if err := st.VerifyCredentials("alice", password); !errors.Is(err, auth.ErrWrongPassword) {
+		t.Errorf("VerifyCredentials() with the old password error = %v, want %v", err, auth.ErrWrongPassword)
+	}
+	if err := st.VerifyCredentials("alice", "newpass"); err != nil {
+		t.Errorf("VerifyCredentials() with the new password error = %v", err)
+	}
+	if err := st.VerifyCredentials("bob", password); err != nil {
+		t.Errorf("password of another user changed: %v", err)
+	}
+	if err := st.ChangePassword("carol", "newpass"); !errors.Is(err, auth.ErrUserNotFound) {
+		t.Errorf("ChangePassword() of unknown user error = %v, want %v", err, auth.ErrUserNotFound)
+	}
+}
+
+func testDeleteUser(t *testing.T, st auth.AuthStorage) {
+	register(t, st, "alice", "bob")
+	newSession(t, st, "alice", "s1")
+	newSession(t, st, "bob", "s2")
+
+	if err := st.DeleteUser("alice"); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	if err := st.VerifyCredentials("alice", password); !errors.Is(err, auth.ErrUserNotFound) {
+		t.Errorf("VerifyCredentials() of deleted user error = %v, want %v", err, auth.ErrUserNotFound)
+	}
+	checkSession(t, st, "s1", auth.ErrSessionNotFound)
+	checkSession(t, st, "s2", nil)
+	if err := st.DeleteUser("alice"); !errors.Is(err, auth.ErrUserNotFound) {
+		t.Errorf("second DeleteUser() error = %v, want %v", err, auth.ErrUserNotFound)
+	}
+
+	// the login is free again
+	register(t, st, "alice")
+}
+
+func testRoles(t *testing.T, st auth.AuthStorage) {
+	ctx := context.Background()
+	register(t, st, "bob", "alice")
+
+	if err := st.SetRoles(ctx, "alice", []string{auth.RoleAdmin, auth.RoleAdmin}); err != nil {
+		t.Fatalf("SetRoles() error = %v", err)
+	}
+	roles, err := st.GetRoles(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetRoles() error = %v", err)
+	}
+	if !reflect.DeepEqual(roles, []string{auth.RoleAdmin}) {
+		t.Errorf("GetRoles() = %v, want %v", roles, []string{auth.RoleAdmin})
+	}
+	if roles, err = st.GetRoles(ctx, "bob"); err != nil || len(roles) != 0 {
+		t.Errorf("GetRoles() of a user without roles = %v, %v", roles, err)
+	}
+
+	users, err := st.ListUsers(ctx)
+	if err != nil {
+		t.Fatalf("ListUsers() error = %v", err)
+	}
+	want := []auth.User{{Login: "alice", Roles: []string{auth.RoleAdmin}}, {Login: "bob", Roles: []string{}}}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("ListUsers() = %+v, want %+v", users, want)
+	}
+
+	tests := []struct {
+		name  string
+		login string
+		roles []string
+		want  error
+	}{
+		{name: "unknown role", login: "bob", roles: []string{"root"}, want: auth.ErrUnknownRole},
+		{name: "unknown user", login: "carol", roles: []string{auth.RoleAdmin}, want: auth.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		if err = st.SetRoles(ctx, tt.login, tt.roles); !errors.Is(err, tt.want) {
+			t.Errorf("%s: SetRoles() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if _, err = st.GetRoles(ctx, "carol"); !errors.Is(err, auth.ErrUserNotFound) {
+		t.Errorf("GetRoles() of unknown user error = %v, want %v", err, auth.ErrUserNotFound)
+	}
+
+	// revoking works too
+	if err = st.SetRoles(ctx, "alice", nil); err != nil {
+		t.Fatalf("SetRoles() error = %v", err)
+	}
+	if roles, err = st.GetRoles(ctx, "alice"); err != nil || len(roles) != 0 {
+		t.Errorf("GetRoles() after revoking = %v, %v", roles, err)
+	}
+}
+
+func testOrderOwnership(t *testing.T, st database.Storage) {
+	register(t, st, "alice", "bob")
+	setOrders(t, st, "alice", "12345678903")
+
+	tests := []struct {
+		login string
+		want  error
+	}{
+		{login: "alice", want: database.ErrOrderLoadedThisUser},
+		{login: "bob", want: database.ErrOrderLoadedAnotherUser},
+		{login: "carol", want: database.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		if err := st.SetOrder("12345678903", tt.login); !errors.Is(err, tt.want) {
+			t.Errorf("SetOrder() by %q error = %v, want %v", tt.login, err, tt.want)
+		}
+	}
+
+	if _, _, err := st.GetOrders(userCtx("bob"), database.OrderFilter{}, database.AllItems); !errors.Is(err, database.ErrNoOrders) {
+		t.Errorf("GetOrders() of bob error = %v, want %v", err, database.ErrNoOrders)
+	}
+}
+
+func testGetOrders(t *testing.T, st database.Storage) {
+	register(t, st, "alice", "bob")
+	if _, _, err := st.GetOrders(userCtx("alice"), database.OrderFilter{}, database.AllItems); !errors.Is(err, database.ErrNoOrders) {
+		t.Errorf("GetOrders() without orders error = %v, want %v", err, database.ErrNoOrders)
+	}
+
+	before := time.Now().Add(-time.Second)
+	setOrders(t, st, "alice", "12345678903", "9278923470")
+	setOrders(t, st, "bob", "346436439")
+	after := time.Now().Add(time.Second)
+
+	got := ordersByNumber(t, st, "alice")
+	if len(got) != 2 {
+		t.Fatalf("GetOrders() returned %d orders, want 2", len(got))
+	}
+	for _, number := range []string{"12345678903", "9278923470"} {
+		o, ok := got[number]
+		switch {
+		case !ok:
+			t.Errorf("order %s is missing", number)
+		case o.Status != "NEW" || o.Accrual != nil:
+			t.Errorf("new order = %+v, want status NEW without accrual", o)
+		case o.UploadedAt.Before(before) || o.UploadedAt.After(after):
+			t.Errorf("order uploaded at %v, want between %v and %v", o.UploadedAt, before, after)
+		}
+	}
+}
+
+func testAccrualStatuses(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	setOrders(t, st, "alice", "1", "2", "3", "4", "5")
+	if got, want := ordersForAccrual(t, st), []string{"1", "2", "3", "4", "5"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ClaimOrdersForAccrual() = %v, want %v", got, want)
+	}
+
+	updateAccrual(t, st,
+		database.ProcessedOrder{Number: "1", Status: "REGISTERED"},
+		database.ProcessedOrder{Number: "2", Status: "PROCESSING"},
+		processed("3", 729_98),
+		database.ProcessedOrder{Number: "4", Status: "INVALID"},
+		database.ProcessedOrder{Number: "5", Status: "PROCESSED"},
+	)
+
+	var accrual database.Money = 729_98
+	want := map[string]database.Order{
+		"1": {Number: "1", Status: "PROCESSING"},
+		"2": {Number: "2", Status: "PROCESSING"},
+		"3": {Number: "3", Status: "PROCESSED", Accrual: &accrual},
+		"4": {Number: "4", Status: "INVALID"},
+		"5": {Number: "5", Status: "PROCESSED"},
+	}
+	for number, o := range ordersByNumber(t, st, "alice") {
+		w := want[number]
+		if o.Status != w.Status || !reflect.DeepEqual(o.Accrual, w.Accrual) {
+			t.Errorf("order %s has status %s and accrual %v, want %s and %v",
+				number, o.Status, o.Accrual, w.Status, w.Accrual)
+		}
+	}
+
+	// orders in a final status are not polled any more
+	if got, want := ordersForAccrual(t, st), []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ClaimOrdersForAccrual() = %v, want %v", got, want)
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 729_98})
+}
+
+func testAccrualUnexpectedStatus(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	setOrders(t, st, "alice", "1", "2", "3")
+
+	// one bad result doesn't cost the rest of the batch
+	err := st.UpdateAccrual([]database.ProcessedOrder{
+		processed("1", 100_00),
+		{Number: "2", Status: "LOST"},
+		processed("3", 10_00),
+	})
+	if !errors.Is(err, database.ErrUnexpectedStatus) {
+		t.Fatalf("UpdateAccrual() error = %v, want %v", err, database.ErrUnexpectedStatus)
+	}
+
+	want := map[string]string{"1": "PROCESSED", "2": "NEW", "3": "PROCESSED"}
+	for number, o := range ordersByNumber(t, st, "alice") {
+		if o.Status != want[number] {
+			t.Errorf("order %s has status %s, want %s", number, o.Status, want[number])
+		}
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 110_00})
+}
+
+func testAccrualUnknownOrder(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	setOrders(t, st, "alice", "1")
+
+	updateAccrual(t, st, processed("404", 100_00), processed("1", 10_00))
+
+	if o := ordersByNumber(t, st, "alice")["1"]; o.Status != "PROCESSED" {
+		t.Errorf("order 1 has status %s, want PROCESSED", o.Status)
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 10_00})
+}
+
+func testAddAccrualOperation(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	setOrders(t, st, "alice", "1", "2")
+
+	var zero database.Money
+	err := st.AddAccrualOperation([]database.ProcessedOrder{
+		processed("1", 15_50),
+		{Number: "2", Status: "PROCESSED", Accrual: &zero},
+		{Number: "2", Status: "PROCESSING"},
+	})
+	if err != nil {
+		t.Fatalf("AddAccrualOperation() error = %v", err)
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 15_50})
+
+	err = st.AddAccrualOperation([]database.ProcessedOrder{processed("404", 1_00)})
+	if !errors.Is(err, database.ErrWrongOrder) {
+		t.Errorf("AddAccrualOperation() for unknown order error = %v, want %v", err, database.ErrWrongOrder)
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 15_50})
+}
+
+func testBalanceMath(t *testing.T, st database.Storage) {
+	register(t, st, "alice", "bob")
+	checkBalance(t, st, "alice", database.Balance{})
+
+	credit(t, st, "alice", 100, 100_50)
+	credit(t, st, "alice", 101, 200_25)
+	credit(t, st, "bob", 102, 1_00)
+	checkBalance(t, st, "alice", database.Balance{Current: 300_75})
+
+	withdrawals := []struct {
+		sum  database.Money
+		want database.Balance
+	}{
+		{sum: 50_75, want: database.Balance{Current: 250_00, Withdrawn: 50_75}},
+		{sum: 0_01, want: database.Balance{Current: 249_99, Withdrawn: 50_76}},
+		{sum: 249_99, want: database.Balance{Current: 0, Withdrawn: 300_75}},
+	}
+	for i, w := range withdrawals {
+		err := st.Withdraw(userCtx("alice"), database.WithdrawQ{Order: LuhnNumber(200 + int64(i)), Sum: w.sum})
+		if err != nil {
+			t.Fatalf("Withdraw(%v) error = %v", w.sum, err)
+		}
+		checkBalance(t, st, "alice", w.want)
+	}
+	checkBalance(t, st, "bob", database.Balance{Current: 1_00})
+}
+
+func testWithdrawErrors(t *testing.T, st database.Storage) {
+	register(t, st, "alice", "bob")
+	credit(t, st, "alice", 100, 100_00)
+	taken := LuhnNumber(300)
+	setOrders(t, st, "bob", taken)
+
+	tests := []struct {
+		name  string
+		login string
+		q     database.WithdrawQ
+		want  error
+	}{
+		{name: "not a Luhn number", login: "alice", q: database.WithdrawQ{Order: "12345678900", Sum: 1_00}, want: database.ErrWrongOrder},
+		{name: "zero sum", login: "alice", q: database.WithdrawQ{Order: LuhnNumber(201), Sum: 0}, want: database.ErrWrongSum},
+		{name: "negative sum", login: "alice", q: database.WithdrawQ{Order: LuhnNumber(202), Sum: -1_00}, want: database.ErrWrongSum},
+		{name: "too much", login: "alice", q: database.WithdrawQ{Order: LuhnNumber(203), Sum: 100_01}, want: database.ErrInsufficientFunds},
+		{name: "taken number", login: "alice", q: database.WithdrawQ{Order: taken, Sum: 1_00}, want: database.ErrWrongOrder},
+		{name: "uploaded number", login: "alice", q: database.WithdrawQ{Order: LuhnNumber(100), Sum: 1_00}, want: database.ErrWrongOrder},
+		{name: "unknown user", login: "carol", q: database.WithdrawQ{Order: LuhnNumber(204), Sum: 1_00}, want: database.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		if err := st.Withdraw(userCtx(tt.login), tt.q); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Withdraw() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	checkBalance(t, st, "alice", database.Balance{Current: 100_00})
+	if _, _, err := st.GetWithdrawals(userCtx("alice"), database.WithdrawalFilter{}, database.AllItems); !errors.Is(err, database.ErrNoOperations) {
+		t.Errorf("GetWithdrawals() after failed withdrawals error = %v, want %v", err, database.ErrNoOperations)
+	}
+}
+
+func testWithdrawalsOrder(t *testing.T, st database.Storage) {
+	register(t, st, "alice", "bob")
+	credit(t, st, "alice", 100, 100_00)
+	credit(t, st, "bob", 101, 100_00)
+
+	sums := []database.Money{30_00, 10_50, 20_00, 0_25}
+	var want []string
+	for i, sum := range sums {
+		number := LuhnNumber(200 + int64(i))
+		want = append(want, number)
+		if err := st.Withdraw(userCtx("alice"), database.WithdrawQ{Order: number, Sum: sum}); err != nil {
+			t.Fatalf("Withdraw() error = %v", err)
+		}
+	}
+	if err := st.Withdraw(userCtx("bob"), database.WithdrawQ{Order: LuhnNumber(300), Sum: 1_00}); err != nil {
+		t.Fatalf("Withdraw() error = %v", err)
+	}
+
+	ops, _, err := st.GetWithdrawals(userCtx("alice"), database.WithdrawalFilter{}, database.AllItems)
+	if err != nil {
+		t.Fatalf("GetWithdrawals() error = %v", err)
+	}
+	var got []string
+	for i, op := range ops {
+		got = append(got, op.Order)
+		if i < len(sums) && op.Accrual != sums[i] {
+			t.Errorf("withdrawal %s of %v, want %v", op.Order, op.Accrual, sums[i])
+		}
+		if op.ProcessedAt.IsZero() {
+			t.Errorf("withdrawal %s has no processing time", op.Order)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetWithdrawals() returned %v, want %v in order of withdrawal", got, want)
+	}
+}
+
+func testDeletedUserData(t *testing.T, st database.Storage) {
+	register(t, st, "alice", "bob")
+	credit(t, st, "alice", 100, 50_00)
+	if err := st.Withdraw(userCtx("alice"), database.WithdrawQ{Order: LuhnNumber(200), Sum: 20_00}); err != nil {
+		t.Fatal(err)
+	}
+	credit(t, st, "bob", 101, 10_00)
+
+	if err := st.DeleteUser("alice"); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	checkBalance(t, st, "bob", database.Balance{Current: 10_00})
+
+	// a new user with the same login starts from scratch
+	register(t, st, "alice")
+	checkBalance(t, st, "alice", database.Balance{})
+	if _, _, err := st.GetOrders(userCtx("alice"), database.OrderFilter{}, database.AllItems); !errors.Is(err, database.ErrNoOrders) {
+		t.Errorf("GetOrders() error = %v, want %v", err, database.ErrNoOrders)
+	}
+	if _, _, err := st.GetWithdrawals(userCtx("alice"), database.WithdrawalFilter{}, database.AllItems); !errors.Is(err, database.ErrNoOperations) {
+		t.Errorf("GetWithdrawals() error = %v, want %v", err, database.ErrNoOperations)
+	}
+
+	// order numbers of the deleted user can be uploaded again
+	setOrders(t, st, "bob", LuhnNumber(100))
+	if o := ordersByNumber(t, st, "bob")[LuhnNumber(100)]; o.Status != "NEW" {
+		t.Errorf("reuploaded order = %+v, want a new one", o)
+	}
+	updateAccrual(t, st, database.ProcessedOrder{Number: LuhnNumber(100), Status: "PROCESSED"})
+	if o := ordersByNumber(t, st, "bob")[LuhnNumber(100)]; o.Accrual != nil {
+		t.Errorf("reuploaded order shows accrual %v of the deleted user", *o.Accrual)
+	}
+}
+
+func testAdjustments(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	credit(t, st, "alice", 100, 10_00)
+	if err := st.Withdraw(userCtx("alice"), database.WithdrawQ{Order: LuhnNumber(200), Sum: 4_00}); err != nil {
+		t.Fatal(err)
+	}
+
+	adjustments := []struct {
+		sum  database.Money
+		want database.Balance
+	}{
+		{sum: 5_50, want: database.Balance{Current: 11_50, Withdrawn: 4_00}},
+		// taking points back isn't a withdrawal
+		{sum: -11_50, want: database.Balance{Current: 0, Withdrawn: 4_00}},
+	}
+	for _, a := range adjustments {
+		err := st.AdjustBalance(context.Background(), database.Adjustment{Login: "alice", Sum: a.sum, Reason: "support ticket", Actor: "root"})
+		if err != nil {
+			t.Fatalf("AdjustBalance(%v) error = %v", a.sum, err)
+		}
+		checkBalance(t, st, "alice", a.want)
+	}
+
+	withdrawals, _, err := st.GetWithdrawals(userCtx("alice"), database.WithdrawalFilter{}, database.AllItems)
+	if err != nil {
+		t.Fatalf("GetWithdrawals() error = %v", err)
+	}
+	if len(withdrawals) != 1 {
+		t.Errorf("GetWithdrawals() = %+v, adjustments mustn't be listed", withdrawals)
+	}
+
+	ops, err := st.GetOperations(userCtx("alice"))
+	if err != nil {
+		t.Fatalf("GetOperations() error = %v", err)
+	}
+	var types []string
+	for _, op := range ops {
+		types = append(types, op.Type)
+	}
+	wantTypes := []string{database.OperationAccrual, database.OperationWithdrawal, database.OperationAdjustment, database.OperationAdjustment}
+	if !reflect.DeepEqual(types, wantTypes) {
+		t.Fatalf("GetOperations() types = %v, want %v", types, wantTypes)
+	}
+	adj := ops[2]
+	if adj.Sum != 5_50 || adj.Kind != database.AdjustmentCorrection || adj.Reason != "support ticket" || adj.Actor != "root" || adj.Order != "" {
+		t.Errorf("adjustment = %+v", adj)
+	}
+	if ops[0].Order != LuhnNumber(100) || ops[0].Sum != 10_00 || ops[1].Sum != -4_00 {
+		t.Errorf("operations = %+v", ops)
+	}
+	for i := 1; i < len(ops); i++ {
+		if ops[i].ID <= ops[i-1].ID {
+			t.Errorf("operation ids %d, %d aren't increasing", ops[i-1].ID, ops[i].ID)
+		}
+	}
+}
+
+func testAdjustmentErrors(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	credit(t, st, "alice", 100, 10_00)
+
+	tests := []struct {
+		name string
+		adj  database.Adjustment
+		want error
+	}{
+		{name: "zero sum", adj: database.Adjustment{Login: "alice", Reason: "r", Actor: "root"}, want: database.ErrZeroAdjustment},
+		{name: "no reason", adj: database.Adjustment{Login: "alice", Sum: 1_00, Reason: "  ", Actor: "root"}, want: database.ErrNoReason},
+		{name: "below zero", adj: database.Adjustment{Login: "alice", Sum: -10_01, Reason: "r", Actor: "root"}, want: database.ErrInsufficientFunds},
+		{name: "unknown user", adj: database.Adjustment{Login: "carol", Sum: 1_00, Reason: "r", Actor: "root"}, want: database.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		if err := st.AdjustBalance(context.Background(), tt.adj); !errors.Is(err, tt.want) {
+			t.Errorf("%s: AdjustBalance() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 10_00})
+
+	// a user without operations has no balance row yet
+	register(t, st, "bob")
+	err := st.AdjustBalance(context.Background(), database.Adjustment{Login: "bob", Sum: -1_00, Reason: "r", Actor: "root"})
+	if !errors.Is(err, database.ErrInsufficientFunds) {
+		t.Errorf("AdjustBalance() of an empty balance error = %v, want %v", err, database.ErrInsufficientFunds)
+	}
+	if err = st.AdjustBalance(context.Background(), database.Adjustment{Login: "bob", Sum: 1_00, Reason: "r", Actor: "root"}); err != nil {
+		t.Fatalf("AdjustBalance() error = %v", err)
+	}
+	checkBalance(t, st, "bob", database.Balance{Current: 1_00})
+}
+
+func testRefunds(t *testing.T, st database.Storage) {
+	register(t, st, "alice", "bob")
+	credit(t, st, "alice", 100, 100_00)
+	credit(t, st, "bob", 101, 100_00)
+	first, second, bobs := LuhnNumber(200), LuhnNumber(201), LuhnNumber(202)
+	for _, w := range []struct {
+		login  string
+		number string
+		sum    database.Money
+	}{{"alice", first, 30_00}, {"alice", second, 20_00}, {"bob", bobs, 10_00}} {
+		if err := st.Withdraw(userCtx(w.login), database.WithdrawQ{Order: w.number, Sum: w.sum}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	refund := database.Refund{Login: "alice", Order: first, Reason: "order cancelled", Actor: "root"}
+	if err := st.RefundWithdrawal(context.Background(), refund); err != nil {
+		t.Fatalf("RefundWithdrawal() error = %v", err)
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 80_00, Withdrawn: 20_00})
+	checkBalance(t, st, "bob", database.Balance{Current: 90_00, Withdrawn: 10_00})
+
+	withdrawals, _, err := st.GetWithdrawals(userCtx("alice"), database.WithdrawalFilter{}, database.AllItems)
+	if err != nil {
+		t.Fatalf("GetWithdrawals() error = %v", err)
+	}
+	if len(withdrawals) != 1 || withdrawals[0].Order != second {
+		t.Errorf("GetWithdrawals() = %+v, want only %s", withdrawals, second)
+	}
+
+	tests := []struct {
+		name   string
+		refund database.Refund
+		want   error
+	}{
+		{name: "twice", refund: refund, want: database.ErrAlreadyRefunded},
+		{name: "no reason", refund: database.Refund{Login: "alice", Order: second, Actor: "root"}, want: database.ErrNoReason},
+		{name: "accrual order", refund: database.Refund{Login: "alice", Order: LuhnNumber(100), Reason: "r", Actor: "root"}, want: database.ErrWithdrawalNotFound},
+		{name: "another user's withdrawal", refund: database.Refund{Login: "alice", Order: bobs, Reason: "r", Actor: "root"}, want: database.ErrWithdrawalNotFound},
+		{name: "unknown user", refund: database.Refund{Login: "carol", Order: first, Reason: "r", Actor: "root"}, want: database.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		if err = st.RefundWithdrawal(context.Background(), tt.refund); !errors.Is(err, tt.want) {
+			t.Errorf("%s: RefundWithdrawal() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 80_00, Withdrawn: 20_00})
+
+	ops, err := st.GetOperations(userCtx("alice"))
+	if err != nil {
+		t.Fatalf("GetOperations() error = %v", err)
+	}
+	last := ops[len(ops)-1]
+	if last.Type != database.OperationRefund || last.Kind != database.AdjustmentRefund ||
+		last.RefID != ops[1].ID || last.Order != first || last.Sum != 30_00 || last.Actor != "root" {
+		t.Errorf("refund = %+v, want a refund of operation %+v", last, ops[1])
+	}
+}
+
+func testRefundConcurrent(t *testing.T, st database.Storage) {
+	const refunds = 10
+	register(t, st, "alice")
+	credit(t, st, "alice", 100, 100_00)
+	number := LuhnNumber(200)
+	if err := st.Withdraw(userCtx("alice"), database.WithdrawQ{Order: number, Sum: 40_00}); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, refunds)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < refunds; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- st.RefundWithdrawal(context.Background(), database.Refund{Login: "alice", Order: number, Reason: "r", Actor: "root"})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, database.ErrAlreadyRefunded):
+			t.Errorf("RefundWithdrawal() error = %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d refunds of one withdrawal succeeded, want 1", succeeded)
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 100_00})
+}
+
+func testRecheckOrder(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	invalid, waiting, done := LuhnNumber(100), LuhnNumber(101), LuhnNumber(102)
+	setOrders(t, st, "alice", invalid, waiting, done)
+	updateAccrual(t, st,
+		database.ProcessedOrder{Number: invalid, Status: "INVALID"},
+		processed(done, 5_00),
+	)
+
+	tests := []struct {
+		number string
+		want   error
+	}{
+		{number: invalid, want: nil},
+		{number: waiting, want: nil},
+		{number: done, want: database.ErrOrderProcessed},
+		{number: LuhnNumber(103), want: database.ErrOrderNotFound},
+	}
+	for _, tt := range tests {
+		if err := st.RecheckOrder(context.Background(), tt.number); !errors.Is(err, tt.want) {
+			t.Errorf("RecheckOrder(%s) error = %v, want %v", tt.number, err, tt.want)
+		}
+	}
+
+	if got, want := ordersForAccrual(t, st), []string{invalid, waiting}; !reflect.DeepEqual(got, want) {
+		t.Errorf("orders for accrual = %v, want %v", got, want)
+	}
+	if o := ordersByNumber(t, st, "alice")[invalid]; o.Status != "PROCESSING" {
+		t.Errorf("rechecked order status = %s, want PROCESSING", o.Status)
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 5_00})
+}
+
+func testRecheckPendingOrder(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	setOrders(t, st, "alice", "1")
+	sched := database.Schedule{Interval: time.Minute, MaxInterval: time.Hour}
+	start := time.Now()
+
+	// the order backs off to checks a few minutes apart
+	at := start
+	for i := 0; i < 3; i++ {
+		if got := claim(t, st, at, 0, sched); len(got) != 1 {
+			t.Fatalf("claim %d = %v, want the order", i, got)
+		}
+		at = at.Add(10 * time.Minute)
+	}
+	at = start.Add(20*time.Minute + time.Second)
+	if got := claim(t, st, at, 0, sched); len(got) != 0 {
+		t.Fatalf("claim before the next check = %v, want none", got)
+	}
+
+	// a recheck has it checked at once and backing off from the start
+	if err := st.RecheckOrder(context.Background(), "1"); err != nil {
+		t.Fatalf("RecheckOrder() error = %v", err)
+	}
+	if got, want := claim(t, st, at, 0, sched), []string{"1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("claim after a recheck = %v, want %v", got, want)
+	}
+	if got, want := claim(t, st, at.Add(time.Minute+time.Second), 0, sched), []string{"1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("claim a minute after the recheck = %v, want %v", got, want)
+	}
+	if o := ordersByNumber(t, st, "alice")["1"]; o.Status != "NEW" {
+		t.Errorf("rechecked order status = %s, want NEW", o.Status)
+	}
+}
+
+// ledger returns a page of the user's ledger
+func ledger(t *testing.T, st database.Storage, login string, filter database.LedgerFilter, page database.Page) ([]database.LedgerEntry, *database.Cursor) {
+	t.Helper()
+	entries, next, err := st.GetLedger(userCtx(login), filter, page)
+	if err != nil {
+		t.Fatalf("GetLedger() error = %v", err)
+	}
+	return entries, next
+}
+
+// ledgerHistory gives alice an operation of every type that can be made
+// through the storage, bob gets one as well
+func ledgerHistory(t *testing.T, st database.Storage) {
+	t.Helper()
+	register(t, st, "alice", "bob")
+	credit(t, st, "alice", 100, 10_00)
+	if err := st.Withdraw(userCtx("alice"), database.WithdrawQ{Order: LuhnNumber(200), Sum: 3_00}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AdjustBalance(context.Background(), database.Adjustment{Login: "alice", Sum: 1_00, Reason: "r", Actor: "root"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.RefundWithdrawal(context.Background(), database.Refund{Login: "alice", Order: LuhnNumber(200), Reason: "r", Actor: "root"}); err != nil {
+		t.Fatal(err)
+	}
+	credit(t, st, "alice", 101, 5_00)
+	credit(t, st, "bob", 102, 7_00)
+}
+
+func testLedger(t *testing.T, st database.Storage) {
+	ledgerHistory(t, st)
+
+	entries, next := ledger(t, st, "alice", database.LedgerFilter{}, database.Page{})
+	if next != nil {
+		t.Errorf("GetLedger() of a single page returned next cursor %v", next)
+	}
+	type row struct {
+		typ     string
+		sum     database.Money
+		balance database.Money
+	}
+	var got []row
+	for _, e := range entries {
+		got = append(got, row{typ: e.Type, sum: e.Sum, balance: e.Balance})
+	}
+	want := []row{
+		{typ: database.OperationAccrual, sum: 5_00, balance: 16_00},
+		{typ: database.OperationRefund, sum: 3_00, balance: 11_00},
+		{typ: database.OperationAdjustment, sum: 1_00, balance: 8_00},
+		{typ: database.OperationWithdrawal, sum: -3_00, balance: 7_00},
+		{typ: database.OperationAccrual, sum: 10_00, balance: 10_00},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetLedger() = %+v, want %+v", got, want)
+	}
+	if len(entries) == len(want) && (entries[4].Order != LuhnNumber(100) || entries[3].Order != LuhnNumber(200)) {
+		t.Errorf("GetLedger() orders = %+v", entries)
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 16_00})
+
+	if entries, _ = ledger(t, st, "carol", database.LedgerFilter{}, database.Page{}); len(entries) != 0 {
+		t.Errorf("GetLedger() of unknown user = %+v", entries)
+	}
+}
+
+func testLedgerPages(t *testing.T, st database.Storage) {
+	ledgerHistory(t, st)
+
+	var (
+		ids   []int64
+		pages int
+		page  = database.Page{Limit: 2}
+	)
+	for {
+		entries, next := ledger(t, st, "alice", database.LedgerFilter{}, page)
+		pages++
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+		if next == nil {
+			break
+		}
+		if pages > 5 {
+			t.Fatal("GetLedger() keeps returning next pages")
+		}
+		// the cursor goes through the client
+		c, err := database.ParseCursor(next.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.After = &c
+	}
+	if pages != 3 || len(ids) != 5 {
+		t.Fatalf("got %d operations on %d pages, want 5 on 3", len(ids), pages)
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] >= ids[i-1] {
+			t.Errorf("operation %d comes after %d, want newest first", ids[i], ids[i-1])
+		}
+	}
+
+	// a full last page has no next one
+	entries, next := ledger(t, st, "alice", database.LedgerFilter{}, database.Page{Limit: 5})
+	if len(entries) != 5 || next != nil {
+		t.Errorf("GetLedger() of exactly one page = %d entries, next %v", len(entries), next)
+	}
+
+	bad := database.Cursor{Time: time.Now(), Key: "not an id"}
+	if _, _, err := st.GetLedger(userCtx("alice"), database.LedgerFilter{}, database.Page{After: &bad}); !errors.Is(err, database.ErrBadCursor) {
+		t.Errorf("GetLedger() with a bad cursor error = %v, want %v", err, database.ErrBadCursor)
+	}
+}
+
+func testLedgerFilters(t *testing.T, st database.Storage) {
+	ledgerHistory(t, st)
+	hour := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		filter database.LedgerFilter
+		want   []database.Money
+	}{
+		{name: "accruals", filter: database.LedgerFilter{Types: []string{database.OperationAccrual}}, want: []database.Money{16_00, 10_00}},
+		{name: "withdrawals and refunds", filter: database.LedgerFilter{Types: []string{database.OperationWithdrawal, database.OperationRefund}}, want: []database.Money{11_00, 7_00}},
+		{name: "expiries", filter: database.LedgerFilter{Types: []string{database.OperationExpiry}}},
+		{name: "last hour", filter: database.LedgerFilter{From: hour}, want: []database.Money{16_00, 11_00, 8_00, 7_00, 10_00}},
+		{name: "till an hour ago", filter: database.LedgerFilter{To: hour}},
+		{name: "next hour", filter: database.LedgerFilter{From: hour.Add(2 * time.Hour), To: hour.Add(3 * time.Hour)}},
+	}
+	for _, tt := range tests {
+		entries, _ := ledger(t, st, "alice", tt.filter, database.Page{})
+		var got []database.Money
+		for _, e := range entries {
+			got = append(got, e.Balance)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: GetLedger() balances = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	errs := []struct {
+		name   string
+		filter database.LedgerFilter
+		want   error
+	}{
+		{name: "unknown type", filter: database.LedgerFilter{Types: []string{"gift"}}, want: database.ErrUnknownOperationType},
+		{name: "empty range", filter: database.LedgerFilter{From: hour, To: hour}, want: database.ErrBadRange},
+	}
+	for _, tt := range errs {
+		if _, _, err := st.GetLedger(userCtx("alice"), tt.filter, database.Page{}); !errors.Is(err, tt.want) {
+			t.Errorf("%s: GetLedger() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// orderNumbers pages through the user's orders and returns their numbers
+func orderNumbers(t *testing.T, st database.Storage, login string, filter database.OrderFilter, limit int) (numbers []string, pages int) {
+	t.Helper()
+	page := database.Page{Limit: limit}
+	for {
+		ords, next, err := st.GetOrders(userCtx(login), filter, page)
+		if errors.Is(err, database.ErrNoOrders) {
+			return numbers, pages
+		}
+		if err != nil {
+			t.Fatalf("GetOrders() error = %v", err)
+		}
+		pages++
+		for _, o := range ords {
+			numbers = append(numbers, o.Number)
+		}
+		if next == nil {
+			return numbers, pages
+		}
+		if pages > 10 {
+			t.Fatal("GetOrders() keeps returning next pages")
+		}
+		// the cursor goes through the client
+		c, err := database.ParseCursor(next.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.After = &c
+	}
+}
+
+func testOrderPages(t *testing.T, st database.Storage) {
+	register(t, st, "alice", "bob")
+	for i := int64(0); i < 5; i++ {
+		setOrders(t, st, "alice", LuhnNumber(900-i*100))
+	}
+	setOrders(t, st, "bob", LuhnNumber(1000))
+
+	all, _, err := st.GetOrders(userCtx("alice"), database.OrderFilter{}, database.AllItems)
+	if err != nil {
+		t.Fatalf("GetOrders() error = %v", err)
+	}
+	for i := 1; i < len(all); i++ {
+		prev, cur := all[i-1], all[i]
+		if cur.UploadedAt.Before(prev.UploadedAt) || cur.UploadedAt.Equal(prev.UploadedAt) && cur.Number < prev.Number {
+			t.Errorf("order %s comes after %s, want oldest first, then by number", cur.Number, prev.Number)
+		}
+	}
+	var want []string
+	for _, o := range all {
+		want = append(want, o.Number)
+	}
+
+	got, pages := orderNumbers(t, st, "alice", database.OrderFilter{}, 2)
+	if pages != 3 || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetOrders() by 2 = %v on %d pages, want %v on 3", got, pages, want)
+	}
+	if got, pages = orderNumbers(t, st, "alice", database.OrderFilter{}, 5); pages != 1 || len(got) != 5 {
+		t.Errorf("GetOrders() of exactly one page = %v on %d pages", got, pages)
+	}
+}
+
+func testOrderFilters(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	setOrders(t, st, "alice", LuhnNumber(100), LuhnNumber(101), LuhnNumber(102))
+	updateAccrual(t, st, processed(LuhnNumber(100), 1_00),
+		database.ProcessedOrder{Number: LuhnNumber(101), Status: "INVALID"})
+	hour := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		filter database.OrderFilter
+		want   []string
+	}{
+		{name: "processed", filter: database.OrderFilter{Statuses: []string{"PROCESSED"}}, want: []string{LuhnNumber(100)}},
+		{name: "new and invalid", filter: database.OrderFilter{Statuses: []string{"NEW", "INVALID"}}, want: []string{LuhnNumber(101), LuhnNumber(102)}},
+		{name: "processing", filter: database.OrderFilter{Statuses: []string{"PROCESSING"}}},
+		{name: "last hour", filter: database.OrderFilter{From: hour}, want: []string{LuhnNumber(100), LuhnNumber(101), LuhnNumber(102)}},
+		{name: "till an hour ago", filter: database.OrderFilter{To: hour}},
+	}
+	for _, tt := range tests {
+		got, _ := orderNumbers(t, st, "alice", tt.filter, database.NoLimit)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: GetOrders() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	errs := []struct {
+		name   string
+		filter database.OrderFilter
+		want   error
+	}{
+		{name: "unknown status", filter: database.OrderFilter{Statuses: []string{"LOST"}}, want: database.ErrUnknownStatus},
+		{name: "empty range", filter: database.OrderFilter{From: hour, To: hour}, want: database.ErrBadRange},
+	}
+	for _, tt := range errs {
+		if _, _, err := st.GetOrders(userCtx("alice"), tt.filter, database.Page{}); !errors.Is(err, tt.want) {
+			t.Errorf("%s: GetOrders() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func testWithdrawalPages(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	credit(t, st, "alice", 100, 100_00)
+	var want []string
+	for i := int64(0); i < 5; i++ {
+		number := LuhnNumber(200 + i)
+		want = append(want, number)
+		if err := st.Withdraw(userCtx("alice"), database.WithdrawQ{Order: number, Sum: 1_00}); err != nil {
+			t.Fatalf("Withdraw() error = %v", err)
+		}
+	}
+
+	var (
+		got   []string
+		pages int
+		page  = database.Page{Limit: 2}
+	)
+	for {
+		ops, next, err := st.GetWithdrawals(userCtx("alice"), database.WithdrawalFilter{}, page)
+		if err != nil {
+			t.Fatalf("GetWithdrawals() error = %v", err)
+		}
+		pages++
+		for _, op := range ops {
+			got = append(got, op.Order)
+		}
+		if next == nil {
+			break
+		}
+		if pages > 5 {
+			t.Fatal("GetWithdrawals() keeps returning next pages")
+		}
+		c, err := database.ParseCursor(next.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.After = &c
+	}
+	if pages != 3 || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetWithdrawals() by 2 = %v on %d pages, want %v on 3", got, pages, want)
+	}
+
+	hour := time.Now().Add(-time.Hour)
+	if _, _, err := st.GetWithdrawals(userCtx("alice"), database.WithdrawalFilter{To: hour}, database.AllItems); !errors.Is(err, database.ErrNoOperations) {
+		t.Errorf("GetWithdrawals() till an hour ago error = %v, want %v", err, database.ErrNoOperations)
+	}
+	if _, _, err := st.GetWithdrawals(userCtx("alice"), database.WithdrawalFilter{From: hour, To: hour}, database.AllItems); !errors.Is(err, database.ErrBadRange) {
+		t.Errorf("GetWithdrawals() with an empty range error = %v, want %v", err, database.ErrBadRange)
+	}
+	bad := database.Cursor{Time: time.Now(), Key: "not an id"}
+	if _, _, err := st.GetWithdrawals(userCtx("alice"), database.WithdrawalFilter{}, database.Page{After: &bad}); !errors.Is(err, database.ErrBadCursor) {
+		t.Errorf("GetWithdrawals() with a bad cursor error = %v, want %v", err, database.ErrBadCursor)
+	}
+}
+
+// claim returns the orders claimed at the time
+func claim(t *testing.T, st database.Storage, at time.Time, limit int, sched database.Schedule) []string {
+	t.Helper()
+	numbers, err := st.ClaimOrdersForAccrual(context.Background(), database.Claim{At: at, Limit: limit, Schedule: sched})
+	if err != nil {
+		t.Fatalf("ClaimOrdersForAccrual() error = %v", err)
+	}
+	sort.Strings(numbers)
+	return numbers
+}
+
+func testAccrualSchedule(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	setOrders(t, st, "alice", "1", "2", "3")
+	updateAccrual(t, st, database.ProcessedOrder{Number: "3", Status: "INVALID"})
+	sched := database.Schedule{Interval: time.Minute, MaxInterval: 4 * time.Minute}
+	start := time.Now().Truncate(time.Second)
+
+	// the checks come 1, 2, 4 and then again 4 minutes apart
+	tests := []struct {
+		after time.Duration
+		want  []string
+	}{
+		{after: 0, want: []string{"1", "2"}},
+		{after: 0},
+		{after: 59 * time.Second},
+		{after: time.Minute, want: []string{"1", "2"}},
+		{after: 2 * time.Minute},
+		{after: 3 * time.Minute, want: []string{"1", "2"}},
+		{after: 6 * time.Minute},
+		{after: 7 * time.Minute, want: []string{"1", "2"}},
+		{after: 10 * time.Minute},
+		{after: 11 * time.Minute, want: []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		if got := claim(t, st, start.Add(tt.after), 0, sched); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ClaimOrdersForAccrual() after %v = %v, want %v", tt.after, got, tt.want)
+		}
+	}
+
+	// a claimed order is skipped by the next claim, so agents share the orders
+	at := start.Add(time.Hour)
+	first := claim(t, st, at, 1, sched)
+	second := claim(t, st, at, 1, sched)
+	if len(first) != 1 || len(second) != 1 || first[0] == second[0] {
+		t.Errorf("claims of one order = %v and %v, want different orders", first, second)
+	}
+	if got := claim(t, st, at, 1, sched); len(got) != 0 {
+		t.Errorf("third claim = %v, want none", got)
+	}
+
+	updateAccrual(t, st, processed("1", 1_00))
+	if got, want := claim(t, st, start.Add(2*time.Hour), 0, sched), []string{"2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ClaimOrdersForAccrual() after a result = %v, want %v", got, want)
+	}
+}
+
+func testAccrualStale(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	setOrders(t, st, "alice", "1", "2", "3")
+	updateAccrual(t, st,
+		database.ProcessedOrder{Number: "2", Status: "REGISTERED"},
+		processed("3", 1_00),
+	)
+	sched := database.Schedule{Interval: time.Minute, MaxInterval: time.Hour, StaleAfter: time.Hour}
+
+	if got, want := claim(t, st, time.Now(), 0, sched), []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ClaimOrdersForAccrual() = %v, want %v", got, want)
+	}
+	if got := claim(t, st, time.Now().Add(2*time.Hour), 0, sched); len(got) != 0 {
+		t.Errorf("ClaimOrdersForAccrual() of stale orders = %v, want none", got)
+	}
+	for number, o := range ordersByNumber(t, st, "alice") {
+		want := "STALE"
+		if number == "3" {
+			want = "PROCESSED"
+		}
+		if o.Status != want {
+			t.Errorf("order %s status = %s, want %s", number, o.Status, want)
+		}
+	}
+	// stale orders are not polled any more, whatever the schedule
+	if got := claim(t, st, time.Now().Add(2*time.Hour), 0, database.Schedule{}); len(got) != 0 {
+		t.Errorf("ClaimOrdersForAccrual() without staleness = %v, want none", got)
+	}
+
+	// a recheck starts over
+	if err := st.RecheckOrder(context.Background(), "1"); err != nil {
+		t.Fatalf("RecheckOrder() error = %v", err)
+	}
+	if got, want := claim(t, st, time.Now().Add(30*time.Minute), 0, sched), []string{"1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ClaimOrdersForAccrual() after recheck = %v, want %v", got, want)
+	}
+}
+
+// leased claims the due orders with a lease of a minute
+func leased(t *testing.T, st database.Storage, at time.Time) []string {
+	t.Helper()
+	numbers, err := st.ClaimOrdersForAccrual(context.Background(), database.Claim{At: at, Lease: time.Minute})
+	if err != nil {
+		t.Fatalf("ClaimOrdersForAccrual() error = %v", err)
+	}
+	sort.Strings(numbers)
+	return numbers
+}
+
+func testAccrualLeases(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	setOrders(t, st, "alice", "1", "2")
+	start := time.Now().Truncate(time.Second)
+
+	// without a schedule the orders are due all the time, the leases keep
+	// them from the other agent
+	if got, want := leased(t, st, start), []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("agent a claimed %v, want %v", got, want)
+	}
+	if got := leased(t, st, start.Add(59*time.Second)); len(got) != 0 {
+		t.Errorf("agent b claimed %v while a holds the leases", got)
+	}
+
+	// a saved result ends the lease
+	updateAccrual(t, st, database.ProcessedOrder{Number: "1", Status: "REGISTERED"})
+	if got, want := leased(t, st, start.Add(59*time.Second)), []string{"1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("agent b claimed %v after a result, want %v", got, want)
+	}
+
+	// so does time, when the agent holding it fails
+	if got, want := leased(t, st, start.Add(time.Minute)), []string{"2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("agent b claimed %v after the lease ran out, want %v", got, want)
+	}
+}
+
+func testAccrualConcurrentClaims(t *testing.T, st database.Storage) {
+	const (
+		orders = 40
+		agents = 4
+	)
+	register(t, st, "alice")
+	for i := 0; i < orders; i++ {
+		setOrders(t, st, "alice", strconv.Itoa(i))
+	}
+	at := time.Now()
+
+	var (
+		mu      sync.Mutex
+		claimed = make(map[string]int)
+		wg      sync.WaitGroup
+	)
+	for a := 0; a < agents; a++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				numbers, err := st.ClaimOrdersForAccrual(context.Background(),
+					database.Claim{At: at, Limit: 3, Lease: time.Minute})
+				if err != nil {
+					t.Errorf("ClaimOrdersForAccrual() error = %v", err)
+					return
+				}
+				if len(numbers) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, number := range numbers {
+					claimed[number]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimed) != orders {
+		t.Errorf("%d orders claimed, want %d", len(claimed), orders)
+	}
+	for number, n := range claimed {
+		if n != 1 {
+			t.Errorf("order %s claimed %d times", number, n)
+		}
+	}
+}
+
+func testAccrualReportedTwice(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	setOrders(t, st, "alice", "1", "2")
+
+	// a callback racing a poll reports the order again, the rest of the
+	// batch goes through
+	updateAccrual(t, st, processed("1", 5_00))
+	updateAccrual(t, st, processed("1", 5_00), processed("2", 3_00))
+	if err := st.AddAccrualOperation([]database.ProcessedOrder{processed("2", 3_00)}); err != nil {
+		t.Fatalf("AddAccrualOperation() of a credited order error = %v", err)
+	}
+	ords := ordersByNumber(t, st, "alice")
+	for number, want := range map[string]database.Money{"1": 5_00, "2": 3_00} {
+		if o := ords[number]; o.Status != "PROCESSED" || o.Accrual == nil || *o.Accrual != want {
+			t.Errorf("order %s = %+v, want PROCESSED with %v", number, o, want)
+		}
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 8_00})
+}
+
+func testAccrualCreditedOnce(t *testing.T, st database.Storage) {
+	register(t, st, "alice")
+	setOrders(t, st, "alice", "1", "2")
+
+	// the accrual system reports the order PROCESSED on repeated ticks and to
+	// agents racing each other
+	updateAccrual(t, st, processed("1", 5_00), processed("1", 5_00))
+	updateAccrual(t, st, processed("1", 7_00))
+	updateAccrual(t, st, database.ProcessedOrder{Number: "1", Status: "PROCESSING"})
+	if err := st.AddAccrualOperation([]database.ProcessedOrder{processed("1", 5_00)}); err != nil {
+		t.Fatalf("AddAccrualOperation() of a credited order error = %v", err)
+	}
+	o := ordersByNumber(t, st, "alice")["1"]
+	if o.Status != "PROCESSED" || o.Accrual == nil || *o.Accrual != 5_00 {
+		t.Errorf("order credited again = %+v, want PROCESSED with 5.00", o)
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 5_00})
+
+	if err := st.AddAccrualOperation([]database.ProcessedOrder{processed("2", 1_00), processed("2", 1_00)}); err != nil {
+		t.Fatalf("AddAccrualOperation() error = %v", err)
+	}
+	updateAccrual(t, st, processed("2", 1_00))
+	if o = ordersByNumber(t, st, "alice")["2"]; o.Status != "PROCESSED" {
+		t.Errorf("order status = %s, want PROCESSED", o.Status)
+	}
+	checkBalance(t, st, "alice", database.Balance{Current: 6_00})
+
+	entries, _ := ledger(t, st, "alice", database.LedgerFilter{Types: []string{database.OperationAccrual}}, database.Page{})
+	if len(entries) != 2 {
+		t.Errorf("%d accruals recorded, want 2", len(entries))
+	}
+}
+
+func testIdempotencyKeys(t *testing.T, st database.Storage) {
+	register(t, st, "alice", "bob")
+	alice, bob := userCtx("alice"), userCtx("bob")
+	since := time.Now().Add(-time.Hour)
+	req := database.IdempotentRequest{Key: "k1", Fingerprint: "withdraw 1", Since: since}
+	other := database.IdempotentRequest{Key: "k1", Fingerprint: "withdraw 2", Since: since}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		req  database.IdempotentRequest
+		want error
+	}{
+		{name: "first request", ctx: alice, req: req},
+		{name: "repeat while pending", ctx: alice, req: req, want: database.ErrRequestPending},
+		{name: "key reused", ctx: alice, req: other, want: database.ErrKeyReused},
+		{name: "key of another user", ctx: bob, req: other},
+		{name: "unknown user", ctx: userCtx("carol"), req: req, want: database.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		saved, err := st.BeginRequest(tt.ctx, tt.req)
+		if !errors.Is(err, tt.want) || saved != nil {
+			t.Errorf("%s: BeginRequest() = %v, %v, want no response and %v", tt.name, saved, err, tt.want)
+		}
+	}
+
+	resp := database.SavedResponse{Status: 402, Body: []byte("no funds")}
+	if err := st.FinishRequest(alice, req.Key, resp); err != nil {
+		t.Fatalf("FinishRequest() error = %v", err)
+	}
+	// a served request isn't released
+	if err := st.ReleaseRequest(alice, req.Key); err != nil {
+		t.Fatalf("ReleaseRequest() error = %v", err)
+	}
+	saved, err := st.BeginRequest(alice, req)
+	if err != nil || saved == nil || !reflect.DeepEqual(*saved, resp) {
+		t.Errorf("BeginRequest() of a served request = %v, %v, want %v", saved, err, resp)
+	}
+	if _, err = st.BeginRequest(alice, other); !errors.Is(err, database.ErrKeyReused) {
+		t.Errorf("BeginRequest() reusing a served key error = %v, want %v", err, database.ErrKeyReused)
+	}
+
+	// a failed request is released and may be retried
+	if err = st.ReleaseRequest(bob, other.Key); err != nil {
+		t.Fatalf("ReleaseRequest() error = %v", err)
+	}
+	if saved, err = st.BeginRequest(bob, req); err != nil || saved != nil {
+		t.Errorf("BeginRequest() after release = %v, %v, want a new request", saved, err)
+	}
+
+	// a request pending past its lease is taken for lost, the repeat takes
+	// the key over and holds it for a lease of its own
+	lost, reused := req, other
+	lost.PendingSince = time.Now().Add(time.Hour)
+	reused.PendingSince = lost.PendingSince
+	if _, err = st.BeginRequest(bob, reused); !errors.Is(err, database.ErrKeyReused) {
+		t.Errorf("BeginRequest() reusing a lost key error = %v, want %v", err, database.ErrKeyReused)
+	}
+	if saved, err = st.BeginRequest(bob, lost); err != nil || saved != nil {
+		t.Errorf("BeginRequest() of a lost request = %v, %v, want a new request", saved, err)
+	}
+	if _, err = st.BeginRequest(bob, req); !errors.Is(err, database.ErrRequestPending) {
+		t.Errorf("BeginRequest() after a takeover error = %v, want %v", err, database.ErrRequestPending)
+	}
+
+	// keys are forgotten after the retention window
+	expired := req
+	expired.Fingerprint = "withdraw 3"
+	expired.Since = time.Now().Add(time.Hour)
+	if saved, err = st.BeginRequest(alice, expired); err != nil || saved != nil {
+		t.Errorf("BeginRequest() with an expired key = %v, %v, want a new request", saved, err)
+	}
+}